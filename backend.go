@@ -2,22 +2,45 @@ package oidc
 
 import (
 	"context"
+	"errors"
 	"github.com/patrickmn/go-cache"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-oidc"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/vault/helper/locksutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	configPath string = "config"
-	callbackPath string = "callback"
+	configPath       string = "config"
+	configPrefix     string = "config/"
+	callbackPath     string = "callback"
 	claimsConfigPath string = "claims"
-)
+	rolePrefix       string = "role/"
+	groupPrefix      string = "groups/"
+	authURLPath      string = "auth_url"
+	statePrefix      string = "state/"
+
+	// tidyInterval is how often the periodic function sweeps the expired
+	// login states
+	tidyInterval = 5 * time.Minute
 
+	// idpMaxIdleConnsPerHost is the number of idle connections kept to each
+	// Idp host
+	idpMaxIdleConnsPerHost = 32
 
+	// providerWaitTimeout bounds how long a login waits for the discovery
+	// started by another login
+	providerWaitTimeout = time.Minute
+)
 
 // Factory is used by framework
 func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, error) {
@@ -33,19 +56,40 @@ type openIDConnectAuthBackend struct {
 
 	l                  sync.RWMutex
 	stateCache         *cache.Cache
-	provider           *oidc.Provider
-	cachedConfig       *oidcConfig
+	providerCache      *cache.Cache
+	exchangeLimiters   *cache.Cache
+	lockouts           *cache.Cache
+	lockoutsLock       sync.Mutex
+	stateLocks         []*locksutil.LockEntry
+	idps               map[string]*idpEntry
+	defaultClient      *http.Client
+	cachedConfigs      map[string]*oidcConfig
 	cachedClaimsConfig *oidcClaimsConfig
 
 	providerCtx       context.Context
 	providerCtxCancel context.CancelFunc
+
+	// providerFlight runs one discovery at a time per config hash
+	providerFlight singleflight.Group
+
+	// lastTidy, tidying and storageUpgraded are only accessed atomically
+	lastTidy        int64
+	tidying         uint32
+	storageUpgraded uint32
 }
 
 func backend(c *logical.BackendConfig) *openIDConnectAuthBackend {
 	b := new(openIDConnectAuthBackend)
 	b.providerCtx, b.providerCtxCancel = context.WithCancel(context.Background())
 
+	b.idps = make(map[string]*idpEntry)
+	b.cachedConfigs = make(map[string]*oidcConfig)
+	b.defaultClient = cleanhttp.DefaultPooledClient()
 	b.stateCache = cache.New(5*time.Minute, 10*time.Minute)
+	b.providerCache = cache.New(time.Minute, 5*time.Minute)
+	b.exchangeLimiters = cache.New(10*time.Minute, 10*time.Minute)
+	b.lockouts = cache.New(defaultLockoutDuration, time.Minute)
+	b.stateLocks = locksutil.CreateLocks()
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeCredential,
 		Invalidate:  b.invalidate,
@@ -54,29 +98,88 @@ func backend(c *logical.BackendConfig) *openIDConnectAuthBackend {
 			Unauthenticated: []string{
 				"login",
 				"callback",
+				"auth_url",
+				"login/client",
+				"device/auth",
+				"device/poll",
+				"poll",
 			},
 			SealWrapStorage: []string{
 				"config",
+				// Each named provider stores its own client secret
+				"config/",
 				"secret-id",
-				"claims-config",
+				"claims",
 			},
-
 		},
 		Paths: framework.PathAppend(
 			[]*framework.Path{
 				pathLogin(b),
+				pathLoginClient(b),
+				pathAuthURL(b),
+				pathDeviceAuth(b),
+				pathDevicePoll(b),
 				pathCallback(b),
+				pathPoll(b),
+				pathConfigRotate(b),
 				pathConfig(b),
+				pathConfigList(b),
+				pathNamedConfig(b),
 				pathSecretID(b),
 				pathClaimsConfig(b),
+				pathRoleList(b),
+				pathRole(b),
+				pathGroupsList(b),
+				pathGroups(b),
+				pathTidy(b),
+				pathLockouts(b),
+				pathLockoutsClear(b),
+				pathDenyList(b),
 			},
 		),
-		Clean: b.cleanup,
+		AuthRenew:    b.pathLoginRenew,
+		PeriodicFunc: b.periodicFunc,
+		Clean:        b.cleanup,
 	}
 
 	return b
 }
 
+// periodicFunc is called every minute, the login states and the consumed
+// nonces are swept every tidyInterval only as listing them is costly with many
+// logins.
+func (b *openIDConnectAuthBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if err := b.upgradeStorage(ctx, req.Storage); err != nil {
+		b.Logger().Error("failed to upgrade storage", "error", err)
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&b.lastTidy)
+	if now-last < int64(tidyInterval) || !atomic.CompareAndSwapInt64(&b.lastTidy, last, now) {
+		return nil
+	}
+
+	if config, err := b.config(ctx, req.Storage); err == nil && config != nil {
+		if evicted := b.sweepStateCache(config.stateCacheMaxEntries()); evicted > 0 {
+			b.Logger().Warn("evicted pending device logins over state_cache_max_entries", "count", evicted)
+		}
+	}
+
+	deleted, err := b.tidyLoginStates(ctx, req.Storage)
+	if deleted > 0 {
+		b.Logger().Debug("deleted expired login states", "count", deleted)
+	}
+	if err != nil {
+		return err
+	}
+
+	deleted, err = b.tidyNonces(ctx, req.Storage)
+	if deleted > 0 {
+		b.Logger().Debug("deleted expired nonces", "count", deleted)
+	}
+	return err
+}
+
 func (b *openIDConnectAuthBackend) cleanup(_ context.Context) {
 	b.l.Lock()
 	if b.providerCtxCancel != nil {
@@ -86,51 +189,183 @@ func (b *openIDConnectAuthBackend) cleanup(_ context.Context) {
 }
 
 func (b *openIDConnectAuthBackend) invalidate(ctx context.Context, key string) {
-	switch key {
-	case "config":
-		b.reset()
-	case "claims":
-		b.reset()
+	// Config writes replicated from another node must drop the cached
+	// provider along with the cached config, the next login reads them from
+	// storage again. Roles, groups and the deny list are not cached.
+	switch {
+	case key == configPath:
+		b.resetConfig("")
+	case strings.HasPrefix(key, configPrefix):
+		b.resetConfig(strings.TrimPrefix(key, configPrefix))
+	case key == claimsConfigPath:
+		b.resetClaimsConfig()
+	}
+}
+
+// resetConfig drops the cached config and provider of the named config, ""
+// for the default one. The named configs inherit the mount settings of the
+// default config and are dropped along with it. Pending device logins are
+// kept, they complete with the provider they were started with.
+func (b *openIDConnectAuthBackend) resetConfig(name string) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if name == "" {
+		b.cachedConfigs = make(map[string]*oidcConfig)
+		// The exchange rate limits are mount settings
+		b.exchangeLimiters.Flush()
+	} else {
+		delete(b.cachedConfigs, name)
+	}
+	if entry, ok := b.idps[name]; ok {
+		entry.provider = nil
+		entry.providerHash = ""
+	}
+
+	// Group lookups were made with the credentials of the previous config
+	prefix := providerCacheKey(name, "")
+	for key := range b.providerCache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			b.providerCache.Delete(key)
+		}
 	}
 }
 
-func (b *openIDConnectAuthBackend) reset() {
+func (b *openIDConnectAuthBackend) resetClaimsConfig() {
 	b.l.Lock()
-	b.provider = nil
-	b.cachedConfig = nil
 	b.cachedClaimsConfig = nil
-	b.stateCache.Flush()
 	b.l.Unlock()
 }
 
-func (b *openIDConnectAuthBackend) getProvider(ctx context.Context, config *oidcConfig) (*oidc.Provider, error) {
-	b.l.RLock()
-	unlockFunc := b.l.RUnlock
-	defer func() { unlockFunc() }()
+// providerCacheKey returns the key of a lookup of provider_config in the
+// provider cache, prefixed with the config name so that a config write only
+// drops its own lookups. Config names can't contain ':'.
+func providerCacheKey(configName, key string) string {
+	return configName + ":" + key
+}
+
+// idpEntry is the cached provider and HTTP client of a config, keyed by the
+// config name. The client is kept when the provider is dropped.
+type idpEntry struct {
+	provider     *oidcProvider
+	providerHash string
+	client       *http.Client
+	clientHash   string
+}
 
-	if b.provider != nil {
-		return b.provider, nil
+// idpEntry returns the cache entry of the named config, it is created when
+// missing. The write lock must be held.
+func (b *openIDConnectAuthBackend) idpEntry(name string) *idpEntry {
+	entry, ok := b.idps[name]
+	if !ok {
+		entry = &idpEntry{}
+		b.idps[name] = entry
 	}
+	return entry
+}
 
+// getProvider returns the cached provider of the config, it is rebuilt when
+// the config it was created from has changed. Concurrent logins share a
+// single discovery and its error, they wait for it at most
+// providerWaitTimeout.
+func (b *openIDConnectAuthBackend) getProvider(ctx context.Context, config *oidcConfig) (*oidcProvider, error) {
+	hash, err := config.hash()
+	if err != nil {
+		return nil, err
+	}
+
+	b.l.RLock()
+	if entry := b.idps[config.name]; entry != nil && entry.provider != nil && entry.providerHash == hash {
+		provider := entry.provider
+		b.l.RUnlock()
+		return provider, nil
+	}
 	b.l.RUnlock()
-	b.l.Lock()
-	unlockFunc = b.l.Unlock
 
-	if b.provider != nil {
-		return b.provider, nil
+	result := b.providerFlight.DoChan(config.name+":"+hash, func() (interface{}, error) {
+		b.l.Lock()
+		client, err := b.sharedHTTPClient(config)
+		b.l.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		provider, err := b.createProvider(config, client)
+		loginMetricsFrom(ctx).measure(stageDiscovery, start)
+		if timeoutErr := idpTimeout(b.providerCtx, "discovery", err); timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		b.l.Lock()
+		entry := b.idpEntry(config.name)
+		entry.provider = provider
+		entry.providerHash = hash
+		b.l.Unlock()
+		return provider, nil
+	})
+
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*oidcProvider), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(providerWaitTimeout):
+		return nil, errors.New("timed out waiting for the provider discovery")
 	}
+}
 
-	provider, err := b.createProvider(config)
+// sharedHTTPClient returns the client used for all requests to the Idp of the
+// config. It is kept across config writes and only rebuilt when the CA
+// certificates, the proxy or the timeout change, so that logins reuse its
+// pooled connections. The write lock must be held.
+func (b *openIDConnectAuthBackend) sharedHTTPClient(config *oidcConfig) (*http.Client, error) {
+	hash, err := config.transportHash()
 	if err != nil {
 		return nil, err
 	}
+	entry := b.idpEntry(config.name)
+	if entry.client != nil && entry.clientHash == hash {
+		return entry.client, nil
+	}
 
-	b.provider = provider
-	return provider, nil
+	client, err := createHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if entry.client != nil {
+		if tr, ok := entry.client.Transport.(*http.Transport); ok {
+			tr.CloseIdleConnections()
+		}
+	}
+	entry.client = client
+	entry.clientHash = hash
+	return client, nil
+}
+
+// httpClient returns the client used for requests to the Idp. Login
+// operations set the client of their provider on the context with
+// oidcProvider.clientContext, a pooled default client is used otherwise.
+func (b *openIDConnectAuthBackend) httpClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && client != nil {
+		return client
+	}
+	return b.defaultClient
+}
+
+// clientContext returns a context making the oauth2 and go-oidc libraries
+// send their requests with the backend HTTP client.
+func (b *openIDConnectAuthBackend) clientContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, b.httpClient(ctx))
 }
 
 const (
 	backendHelp = `
 The OpenID Connect backend plugin allows authentication using OpenID code flow.
 `
-)
\ No newline at end of file
+)
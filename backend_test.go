@@ -0,0 +1,653 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/helper/logging"
+	"github.com/hashicorp/vault/logical"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	testClientID    = "vault"
+	testRedirectURL = "https://vault.example.com/ui/vault/auth/oidc/oidc/callback"
+
+	// testCode is the only authorization code the test Idp exchanges
+	testCode = "valid-code"
+)
+
+func getBackend(t *testing.T) (*openIDConnectAuthBackend, logical.Storage) {
+	config := &logical.BackendConfig{
+		Logger: logging.NewVaultLogger(log.Trace),
+		System: &logical.StaticSystemView{
+			DefaultLeaseTTLVal: 12 * time.Hour,
+			MaxLeaseTTLVal:     24 * time.Hour,
+		},
+		StorageView: &logical.InmemStorage{},
+	}
+
+	b, err := Factory(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+
+	return b.(*openIDConnectAuthBackend), config.StorageView
+}
+
+// testIdp is an OpenID Connect provider serving the discovery document, its
+// signing keys, UserInfo and a token endpoint. The token endpoint exchanges
+// testCode for an ID token with the claims and the nonce of the last login
+// started with startLogin, other codes are rejected as an Idp does.
+type testIdp struct {
+	*httptest.Server
+
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	// discoveryRequests counts the requests of the discovery document
+	discoveryRequests int32
+
+	l      sync.Mutex
+	claims map[string]interface{}
+	nonce  string
+	// tokenHandler replaces the token endpoint when set
+	tokenHandler http.HandlerFunc
+	// discoveryDelay slows down the discovery document, which fails with
+	// discoveryStatus when set
+	discoveryDelay  time.Duration
+	discoveryStatus int
+}
+
+func newTestIdp(t *testing.T) *testIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdp{
+		t:   t,
+		key: key,
+		claims: map[string]interface{}{
+			"sub":    "user-1",
+			"email":  "user@example.com",
+			"groups": []interface{}{"admins", "developers"},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.serveDiscovery)
+	mux.HandleFunc("/keys", idp.serveKeys)
+	mux.HandleFunc("/token", idp.serveToken)
+	mux.HandleFunc("/userinfo", idp.serveUserInfo)
+	idp.Server = httptest.NewServer(mux)
+
+	return idp
+}
+
+func (idp *testIdp) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&idp.discoveryRequests, 1)
+	idp.l.Lock()
+	delay, status := idp.discoveryDelay, idp.discoveryStatus
+	idp.l.Unlock()
+	time.Sleep(delay)
+	if status != 0 {
+		writeJSON(w, status, map[string]interface{}{"error": "temporarily_unavailable"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/auth",
+		"token_endpoint":                        idp.URL + "/token",
+		"userinfo_endpoint":                     idp.URL + "/userinfo",
+		"jwks_uri":                              idp.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *testIdp) serveKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{
+			{Key: &idp.key.PublicKey, KeyID: "test-key", Algorithm: string(jose.RS256), Use: "sig"},
+		},
+	})
+}
+
+func (idp *testIdp) serveToken(w http.ResponseWriter, r *http.Request) {
+	idp.l.Lock()
+	handler := idp.tokenHandler
+	idp.l.Unlock()
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("code") != testCode {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":             "invalid_grant",
+			"error_description": "the authorization code is invalid or expired",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "test-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idp.idToken(nil),
+	})
+}
+
+func (idp *testIdp) serveUserInfo(w http.ResponseWriter, r *http.Request) {
+	idp.l.Lock()
+	defer idp.l.Unlock()
+	writeJSON(w, http.StatusOK, idp.claims)
+}
+
+// idToken returns an ID token signed by the Idp with its claims, the nonce of
+// the last login and the given claims set over them.
+func (idp *testIdp) idToken(claims map[string]interface{}) string {
+	idp.l.Lock()
+	payload := map[string]interface{}{
+		"iss":   idp.URL,
+		"aud":   testClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": idp.nonce,
+	}
+	for k, v := range idp.claims {
+		payload[k] = v
+	}
+	idp.l.Unlock()
+	for k, v := range claims {
+		payload[k] = v
+	}
+
+	return signToken(idp.t, jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: idp.key, KeyID: "test-key"},
+	}, payload)
+}
+
+func (idp *testIdp) setClaim(name string, value interface{}) {
+	idp.l.Lock()
+	defer idp.l.Unlock()
+	idp.claims[name] = value
+}
+
+func (idp *testIdp) setNonce(nonce string) {
+	idp.l.Lock()
+	defer idp.l.Unlock()
+	idp.nonce = nonce
+}
+
+func (idp *testIdp) setDiscovery(delay time.Duration, status int) {
+	idp.l.Lock()
+	defer idp.l.Unlock()
+	idp.discoveryDelay = delay
+	idp.discoveryStatus = status
+}
+
+func (idp *testIdp) setTokenHandler(handler http.HandlerFunc) {
+	idp.l.Lock()
+	defer idp.l.Unlock()
+	idp.tokenHandler = handler
+}
+
+// configure writes the config and the claims of the backend for the Idp, the
+// given fields are set over the defaults.
+func (idp *testIdp) configure(b *openIDConnectAuthBackend, s logical.Storage, config, claims map[string]interface{}) {
+	data := map[string]interface{}{
+		"oidc_discovery_url": idp.URL,
+		"client_id":          testClientID,
+		"secret_id":          "test-secret",
+		"redirect_url":       testRedirectURL,
+	}
+	for k, v := range config {
+		data[k] = v
+	}
+	writeOK(idp.t, b, s, "config", data)
+
+	data = map[string]interface{}{
+		"user_claim":   "email",
+		"groups_claim": "groups",
+	}
+	for k, v := range claims {
+		data[k] = v
+	}
+	writeOK(idp.t, b, s, "claims", data)
+}
+
+// startLogin creates the auth URL of a new login and returns its state, the
+// Idp puts its nonce in the next ID tokens.
+func (idp *testIdp) startLogin(b *openIDConnectAuthBackend, s logical.Storage) string {
+	return idp.startRoleLogin(b, s, "")
+}
+
+// startRoleLogin is startLogin with the given role.
+func (idp *testIdp) startRoleLogin(b *openIDConnectAuthBackend, s logical.Storage, role string) string {
+	var data map[string]interface{}
+	if role != "" {
+		data = map[string]interface{}{"role": role}
+	}
+	resp := writeOK(idp.t, b, s, "auth_url", data)
+	authURL, err := url.Parse(resp.Data["auth_url"].(string))
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	idp.setNonce(authURL.Query().Get("nonce"))
+	return authURL.Query().Get("state")
+}
+
+// callback completes the login of the state with the given code.
+func callback(b *openIDConnectAuthBackend, s logical.Storage, state, code string) (*logical.Request, *logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "callback",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"state": state,
+			"code":  code,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	return req, resp, err
+}
+
+// writeOK writes the data to the path and fails the test on errors and error
+// responses.
+func writeOK(t *testing.T, b *openIDConnectAuthBackend, s logical.Storage, path string, data map[string]interface{}) *logical.Response {
+	t.Helper()
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      path,
+		Storage:   s,
+		Data:      data,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("error writing %s: err: %v resp: %#v", path, err, resp)
+	}
+
+	return resp
+}
+
+// readOK reads the path and fails the test on errors and error responses.
+func readOK(t *testing.T, b *openIDConnectAuthBackend, s logical.Storage, path string) *logical.Response {
+	t.Helper()
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      path,
+		Storage:   s,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("error reading %s: err: %v resp: %#v", path, err, resp)
+	}
+
+	return resp
+}
+
+func signToken(t *testing.T, key jose.SigningKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(key, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// putJSON stores the value as a replicated write from another node does,
+// without going through the backend.
+func putJSON(t *testing.T, s logical.Storage, key string, value interface{}) {
+	entry, err := logical.StorageEntryJSON(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loginAlias(t *testing.T, idp *testIdp, b *openIDConnectAuthBackend, s logical.Storage) string {
+	t.Helper()
+
+	_, resp, err := callback(b, s, idp.startLogin(b, s), testCode)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("login failed: err: %v resp: %#v", err, resp)
+	}
+	return resp.Auth.Alias.Name
+}
+
+func TestInvalidate_ClaimsConfig(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, nil, nil)
+
+	if alias := loginAlias(t, idp, b, storage); alias != "user@example.com" {
+		t.Fatalf("unexpected alias %q", alias)
+	}
+
+	claimsConfig, err := b.claimsConfig(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicated := *claimsConfig
+	replicated.UserClaim = "sub"
+	replicated.DisplayNameClaim = "sub"
+	putJSON(t, storage, claimsConfigPath, &replicated)
+
+	// The cached claims config is used until it is invalidated
+	if alias := loginAlias(t, idp, b, storage); alias != "user@example.com" {
+		t.Fatalf("unexpected alias %q before the invalidation", alias)
+	}
+
+	b.InvalidateKey(context.Background(), claimsConfigPath)
+	if alias := loginAlias(t, idp, b, storage); alias != "user-1" {
+		t.Fatalf("the login didn't read the replicated claims config, alias %q", alias)
+	}
+}
+
+func TestInvalidate_Config(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, nil, nil)
+	loginAlias(t, idp, b, storage)
+	if entry := b.idps[""]; entry == nil || entry.provider == nil {
+		t.Fatal("the provider was not cached by the login")
+	}
+
+	config, err := b.config(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicated := *config
+	replicated.BoundAudiences = []string{"another-client"}
+	putJSON(t, storage, configPath, &replicated)
+
+	b.InvalidateKey(context.Background(), configPath)
+	if entry := b.idps[""]; entry.provider != nil || entry.providerHash != "" {
+		t.Fatal("the cached provider was not dropped")
+	}
+	if len(b.cachedConfigs) != 0 {
+		t.Fatalf("the cached configs were not dropped: %#v", b.cachedConfigs)
+	}
+
+	_, resp, err := callback(b, storage, idp.startLogin(b, storage), testCode)
+	if err != nil || resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "bound audiences") {
+		t.Fatalf("the login didn't read the replicated config: err: %v resp: %#v", err, resp)
+	}
+}
+
+func TestInvalidate_NamedConfig(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, nil, nil)
+	loginAlias(t, idp, b, storage)
+
+	b.idps["partners"] = &idpEntry{provider: &oidcProvider{}, providerHash: "hash"}
+	b.providerCache.SetDefault(providerCacheKey("", "groups/user-1"), []string{"admins"})
+	b.providerCache.SetDefault(providerCacheKey("partners", "groups/user-1"), []string{"partners"})
+
+	b.InvalidateKey(context.Background(), configPrefix+"partners")
+	if b.idps["partners"].provider != nil {
+		t.Fatal("the provider of the named config was not dropped")
+	}
+	if _, ok := b.providerCache.Get(providerCacheKey("partners", "groups/user-1")); ok {
+		t.Fatal("the lookups of the named config were not dropped")
+	}
+	if b.idps[""].provider == nil {
+		t.Fatal("the provider of the default config was dropped")
+	}
+	if _, ok := b.providerCache.Get(providerCacheKey("", "groups/user-1")); !ok {
+		t.Fatal("the lookups of the default config were dropped")
+	}
+	if _, ok := b.cachedConfigs[""]; !ok {
+		t.Fatal("the default config was dropped")
+	}
+}
+
+// startLogins starts count logins at once and returns the responses and the
+// errors of their auth URL requests.
+func startLogins(b *openIDConnectAuthBackend, s logical.Storage, count int) ([]*logical.Response, []error) {
+	resps := make([]*logical.Response, count)
+	errs := make([]error, count)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			resps[i], errs[i] = b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "auth_url",
+				Storage:   s,
+			})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	return resps, errs
+}
+
+func TestGetProvider_SingleDiscovery(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, map[string]interface{}{"skip_validation": true}, nil)
+	idp.setDiscovery(500*time.Millisecond, 0)
+
+	resps, errs := startLogins(b, storage, 100)
+	for i := range resps {
+		if errs[i] != nil || resps[i] == nil || resps[i].IsError() {
+			t.Fatalf("login %d failed: err: %v resp: %#v", i, errs[i], resps[i])
+		}
+	}
+	if hits := atomic.LoadInt32(&idp.discoveryRequests); hits != 1 {
+		t.Fatalf("expected a single discovery, got %d", hits)
+	}
+}
+
+func TestGetProvider_SharedError(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, map[string]interface{}{"skip_validation": true}, nil)
+	idp.setDiscovery(500*time.Millisecond, http.StatusServiceUnavailable)
+
+	_, errs := startLogins(b, storage, 100)
+	for i, err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "error creating provider") {
+			t.Fatalf("login %d didn't get the discovery error: %v", i, err)
+		}
+	}
+	if hits := atomic.LoadInt32(&idp.discoveryRequests); hits != 1 {
+		t.Fatalf("expected a single discovery, got %d", hits)
+	}
+
+	// The error is not cached, the next login discovers the provider again
+	idp.setDiscovery(0, 0)
+	writeOK(t, b, storage, "auth_url", nil)
+	if hits := atomic.LoadInt32(&idp.discoveryRequests); hits != 2 {
+		t.Fatalf("expected a second discovery, got %d", hits)
+	}
+}
+
+func TestGetProvider_BoundedWait(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, map[string]interface{}{"skip_validation": true}, nil)
+	idp.setDiscovery(2*time.Second, 0)
+
+	config, err := b.config(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := b.getProvider(ctx, config); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("waited for the discovery for %s", waited)
+	}
+}
+
+// newTLSTokenServer starts a TLS server answering like a token endpoint and
+// returns a config trusting its certificate. The connections opened to the
+// server are counted.
+func newTLSTokenServer(tb testing.TB) (*httptest.Server, *oidcConfig, *int32) {
+	connections := new(int32)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+		})
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(connections, 1)
+		}
+	}
+	server.StartTLS()
+
+	config := &oidcConfig{
+		OIDCDiscoveryCAPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+	}
+	return server, config, connections
+}
+
+func postToken(client *http.Client, tokenURL string) error {
+	resp, err := client.PostForm(tokenURL, url.Values{"code": {testCode}})
+	if err != nil {
+		return err
+	}
+	// The body must be read for the connection to be reused
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return err
+}
+
+func TestSharedHTTPClient(t *testing.T) {
+	b, _ := getBackend(t)
+	server, config, connections := newTLSTokenServer(t)
+	defer server.Close()
+
+	b.l.Lock()
+	client, err := b.sharedHTTPClient(config)
+	b.l.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := postToken(client, server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := atomic.LoadInt32(connections); count != 1 {
+		t.Fatalf("expected the requests to share a connection, %d were opened", count)
+	}
+
+	// Config writes keep the client unless its transport settings change
+	b.resetConfig("")
+	b.l.Lock()
+	kept, err := b.sharedHTTPClient(config)
+	b.l.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept != client {
+		t.Fatal("the client was rebuilt without transport changes")
+	}
+
+	changed := *config
+	changed.ProviderRequestTimeout = time.Minute
+	b.l.Lock()
+	rebuilt, err := b.sharedHTTPClient(&changed)
+	b.l.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt == client || rebuilt.Timeout != time.Minute {
+		t.Fatal("the client was not rebuilt with the new timeout")
+	}
+}
+
+// BenchmarkIdpRequest_SharedClient and BenchmarkIdpRequest_NewClient compare
+// the latency of the Idp requests of a login with the shared client, which
+// reuses its TLS connections, and with a client created for each login.
+func BenchmarkIdpRequest_SharedClient(b *testing.B) {
+	server, config, _ := newTLSTokenServer(b)
+	defer server.Close()
+	client, err := createHTTPClient(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := postToken(client, server.URL); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIdpRequest_NewClient(b *testing.B) {
+	server, config, _ := newTLSTokenServer(b)
+	defer server.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, err := createHTTPClient(config)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := postToken(client, server.URL); err != nil {
+			b.Fatal(err)
+		}
+		client.Transport.(*http.Transport).CloseIdleConnections()
+	}
+}
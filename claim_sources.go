@@ -0,0 +1,152 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+const (
+	// claimSourcesTimeout bounds the time spent fetching distributed claims
+	claimSourcesTimeout = 10 * time.Second
+
+	// maxClaimSourceSize bounds the size of fetched claim JWTs
+	maxClaimSourceSize = 1 << 20
+)
+
+// resolveClaimSources replaces the aggregated and distributed claims listed in
+// _claim_names with their values, as described in section 5.6.2 of OpenID
+// Connect Core. Aggregated claims are embedded as JWTs and distributed claims
+// are fetched from the source endpoint, both are verified against the provider
+// keys. Only one level is resolved, the claims already present are kept.
+func (b *openIDConnectAuthBackend) resolveClaimSources(ctx context.Context, config *oidcConfig, provider *oidcProvider,
+	allClaims map[string]interface{}) error {
+	names, _ := allClaims["_claim_names"].(map[string]interface{})
+	if len(names) == 0 {
+		return nil
+	}
+	sources, _ := allClaims["_claim_sources"].(map[string]interface{})
+
+	ctx, cancel := context.WithTimeout(ctx, claimSourcesTimeout)
+	defer cancel()
+
+	// Several claims may come from the same source, which is only fetched once
+	bySource := make(map[string][]string)
+	for claim, source := range names {
+		if _, ok := allClaims[claim]; ok {
+			continue
+		}
+		sourceName, ok := source.(string)
+		if !ok {
+			return fmt.Errorf("could not resolve claim %q: invalid _claim_names entry", claim)
+		}
+		bySource[sourceName] = append(bySource[sourceName], claim)
+	}
+
+	sourceNames := make([]string, 0, len(bySource))
+	for sourceName := range bySource {
+		sourceNames = append(sourceNames, sourceName)
+	}
+	sort.Strings(sourceNames)
+
+	for _, sourceName := range sourceNames {
+		claims := bySource[sourceName]
+		sort.Strings(claims)
+
+		values, err := b.claimSourceClaims(ctx, config, provider, sources[sourceName])
+		if err != nil {
+			return fmt.Errorf("could not resolve claim %q from source %q: %s", claims[0], sourceName, err)
+		}
+		for _, claim := range claims {
+			value, ok := values[claim]
+			if !ok {
+				return fmt.Errorf("could not resolve claim %q: it is missing from source %q", claim, sourceName)
+			}
+			allClaims[claim] = value
+		}
+	}
+
+	return nil
+}
+
+// claimSourceClaims verifies the JWT of an aggregated claim source, or fetches
+// it from a distributed one, and returns its claims.
+func (b *openIDConnectAuthBackend) claimSourceClaims(ctx context.Context, config *oidcConfig, provider *oidcProvider,
+	rawSource interface{}) (map[string]interface{}, error) {
+	source, ok := rawSource.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the source is missing from _claim_sources")
+	}
+
+	rawJWT, _ := source["JWT"].(string)
+	if rawJWT == "" {
+		endpoint, _ := source["endpoint"].(string)
+		if endpoint == "" {
+			return nil, errors.New("the source has neither a JWT nor an endpoint")
+		}
+		accessToken, _ := source["access_token"].(string)
+
+		var err error
+		if rawJWT, err = b.fetchClaimSource(ctx, endpoint, accessToken); err != nil {
+			return nil, err
+		}
+	}
+
+	// Claim JWTs are issued by the provider but not for Vault
+	token, err := b.verifyToken(ctx, config, provider, true, rawJWT)
+	if err != nil {
+		return nil, errwrap.Wrapf("could not verify the claims JWT: {{err}}", err)
+	}
+
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+
+	return claims, nil
+}
+
+func (b *openIDConnectAuthBackend) fetchClaimSource(ctx context.Context, endpoint, accessToken string) (string, error) {
+	if !strings.HasPrefix(endpoint, "https://") {
+		return "", fmt.Errorf("the source endpoint %q is not an https URL", endpoint)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	req.Header.Set("Accept", "application/jwt")
+
+	resp, err := b.httpClient(ctx).Do(req.WithContext(ctx))
+	if timeoutErr := idpTimeout(ctx, "claim source", err); timeoutErr != nil {
+		return "", timeoutErr
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxClaimSourceSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(body) > maxClaimSourceSize {
+		return "", errors.New("the source endpoint response is too large")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the source endpoint returned status %d", resp.StatusCode)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,190 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	defaultMount           = "oidc"
+	defaultListenAddress   = "localhost"
+	defaultPort            = "8250"
+	defaultCallbackTimeout = 2 * time.Minute
+)
+
+// CLIHandler logs in from the Vault CLI. It starts the login with the
+// auth_url endpoint, opens the browser on the Idp and waits for the redirect
+// on a local listener to complete the login with the callback endpoint.
+type CLIHandler struct{}
+
+type loginResp struct {
+	secret *api.Secret
+	err    error
+}
+
+func (h *CLIHandler) Auth(c *api.Client, m map[string]string) (*api.Secret, error) {
+	mount, ok := m["mount"]
+	if !ok {
+		mount = defaultMount
+	}
+
+	port, ok := m["port"]
+	if !ok {
+		port = defaultPort
+	}
+
+	timeout := defaultCallbackTimeout
+	if raw, ok := m["timeout"]; ok {
+		var err error
+		timeout, err = time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %s", raw, err)
+		}
+	}
+
+	redirectURI := fmt.Sprintf("http://%s:%s/oidc/callback", defaultListenAddress, port)
+
+	secret, err := c.Logical().Write(fmt.Sprintf("auth/%s/%s", mount, authURLPath), map[string]interface{}{
+		"role":         m["role"],
+		"redirect_uri": redirectURI,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("no response from the auth_url endpoint")
+	}
+	authURL, ok := secret.Data["auth_url"].(string)
+	if !ok || authURL == "" {
+		return nil, errors.New("the auth_url endpoint did not return an authorization URL")
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(defaultListenAddress, port))
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	doneCh := make(chan loginResp, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oidc/callback", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+
+		var resp loginResp
+		if idpErr := query.Get("error"); idpErr != "" {
+			resp.err = fmt.Errorf("login failed at the Idp: %s %s", idpErr, query.Get("error_description"))
+		} else {
+			resp.secret, resp.err = c.Logical().ReadWithData(fmt.Sprintf("auth/%s/%s", mount, callbackPath), map[string][]string{
+				"code":  {query.Get("code")},
+				"state": {query.Get("state")},
+			})
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if resp.err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, cliResultPage, "Vault login failed, check your terminal for the error.")
+		} else {
+			fmt.Fprintf(w, cliResultPage, "Vault login succeeded, you may close this window.")
+		}
+
+		select {
+		case doneCh <- resp:
+		default:
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	if err := openURL(authURL); err != nil {
+		fmt.Fprintf(os.Stderr, "Complete the login via your OIDC provider. Open the following URL in your browser:\n\n    %s\n\n", authURL)
+	} else {
+		fmt.Fprintf(os.Stderr, "Complete the login via your OIDC provider. Launching browser to:\n\n    %s\n\n", authURL)
+	}
+	fmt.Fprintf(os.Stderr, "Waiting for OIDC authentication to complete...\n")
+
+	select {
+	case resp := <-doneCh:
+		if resp.err != nil {
+			return nil, resp.err
+		}
+		return resp.secret, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out after %s waiting for the Idp redirect", timeout)
+	}
+}
+
+// openURL opens the URL in the default browser of the system.
+func openURL(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return errors.New("no display available to launch a browser")
+		}
+		cmd = exec.Command("xdg-open", url)
+	}
+
+	return cmd.Start()
+}
+
+func (h *CLIHandler) Help() string {
+	help := `
+Usage: vault login -method=oidc [CONFIG K=V...]
+
+  The OIDC auth method allows users to authenticate using an OpenID Connect
+  provider. The login flow is started in the browser and completed through
+  a listener waiting for the provider redirect on localhost.
+
+  Authenticate using role "engineering":
+
+      $ vault login -method=oidc role=engineering
+
+  The redirect URI http://localhost:8250/oidc/callback, with the chosen port,
+  must be allowed by the provider client and by the role.
+
+Configuration:
+
+  mount=<string>
+      Path where the OIDC auth method is mounted. Defaults to "oidc".
+
+  role=<string>
+      Role to log in against, optional.
+
+  port=<string>
+      Local port the listener waits for the redirect on. Defaults to "8250".
+
+  timeout=<duration>
+      How long to wait for the login to complete. Defaults to "2m".
+`
+
+	return strings.TrimSpace(help)
+}
+
+const cliResultPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Vault Login - SSO</title>
+</head>
+<body>
+    <p>%s</p>
+</body>
+</html>
+`
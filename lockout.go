@@ -0,0 +1,120 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// defaultLockoutDuration is how long logins are rejected after
+// lockout_threshold failures when lockout_duration is not set.
+const defaultLockoutDuration = 5 * time.Minute
+
+// lockoutReasons are the login failures counted towards the lockout. Idp
+// errors, such as users cancelling the login, and errors of Vault are not.
+// Neither are invalid states and failed code exchanges, anyone can send them
+// and a source behind a proxy would be locked out for all its users.
+var lockoutReasons = map[string]bool{
+	reasonTokenInvalid:        true,
+	reasonNonceMismatch:       true,
+	reasonTokenRejected:       true,
+	reasonClaimsMappingFailed: true,
+}
+
+// loginFailures counts the consecutive failed logins of a subject or a
+// source, they are kept in the lockouts cache for lockout_duration.
+type loginFailures struct {
+	Count       int
+	LockedUntil time.Time
+}
+
+func lockoutSubjectKey(subject string) string {
+	return "subject:" + subject
+}
+
+func lockoutSourceKey(source string) string {
+	return "source:" + source
+}
+
+// lockedOut returns the time until which logins of the key are rejected, the
+// zero time when they are not.
+func (b *openIDConnectAuthBackend) lockedOut(config *oidcConfig, key string) time.Time {
+	if config.LockoutThreshold <= 0 {
+		return time.Time{}
+	}
+
+	b.lockoutsLock.Lock()
+	defer b.lockoutsLock.Unlock()
+	cached, ok := b.lockouts.Get(key)
+	if !ok {
+		return time.Time{}
+	}
+	if lockedUntil := cached.(*loginFailures).LockedUntil; time.Now().Before(lockedUntil) {
+		return lockedUntil
+	}
+	return time.Time{}
+}
+
+// recordLogin resets the failures of the keys after a successful login and
+// counts the failures otherwise. The keys are locked out for lockout_duration
+// once lockout_threshold consecutive failures are reached.
+func (b *openIDConnectAuthBackend) recordLogin(config *oidcConfig, succeeded bool, keys ...string) {
+	if config.LockoutThreshold <= 0 {
+		return
+	}
+
+	b.lockoutsLock.Lock()
+	defer b.lockoutsLock.Unlock()
+	for _, key := range keys {
+		if succeeded {
+			b.lockouts.Delete(key)
+			continue
+		}
+
+		failures := &loginFailures{}
+		if cached, ok := b.lockouts.Get(key); ok {
+			failures = cached.(*loginFailures)
+		}
+		failures.Count++
+		if failures.Count >= config.LockoutThreshold {
+			failures.LockedUntil = time.Now().Add(config.lockoutDuration())
+			b.Logger().Warn("too many failed logins, locking out", "key", key, "until", failures.LockedUntil)
+		}
+		b.lockouts.Set(key, failures, config.lockoutDuration())
+	}
+}
+
+// lockedOutResponse is returned without contacting the Idp while a subject or
+// a source is locked out.
+func lockedOutResponse(ctx context.Context, lockedUntil time.Time) *logical.Response {
+	loginMetricsFrom(ctx).fail(reasonLockedOut)
+	return logical.ErrorResponse(fmt.Sprintf("too many failed logins, retry after %s", lockedUntil.UTC().Format(time.RFC3339)))
+}
+
+// clearLockout deletes the failures of the key, it reports whether there were
+// any.
+func (b *openIDConnectAuthBackend) clearLockout(key string) bool {
+	b.lockoutsLock.Lock()
+	defer b.lockoutsLock.Unlock()
+
+	_, ok := b.lockouts.Get(key)
+	b.lockouts.Delete(key)
+	return ok
+}
+
+// lockedKeys returns the subjects and sources currently locked out.
+func (b *openIDConnectAuthBackend) lockedKeys() map[string]time.Time {
+	b.lockoutsLock.Lock()
+	defer b.lockoutsLock.Unlock()
+
+	locked := map[string]time.Time{}
+	now := time.Now()
+	for key, item := range b.lockouts.Items() {
+		if lockedUntil := item.Object.(*loginFailures).LockedUntil; now.Before(lockedUntil) {
+			locked[key] = lockedUntil
+		}
+	}
+	return locked
+}
@@ -0,0 +1,151 @@
+package oidc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/consts"
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// loginState is kept in storage between the start of the login flow and the
+// callback, keyed by the state parameter. The nonce is generated independently
+// and checked against the ID token.
+type loginState struct {
+	Nonce        string    `json:"nonce"`
+	Role         string    `json:"role"`
+	RedirectURI  string    `json:"redirect_uri"`
+	CodeVerifier string    `json:"code_verifier"`
+	Expiration   time.Time `json:"expiration"`
+
+	// ClientNonce is set for logins completed by the poll endpoint, Code or
+	// IDToken are set once the callback received the authorization response
+	ClientNonce string `json:"client_nonce"`
+	Code        string `json:"code"`
+	IDToken     string `json:"id_token"`
+}
+
+func (b *openIDConnectAuthBackend) storeLoginState(ctx context.Context, s logical.Storage, stateID string, state *loginState) error {
+	entry, err := logical.StorageEntryJSON(statePrefix+stateID, state)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// readLoginState returns the login state, nil is returned for unknown and
+// expired states.
+func (b *openIDConnectAuthBackend) readLoginState(ctx context.Context, s logical.Storage, stateID string) (*loginState, error) {
+	entry, err := s.Get(ctx, statePrefix+stateID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	state := &loginState{}
+	if err := entry.DecodeJSON(state); err != nil {
+		return nil, err
+	}
+	if time.Now().After(state.Expiration) {
+		return nil, nil
+	}
+
+	return state, nil
+}
+
+// takeLoginState returns the login state and deletes it, so that a state is
+// only used once. Nil is returned for unknown, expired and already used
+// states. The read and the delete happen under the lock of the state, of
+// concurrent requests with the same state only one gets it. The lock only
+// exists on this node, the state is only taken on the active node for the
+// guarantee to hold for the cluster.
+func (b *openIDConnectAuthBackend) takeLoginState(ctx context.Context, s logical.Storage, stateID string) (*loginState, error) {
+	if err := b.requireActiveNode(); err != nil {
+		return nil, err
+	}
+
+	lock := locksutil.LockForKey(b.stateLocks, stateID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	state, err := b.readLoginState(ctx, s, stateID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Delete(ctx, statePrefix+stateID); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// requireActiveNode returns logical.ErrReadOnly on performance standbys, Vault
+// then forwards the request to the active node. Login states and nonces are
+// checked and used up under the locks of the active node only, two nodes
+// can't both accept the same one. Standbys without performance mode forward
+// every request already.
+func (b *openIDConnectAuthBackend) requireActiveNode() error {
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceStandby) {
+		return logical.ErrReadOnly
+	}
+	return nil
+}
+
+// storageError wraps the errors of the login states and nonces, except
+// logical.ErrReadOnly which must be returned as is for Vault to forward the
+// request to the active node.
+func storageError(msg string, err error) error {
+	if err == logical.ErrReadOnly {
+		return err
+	}
+	return errwrap.Wrapf(msg+": {{err}}", err)
+}
+
+// tidyLoginStates deletes the states of logins which were never completed and
+// returns how many were deleted. States still within their TTL are kept. Only
+// one tidy runs at a time, a tidy started meanwhile returns right away.
+func (b *openIDConnectAuthBackend) tidyLoginStates(ctx context.Context, s logical.Storage) (int, error) {
+	if !atomic.CompareAndSwapUint32(&b.tidying, 0, 1) {
+		return 0, nil
+	}
+	defer atomic.StoreUint32(&b.tidying, 0)
+
+	stateIDs, err := s.List(ctx, statePrefix)
+	if err != nil {
+		return 0, errwrap.Wrapf("error listing login states: {{err}}", err)
+	}
+
+	deleted := 0
+	now := time.Now()
+	for _, stateID := range stateIDs {
+		if ctx.Err() != nil {
+			return deleted, ctx.Err()
+		}
+
+		entry, err := s.Get(ctx, statePrefix+stateID)
+		if err != nil {
+			return deleted, errwrap.Wrapf("error reading login state: {{err}}", err)
+		}
+		if entry == nil {
+			continue
+		}
+
+		state := &loginState{}
+		if err := entry.DecodeJSON(state); err == nil && now.Before(state.Expiration) {
+			continue
+		}
+		if err := s.Delete(ctx, statePrefix+stateID); err != nil {
+			return deleted, errwrap.Wrapf("error deleting login state: {{err}}", err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
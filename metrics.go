@@ -0,0 +1,175 @@
+package oidc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// Failure reasons of the login metrics, they are part of the metric labels
+// and must not be renamed.
+const (
+	reasonStateInvalid        = "state_invalid"
+	reasonIdpError            = "idp_error"
+	reasonExchangeFailed      = "exchange_failed"
+	reasonTokenInvalid        = "token_invalid"
+	reasonNonceMismatch       = "nonce_mismatch"
+	reasonTokenRejected       = "token_rejected"
+	reasonUserInfoFailed      = "userinfo_failed"
+	reasonGroupsFailed        = "groups_failed"
+	reasonClaimsMappingFailed = "claims_mapping_failed"
+	reasonRateLimited         = "rate_limited"
+	reasonLockedOut           = "locked_out"
+	reasonDenied              = "denied"
+	reasonLoginRejected       = "login_rejected"
+	reasonInternalError       = "internal_error"
+)
+
+// Idp round trips measured by the login metrics.
+const (
+	stageDiscovery = "discovery"
+	stageExchange  = "exchange"
+	stageUserInfo  = "userinfo"
+)
+
+type loginMetricsKey struct{}
+
+// loginMetrics records the outcome of one login and the latency of its Idp
+// round trips. The metrics are named auth.oidc.login.{success,failure} and
+// auth.oidc.idp.<stage>, labelled with the mount and the login flow so that
+// dashboards don't depend on the mount path. A nil loginMetrics records the
+// latencies without labels, for requests which are not logins.
+type loginMetrics struct {
+	labels []metrics.Label
+	reason string
+
+	// subject is set once the token is verified, failures are counted
+	// towards its lockout
+	subject string
+}
+
+func newLoginMetrics(req *logical.Request, flow string) *loginMetrics {
+	return &loginMetrics{
+		labels: []metrics.Label{
+			{Name: "mount", Value: strings.TrimSuffix(req.MountPoint, "/")},
+			{Name: "flow", Value: flow},
+		},
+	}
+}
+
+// withLoginMetrics returns a context carrying the login metrics, the login
+// helpers record the failure reason and latencies through it.
+func withLoginMetrics(ctx context.Context, m *loginMetrics) context.Context {
+	return context.WithValue(ctx, loginMetricsKey{}, m)
+}
+
+func loginMetricsFrom(ctx context.Context) *loginMetrics {
+	m, _ := ctx.Value(loginMetricsKey{}).(*loginMetrics)
+	return m
+}
+
+func (m *loginMetrics) setSubject(subject string) {
+	if m != nil {
+		m.subject = subject
+	}
+}
+
+// fail sets the failure reason, the first reason set is kept.
+func (m *loginMetrics) fail(reason string) {
+	if m != nil && m.reason == "" {
+		m.reason = reason
+	}
+}
+
+func (m *loginMetrics) measure(stage string, start time.Time) {
+	var labels []metrics.Label
+	if m != nil {
+		labels = m.labels
+	}
+	metrics.MeasureSinceWithLabels([]string{"auth", "oidc", "idp", stage}, start, labels)
+}
+
+// done records the outcome of the login. Responses without a token which are
+// neither errors nor failures, such as pending polls, are not counted.
+func (m *loginMetrics) done(resp *logical.Response, err error) {
+	if m == nil {
+		return
+	}
+
+	switch {
+	case err == nil && resp != nil && resp.Auth != nil:
+		metrics.IncrCounterWithLabels([]string{"auth", "oidc", "login", "success"}, 1, m.labels)
+		return
+	case err != nil:
+		m.fail(reasonInternalError)
+	case resp != nil && resp.IsError():
+		m.fail(reasonLoginRejected)
+	case m.reason == "":
+		return
+	}
+
+	labels := append([]metrics.Label{{Name: "reason", Value: m.reason}}, m.labels...)
+	metrics.IncrCounterWithLabels([]string{"auth", "oidc", "login", "failure"}, 1, labels)
+}
+
+// setStateCacheEntries reports the pending device logins kept in memory, to
+// alert on clients starting logins they never complete.
+func setStateCacheEntries(count int) {
+	metrics.SetGauge([]string{"auth", "oidc", "state_cache", "entries"}, float32(count))
+}
+
+// instrumentLogin wraps a login operation to record its metrics and count its
+// failures towards the lockouts. With lockout_by_source, logins from a locked
+// out source are rejected before the operation runs. Alias lookaheads are not
+// logins and are not counted.
+func (b *openIDConnectAuthBackend) instrumentLogin(flow string, op framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		if req.Operation == logical.AliasLookaheadOperation {
+			return op(ctx, req, d)
+		}
+
+		m := newLoginMetrics(req, flow)
+		ctx = withLoginMetrics(ctx, m)
+		config, err := b.config(ctx, req.Storage)
+		if err != nil || config == nil {
+			resp, err := op(ctx, req, d)
+			m.done(resp, err)
+			return resp, err
+		}
+
+		var source string
+		if config.LockoutBySource {
+			source = requestSource(req, "")
+		}
+		if source != "" {
+			if lockedUntil := b.lockedOut(config, lockoutSourceKey(source)); !lockedUntil.IsZero() {
+				resp := lockedOutResponse(ctx, lockedUntil)
+				m.done(resp, nil)
+				return resp, nil
+			}
+		}
+
+		resp, err := op(ctx, req, d)
+		m.done(resp, err)
+
+		var keys []string
+		if source != "" {
+			keys = append(keys, lockoutSourceKey(source))
+		}
+		if m.subject != "" {
+			keys = append(keys, lockoutSubjectKey(m.subject))
+		}
+		switch {
+		case err == nil && resp != nil && resp.Auth != nil:
+			b.recordLogin(config, true, keys...)
+		case lockoutReasons[m.reason]:
+			b.recordLogin(config, false, keys...)
+		}
+
+		return resp, err
+	}
+}
@@ -0,0 +1,104 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// noncePrefix is where the consumed nonces are kept, hashed, until the ID
+// tokens carrying them expire. Storage is replicated, an ID token replayed
+// against another node is rejected as well.
+const noncePrefix string = "nonce/"
+
+type consumedNonce struct {
+	Expiration time.Time `json:"expiration"`
+}
+
+func nonceStorageKey(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return noncePrefix + hex.EncodeToString(sum[:])
+}
+
+// consumeNonce records the nonce of a verified ID token and reports whether it
+// was consumed before. The nonce is kept past the token expiry by the clock
+// skew leeway, until the token itself is rejected. Like the login states,
+// nonces are only consumed on the active node.
+func (b *openIDConnectAuthBackend) consumeNonce(ctx context.Context, s logical.Storage, config *oidcConfig,
+	nonce string, expiry time.Time) (bool, error) {
+	if err := b.requireActiveNode(); err != nil {
+		return false, err
+	}
+
+	key := nonceStorageKey(nonce)
+	lock := locksutil.LockForKey(b.stateLocks, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := s.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if entry != nil {
+		consumed := &consumedNonce{}
+		if err := entry.DecodeJSON(consumed); err != nil {
+			return false, err
+		}
+		if time.Now().Before(consumed.Expiration) {
+			return true, nil
+		}
+	}
+
+	if expiry.IsZero() {
+		expiry = time.Now().Add(config.stateTTL())
+	}
+	entry, err = logical.StorageEntryJSON(key, &consumedNonce{
+		Expiration: expiry.Add(config.ClockSkewLeeway),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return false, s.Put(ctx, entry)
+}
+
+// tidyNonces deletes the consumed nonces of the expired ID tokens and returns
+// how many were deleted.
+func (b *openIDConnectAuthBackend) tidyNonces(ctx context.Context, s logical.Storage) (int, error) {
+	keys, err := s.List(ctx, noncePrefix)
+	if err != nil {
+		return 0, errwrap.Wrapf("error listing consumed nonces: {{err}}", err)
+	}
+
+	deleted := 0
+	now := time.Now()
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return deleted, ctx.Err()
+		}
+
+		entry, err := s.Get(ctx, noncePrefix+key)
+		if err != nil {
+			return deleted, errwrap.Wrapf("error reading consumed nonce: {{err}}", err)
+		}
+		if entry == nil {
+			continue
+		}
+
+		consumed := &consumedNonce{}
+		if err := entry.DecodeJSON(consumed); err == nil && now.Before(consumed.Expiration) {
+			continue
+		}
+		if err := s.Delete(ctx, noncePrefix+key); err != nil {
+			return deleted, errwrap.Wrapf("error deleting consumed nonce: {{err}}", err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,109 @@
+package oidc
+
+import (
+	"context"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathAuthURL(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: authURLPath + `$`,
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: `<Optional> The role to log in against.`,
+			},
+			"redirect_uri": {
+				Type:        framework.TypeString,
+				Description: `<Optional> The URI the Idp should redirect to after authentication, defaults to the config redirect_url.`,
+			},
+			"client_nonce": {
+				Type:        framework.TypeString,
+				Description: `<Optional> Random value known only to the client, when set the callback shows a page in the browser and the login is completed with the 'poll' endpoint.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathAuthURL,
+		},
+
+		HelpSynopsis:    authURLHelpSyn,
+		HelpDescription: authURLHelpDesc,
+	}
+}
+
+func (b *openIDConnectAuthBackend) pathAuthURL(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("could not load OIDC configuration"), nil
+	}
+
+	roleName, resp, err := b.loginRoleName(ctx, req.Storage, config, d.Get("role").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	config, resp, err = b.roleConfig(ctx, req.Storage, config, roleName)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	redirectURI := d.Get("redirect_uri").(string)
+	if redirectURI == "" {
+		redirectURI = config.RedirectURL
+	}
+	if redirectURI == "" {
+		return logical.ErrorResponse("redirect_uri must be set, no default redirect_url is configured."), nil
+	}
+	resp, err = b.validateLoginRole(ctx, req.Storage, config, roleName, redirectURI)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("error getting provider for login operation: {{err}}", err)
+	}
+
+	if provider.Endpoint().AuthURL == "" {
+		return logical.ErrorResponse("authorization_endpoint must be configured to start a browser login"), nil
+	}
+
+	clientNonce := d.Get("client_nonce").(string)
+	authURL, stateID, err := b.createAuthURL(ctx, req.Storage, config, provider, roleName, redirectURI, clientNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	resp = &logical.Response{
+		Data: map[string]interface{}{
+			"auth_url": authURL,
+		},
+	}
+	if clientNonce != "" {
+		resp.Data["state"] = stateID
+	}
+
+	return resp, nil
+}
+
+const (
+	authURLHelpSyn = `
+Generates the authorization URL to start an OpenID Connect login.
+`
+	authURLHelpDesc = `
+Returns the Idp authorization URL the user must be sent to. The state and
+nonce of the login are generated and kept by the backend, so completing the
+login only requires passing the returned 'code' and 'state' to the 'callback'
+endpoint.
+
+When a 'client_nonce' is given the Idp may redirect the browser to the
+'callback' endpoint directly, it renders a page instead of returning the
+token. The client then completes the login with the 'poll' endpoint, passing
+the returned 'state' and the same 'client_nonce'.
+`
+)
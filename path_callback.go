@@ -2,9 +2,19 @@ package oidc
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/coreos/go-oidc"
 	"github.com/go-errors/errors"
 	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/parseutil"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"golang.org/x/oauth2"
@@ -13,9 +23,33 @@ import (
 func pathCallback(b *openIDConnectAuthBackend) *framework.Path {
 	return &framework.Path{
 		Pattern: `callback$`,
+		Fields: map[string]*framework.FieldSchema{
+			"code": {
+				Type:        framework.TypeString,
+				Description: `Authorization code returned by the Idp on the redirect.`,
+			},
+			"state": {
+				Type:        framework.TypeString,
+				Description: `State returned by the Idp on the redirect, as generated by the auth_url endpoint.`,
+			},
+			"error": {
+				Type:        framework.TypeString,
+				Description: `Error code returned by the Idp on the redirect when the login failed, e.g. 'access_denied'.`,
+			},
+			"error_description": {
+				Type:        framework.TypeString,
+				Description: `Description of the error returned by the Idp on the redirect.`,
+			},
+			"id_token": {
+				Type:        framework.TypeString,
+				Description: `ID token returned on the redirect by the implicit flow, with oidc_response_types 'id_token'.`,
+			},
+		},
+		// There is no alias lookahead, the alias is only known once the code
+		// is exchanged and the login state is used up at that point
 		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.ReadOperation:           b.pathCallback,
-			logical.AliasLookaheadOperation: b.pathCallback,
+			logical.ReadOperation:   b.instrumentLogin("callback", b.pathCallback),
+			logical.UpdateOperation: b.instrumentLogin("callback", b.pathCallback),
 		},
 
 		HelpSynopsis:    pathCallbackSyn,
@@ -24,7 +58,7 @@ func pathCallback(b *openIDConnectAuthBackend) *framework.Path {
 }
 
 func (b *openIDConnectAuthBackend) pathCallback(ctx context.Context, req *logical.Request,
-												d *framework.FieldData) (*logical.Response, error) {
+	d *framework.FieldData) (*logical.Response, error) {
 	// Fetch Config and ClaimsConfig
 	config, err := b.config(ctx, req.Storage)
 	if err != nil {
@@ -41,53 +75,518 @@ func (b *openIDConnectAuthBackend) pathCallback(ctx context.Context, req *logica
 		return logical.ErrorResponse("could not load OIDC Mapping configuration"), nil
 	}
 
-	// Create provider
+	// The redirect parameters are in the query for GET requests and in the body
+	// for form_post responses, both end up in the request data. Parameters
+	// which are not in the schema are ignored.
+	m := loginMetricsFrom(ctx)
+	params := make(map[string]string, len(callbackParams))
+	for _, name := range callbackParams {
+		value, err := callbackParam(d, name)
+		if err != nil {
+			m.fail(reasonIdpError)
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		params[name] = value
+	}
+	code, rawIDToken := params["code"], params["id_token"]
+	var idpErr string
+	if params["error"] != "" {
+		idpErr = idpErrorMessage(params["error"], params["error_description"])
+	}
+
+	// Fetch the state stored when the login flow was started, the state is
+	// the CSRF protection of the callback and may only be used once
+	stateID := params["state"]
+	if stateID == "" {
+		if idpErr != "" {
+			m.fail(reasonIdpError)
+			return logical.ErrorResponse(idpErr), nil
+		}
+		m.fail(reasonStateInvalid)
+		return logical.ErrorResponse("state check failed: missing state parameter, this request may be forged"), nil
+	}
+	// Checked before the state is used up so that the login can be retried
+	if !b.allowExchange(config, requestSource(req, stateID)) {
+		return rateLimitedResponse(ctx, req)
+	}
+	state, err := b.takeLoginState(ctx, req.Storage, stateID)
+	if err != nil {
+		return nil, storageError("error reading login state", err)
+	}
+	if state == nil {
+		m.fail(reasonStateInvalid)
+		return logical.ErrorResponse(fmt.Sprintf("state check failed: state already used or expired, this request may be forged or took over %s", config.stateTTL())), nil
+	}
+
+	// Logins started with a client nonce are completed by the poll endpoint,
+	// the browser only gets a page and never sees the token. Their state is
+	// stored again with the code, a second callback is a replay and the
+	// login must be restarted.
+	if state.ClientNonce != "" {
+		if state.Code != "" || state.IDToken != "" {
+			m.fail(reasonStateInvalid)
+			return logical.ErrorResponse("state check failed: state already used or expired, restart the login"), nil
+		}
+		return b.storeCallbackCode(ctx, req, stateID, state, idpErr, code, rawIDToken)
+	}
+
+	// Errors returned by the Idp on the redirect are passed along
+	if idpErr != "" {
+		m.fail(reasonIdpError)
+		return logical.ErrorResponse(idpErr), nil
+	}
+
+	return b.exchangeCode(ctx, req.Storage, config, claimsConfig, state, code, rawIDToken)
+}
+
+// callbackParams are the parameters of the Idp redirect read by the callback.
+var callbackParams = []string{"code", "state", "error", "error_description", "id_token"}
+
+// callbackParam returns a parameter of the redirect, values which can't be
+// read as a string, such as repeated parameters, are rejected.
+func callbackParam(d *framework.FieldData, name string) (string, error) {
+	raw, ok, err := d.GetOkErr(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s parameter: %s", name, err)
+	}
+	if !ok {
+		return "", nil
+	}
+
+	return strings.TrimSpace(raw.(string)), nil
+}
+
+// exchangeCode exchanges the authorization code for the tokens and completes
+// the login started with the given state, with the provider of its role. With
+// the implicit flow the ID token is returned on the redirect instead and there
+// is no code to exchange.
+func (b *openIDConnectAuthBackend) exchangeCode(ctx context.Context, s logical.Storage, config *oidcConfig,
+	claimsConfig *oidcClaimsConfig, state *loginState, code, rawIDToken string) (*logical.Response, error) {
+	// The role comes from the stored state, never from the redirect, and may
+	// have been deleted since the login was started
+	if state.Role != "" {
+		role, err := b.role(ctx, s, state.Role)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q was deleted since the login was started", state.Role)), nil
+		}
+	}
+
+	config, resp, err := b.roleConfig(ctx, s, config, state.Role)
+	if resp != nil || err != nil {
+		return resp, err
+	}
 	provider, err := b.getProvider(ctx, config)
 	if err != nil {
 		return nil, errwrap.Wrapf("error getting provider for login operation: {{err}}", err)
 	}
+	ctx = provider.clientContext(ctx)
+
+	// The allowed redirect URIs may have changed since the login was started
+	resp, err = b.validateLoginRole(ctx, s, config, state.Role, state.RedirectURI)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	if config.implicitFlow() {
+		if rawIDToken == "" {
+			return logical.ErrorResponse("missing id_token parameter"), nil
+		}
+		// Without an access token the UserInfo endpoint is not called
+		token := (&oauth2.Token{}).WithExtra(map[string]interface{}{
+			"id_token": rawIDToken,
+		})
+		return b.completeLogin(ctx, s, config, claimsConfig, provider, state.Role, state.Nonce, token)
+	}
+
+	var exchangeOpts []oauth2.AuthCodeOption
+	if state.CodeVerifier != "" {
+		exchangeOpts = append(exchangeOpts, oauth2.SetAuthURLParam("code_verifier", state.CodeVerifier))
+	} else if config.RequirePKCE {
+		return logical.ErrorResponse("PKCE code verifier is missing, the login flow must be restarted"), nil
+	}
 
 	// Exchange code for JWT to get claims
 	oauthConfig := config.config2OauthConfig(provider)
-	oauth2Token, err := oauthConfig.Exchange(ctx, req.Data["code"].(string))
+	if state.RedirectURI != "" {
+		oauthConfig.RedirectURL = state.RedirectURI
+	}
+	if code == "" {
+		loginMetricsFrom(ctx).fail(reasonIdpError)
+		return logical.ErrorResponse("missing code parameter, the Idp redirect has no authorization code"), nil
+	}
+	exchangeCtx, cancel := idpContext(ctx, config)
+	defer cancel()
+	start := time.Now()
+	oauth2Token, err := oauthConfig.Exchange(b.clientContext(exchangeCtx), code, exchangeOpts...)
+	loginMetricsFrom(ctx).measure(stageExchange, start)
+	if err != nil {
+		loginMetricsFrom(ctx).fail(reasonExchangeFailed)
+		if timeoutErr := idpTimeout(exchangeCtx, "token", err); timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		// An error response of the Idp means the code is invalid or expired,
+		// anything else is a problem reaching the Idp
+		if _, ok := err.(*oauth2.RetrieveError); ok {
+			return logical.ErrorResponse("Failed to exchange token: " + sanitizeError(err)), nil
+		}
+		return nil, fmt.Errorf("Failed to exchange token: %s", sanitizeError(err))
+	}
+
+	return b.completeLogin(ctx, s, config, claimsConfig, provider, state.Role, state.Nonce, oauth2Token)
+}
+
+// storeCallbackCode keeps the authorization code with the login state for the
+// poll endpoint and renders the page shown in the browser. Errors are logged
+// with a correlation ID shown on the page instead of being returned. idpErr is
+// the message of the error the Idp redirected with, if any.
+func (b *openIDConnectAuthBackend) storeCallbackCode(ctx context.Context, req *logical.Request, stateID string,
+	state *loginState, idpErr, code, rawIDToken string) (*logical.Response, error) {
+	failed := func(msg string, args ...interface{}) (*logical.Response, error) {
+		correlationID, err := randomString(8)
+		if err != nil {
+			return nil, err
+		}
+		b.Logger().Warn(msg, append(args, "correlation_id", correlationID)...)
+		return htmlResponse(http.StatusBadRequest, fmt.Sprintf("Vault login failed, reference %s. Try logging in again from your terminal.", correlationID)), nil
+	}
+
+	m := loginMetricsFrom(ctx)
+	if idpErr != "" {
+		m.fail(reasonIdpError)
+		return failed("login failed at the Idp", "error", idpErr)
+	}
+	if code == "" && rawIDToken == "" {
+		m.fail(reasonIdpError)
+		return failed("callback is missing the code parameter")
+	}
+
+	state.Code = code
+	state.IDToken = rawIDToken
+	if err := b.storeLoginState(ctx, req.Storage, stateID, state); err != nil {
+		return failed("error storing the callback code", "error", err)
+	}
+
+	return htmlResponse(http.StatusOK, "Vault login succeeded, return to your terminal to complete it."), nil
+}
+
+// idpErrorMessages explain the errors of the Idp redirect which users cause
+// themselves, see OpenID Connect Core 1.0 section 3.1.2.6.
+var idpErrorMessages = map[string]string{
+	"access_denied":        "the login was cancelled or denied at the Idp",
+	"login_required":       "the Idp requires the user to log in again, retry the login without prompt=none",
+	"consent_required":     "the user must consent to the Vault application at the Idp, retry the login without prompt=none",
+	"interaction_required": "the Idp requires the user to interact with the login page, retry the login without prompt=none",
+}
+
+// idpErrorMessage returns the error of the Idp redirect with its sanitized
+// description, the state of the login is already used up.
+func idpErrorMessage(idpErr, desc string) string {
+	msg, ok := idpErrorMessages[idpErr]
+	if !ok {
+		msg = fmt.Sprintf("the Idp returned error %q", sanitizeDescription(idpErr))
+	}
+	msg = "login failed: " + msg
+	if desc = sanitizeDescription(desc); desc != "" {
+		msg += ": " + desc
+	}
+
+	return msg
+}
+
+// htmlResponse returns a raw HTML page with the given message.
+func htmlResponse(status int, message string) *logical.Response {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "text/html; charset=utf-8",
+			logical.HTTPStatusCode:  status,
+			logical.HTTPRawBody:     []byte(fmt.Sprintf(cliResultPage, html.EscapeString(message))),
+		},
+	}
+}
+
+// completeLogin verifies the ID token returned by the Idp token endpoint and
+// maps the user claims into the login response. The nonce is only checked for
+// flows that sent one on the authorization request.
+func (b *openIDConnectAuthBackend) completeLogin(ctx context.Context, s logical.Storage, config *oidcConfig,
+	claimsConfig *oidcClaimsConfig, provider *oidcProvider, roleName, nonce string,
+	oauth2Token *oauth2.Token) (*logical.Response, error) {
+	// Check the ID token nonce to mitigate replays
+	idToken, err := b.verifyNonce(ctx, config, nonce, provider, oauth2Token)
 	if err != nil {
-		return nil, errwrap.Wrapf("Failed to exchange token: {{err}}", err)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	// The state is only used once on this node, the nonce is consumed for the
+	// cluster so that the ID token can't be replayed against another node
+	if nonce != "" {
+		consumed, err := b.consumeNonce(ctx, s, config, nonce, idToken.Expiry)
+		if err != nil {
+			return nil, storageError("error recording the ID token nonce", err)
+		}
+		if consumed {
+			loginMetricsFrom(ctx).fail(reasonNonceMismatch)
+			return logical.ErrorResponse("nonce check failed: the ID token nonce was already used, this token may be replayed"), nil
+		}
+	}
+	if lockedUntil := b.lockedOut(config, lockoutSubjectKey(idToken.Subject)); !lockedUntil.IsZero() {
+		return lockedOutResponse(ctx, lockedUntil), nil
+	}
+
+	// Fetch the role the login flow was started for
+	var role *oidcRole
+	if roleName != "" {
+		role, err = b.role(ctx, s, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q could not be found", roleName)), nil
+		}
+	}
+
+	m := loginMetricsFrom(ctx)
+	if err := validateIDToken(config, role, idToken); err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateAuthentication(config, role, idToken); err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	// Check for state nonce to mitigate CSRF
-	err = b.verifyNonce(ctx, config, req, provider, oauth2Token)
+	// Fetch user information JWT, without discovery only the ID token claims
+	// are available
+	var userInfoClaims map[string]interface{}
+	var warnings []string
+	if provider.SupportsUserInfo() && !config.SkipUserInfo && oauth2Token.AccessToken != "" {
+		userInfoClaims, err = b.userInfoClaims(ctx, config, provider, oauth2Token, idToken)
+		if err != nil {
+			if !config.UserInfoOptional {
+				m.fail(reasonUserInfoFailed)
+				return nil, err
+			}
+			b.Logger().Warn("UserInfo request failed, using the ID token claims only", "error", err)
+			warnings = append(warnings, "UserInfo request failed, the login used the ID token claims only")
+			userInfoClaims = nil
+		}
+	}
+
+	var idTokenClaims map[string]interface{}
+	if err := idToken.Claims(&idTokenClaims); err != nil {
+		return nil, errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+	allClaims := claimsConfig.mergeClaims(idTokenClaims, userInfoClaims)
+	if err := claimsConfig.validateEmailDomain(allClaims); err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	emailWarning, err := claimsConfig.validateEmail(allClaims)
 	if err != nil {
-		return nil, errwrap.Wrapf("Failed to verify nonce: {{err}}", err)
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if emailWarning != "" {
+		warnings = append(warnings, emailWarning)
 	}
 
-	// Fetch user information JWT
-	userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(oauth2Token))
+	// Idp specific groups take precedence over the claim sources
+	var providerGroups []string
+	custom, err := newCustomProvider(config)
 	if err != nil {
-		return nil, errwrap.Wrapf("Failed to exchange token: {{err}}", err)
+		return nil, err
+	}
+	if custom != nil {
+		var providerWarnings []string
+		providerGroups, providerWarnings, err = custom.FetchGroups(ctx, b, allClaims, oauth2Token)
+		if err != nil {
+			m.fail(reasonGroupsFailed)
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		warnings = append(warnings, providerWarnings...)
+	}
+	if claimsConfig.ResolveClaimSources {
+		if err := b.resolveClaimSources(ctx, config, provider, allClaims); err != nil {
+			m.fail(reasonGroupsFailed)
+			return logical.ErrorResponse(err.Error()), nil
+		}
 	}
 
 	// Map user information from Idp to Vault user
-	userData, err := claimsConfig.parseUserInfo(userInfo)
+	b.logClaims(config, allClaims)
+	userData, err := claimsConfig.parseClaims(allClaims, providerGroups)
 	if err != nil {
-		return nil, errwrap.Wrapf("Failed to map user claims: {{err}}", err)
+		m.fail(reasonClaimsMappingFailed)
+		return logical.ErrorResponse("Failed to map user claims: " + err.Error()), nil
 	}
 
+	userData.Warnings = append(userData.Warnings, warnings...)
+
+	resp, err := b.buildAuthResponse(ctx, s, config, claimsConfig, roleName, role, userData, allClaims)
+	if err != nil || resp.Auth == nil {
+		return resp, err
+	}
+
+	// The refresh token is used on renewal to check the user is still allowed,
+	// the internal data isn't returned to the client
+	if oauth2Token.RefreshToken != "" && resp.Auth.Renewable {
+		resp.Auth.InternalData["refresh_token"] = oauth2Token.RefreshToken
+	}
+	passAccessToken(config, role, oauth2Token, resp)
+
+	return resp, nil
+}
+
+// userInfoClaims fetches the UserInfo claims. Signed responses are verified
+// against the provider keys, they must be issued for Vault about the subject
+// of the ID token.
+func (b *openIDConnectAuthBackend) userInfoClaims(ctx context.Context, config *oidcConfig, provider *oidcProvider,
+	oauth2Token *oauth2.Token, idToken *oidc.IDToken) (map[string]interface{}, error) {
+	userInfoCtx, cancel := idpContext(ctx, config)
+	defer cancel()
+	start := time.Now()
+	body, contentType, err := provider.UserInfo(userInfoCtx, provider.client, oauth2Token.AccessToken)
+	loginMetricsFrom(ctx).measure(stageUserInfo, start)
+	if timeoutErr := idpTimeout(userInfoCtx, "UserInfo", err); timeoutErr != nil {
+		return nil, timeoutErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to exchange token: %s", sanitizeError(err))
+	}
+
+	return b.decodeUserInfo(ctx, config, provider, contentType, body, idToken.Subject)
+}
+
+// decodeUserInfo decodes a UserInfo response, verifying signed ones. The
+// response subject must match the ID token subject when one is given, as
+// required by OpenID Connect Core 5.3.2.
+func (b *openIDConnectAuthBackend) decodeUserInfo(ctx context.Context, config *oidcConfig, provider *oidcProvider,
+	contentType string, body []byte, subject string) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	if signedUserInfo(contentType, body) {
+		userInfo, err := b.verifyToken(ctx, config, provider, false, strings.TrimSpace(string(body)))
+		if err != nil {
+			return nil, errwrap.Wrapf("failed to verify the signed UserInfo response: {{err}}", err)
+		}
+		if err := userInfo.Claims(&claims); err != nil {
+			return nil, errwrap.Wrapf("failed to decode claims: {{err}}", err)
+		}
+	} else if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+
+	if sub, _ := claims["sub"].(string); subject != "" && sub != subject {
+		return nil, errors.New("the UserInfo response subject does not match the ID token subject")
+	}
+
+	return claims, nil
+}
+
+// buildAuthResponse applies the role settings to the mapped user and creates
+// the response of a successful login.
+func (b *openIDConnectAuthBackend) buildAuthResponse(ctx context.Context, s logical.Storage, config *oidcConfig,
+	claimsConfig *oidcClaimsConfig, roleName string, role *oidcRole, userData *UserEntry,
+	allClaims map[string]interface{}) (*logical.Response, error) {
+	// Denied users are rejected before any policy is attached
+	subject, _ := allClaims["sub"].(string)
+	deniedUsers, err := b.denyList(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if deniedUsers.denied(subject, userData.Username) {
+		b.Logger().Warn("login of a denied user", "subject", subject, "username", userData.Username)
+		loginMetricsFrom(ctx).fail(reasonDenied)
+		return nil, logical.ErrPermissionDenied
+	}
+
+	if err := validateBoundClaims(claimsConfig.BoundClaims, claimsConfig.BoundClaimsType, allClaims); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	ttl, maxTTL, period := tokenDurations(config, role)
+	var mappedPolicies []string
+	if role != nil {
+		if err := validateBoundClaims(role.BoundClaims, role.BoundClaimsType, allClaims); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		mappedPolicies = append(mappedPolicies, role.Policies...)
+		userData.Metadata["role"] = roleName
+	}
+
+	groupPolicies, err := b.groupPolicies(ctx, s, userData.Groups)
+	if err != nil {
+		return nil, err
+	}
+	policies := claimsConfig.tokenPolicies(userData.Policies, append(mappedPolicies, groupPolicies...))
+
 	resp := &logical.Response{
 		Auth: &logical.Auth{
 			DisplayName: userData.DisplayName,
-			Policies: userData.Policies,
-			Metadata: userData.Metadata,
+			Policies:    policies,
+			Period:      period,
+			Metadata:    userData.Metadata,
+			InternalData: map[string]interface{}{
+				"role":           roleName,
+				"claim_policies": userData.Policies,
+				"groups":         userData.Groups,
+				"subject":        subject,
+				"username":       userData.Username,
+			},
 			Alias: &logical.Alias{
-				Name: userData.Username,
+				Name:     userData.AliasName,
+				Metadata: userData.AliasMetadata,
 			},
 			LeaseOptions: logical.LeaseOptions{
-				TTL:       config.TTL,
-				MaxTTL:    config.MaxTTL,
+				TTL:       ttl,
+				MaxTTL:    maxTTL,
 				Renewable: true,
 			},
 		},
 	}
 
+	boundCIDRs, err := parseutil.ParseAddrs(tokenBoundCIDRs(config, role))
+	if err != nil {
+		return nil, errwrap.Wrapf("invalid token_bound_cidrs: {{err}}", err)
+	}
+	resp.Auth.BoundCIDRs = boundCIDRs
+
+	resp.Auth.NumUses = config.TokenNumUses
+	if role != nil && role.TokenNumUses > 0 {
+		resp.Auth.NumUses = role.TokenNumUses
+	}
+	if role != nil {
+		resp.Auth.ExplicitMaxTTL = role.TokenExplicitMaxTTL
+	}
+	if mountMaxTTL := b.System().MaxLeaseTTL(); ttl > mountMaxTTL {
+		resp.AddWarning(fmt.Sprintf("requested ttl %s exceeds the mount max TTL, the token ttl is capped to %s", ttl, mountMaxTTL))
+	}
+
+	// Batch tokens have no lease to renew, a period inherited from the config
+	// doesn't apply to them
+	resp.Auth.TokenType = tokenType(config, role)
+	if resp.Auth.TokenType == logical.TokenTypeBatch {
+		resp.Auth.Renewable = false
+		resp.Auth.Period = 0
+	}
+
+	for _, warning := range userData.Warnings {
+		resp.AddWarning(warning)
+	}
+	for _, warning := range claimsConfig.limitMetadata(resp.Auth.Metadata) {
+		resp.AddWarning(warning)
+	}
+	for _, warning := range claimsConfig.limitMetadata(resp.Auth.Alias.Metadata) {
+		resp.AddWarning("alias " + warning)
+	}
+	if config.VerboseOIDCLogging {
+		resp.AddWarning("verbose_oidc_logging is enabled and logs user claims, it should be disabled in production.")
+	}
+	if config.SkipIssuerVerification {
+		resp.AddWarning(skipIssuerWarning)
+	}
+
 	// Map groups
 	for _, grp := range userData.Groups {
 		resp.Auth.GroupAliases = append(resp.Auth.GroupAliases, &logical.Alias{Name: grp})
@@ -96,29 +595,322 @@ func (b *openIDConnectAuthBackend) pathCallback(ctx context.Context, req *logica
 	return resp, nil
 }
 
-func (b *openIDConnectAuthBackend) verifyNonce(ctx context.Context, config *oidcConfig, req *logical.Request,
-											  provider *oidc.Provider, token *oauth2.Token) error {
-	nonceEnabledVerifier := provider.Verifier(&oidc.Config{
-		ClientID: config.ClientID,
-	})
-	// Verify the ID Token signature and nonce.
-	idToken, err := nonceEnabledVerifier.Verify(ctx, token.Extra("id_token").(string))
+// passAccessToken adds the Idp access token to the internal data, and to the
+// response data for the client completing the login, when enabled on the
+// config or the role. It must never be added to the metadata, which is audited
+// and returned on token lookups.
+func passAccessToken(config *oidcConfig, role *oidcRole, oauth2Token *oauth2.Token, resp *logical.Response) {
+	if oauth2Token.AccessToken == "" {
+		return
+	}
+
+	var expiry string
+	if !oauth2Token.Expiry.IsZero() {
+		expiry = oauth2Token.Expiry.UTC().Format(time.RFC3339)
+	}
+
+	if config.PassAccessToken || (role != nil && role.PassAccessToken) {
+		resp.Auth.InternalData["access_token"] = oauth2Token.AccessToken
+		resp.Auth.InternalData["access_token_expiry"] = expiry
+	}
+	if config.PassAccessTokenInResponse || (role != nil && role.PassAccessTokenInResponse) {
+		if resp.Data == nil {
+			resp.Data = make(map[string]interface{})
+		}
+		resp.Data["access_token"] = oauth2Token.AccessToken
+		resp.Data["access_token_expiry"] = expiry
+	}
+}
+
+// logClaims logs the claims received at login when verbose_oidc_logging is
+// enabled. Only the decoded claims are logged, never the raw tokens.
+func (b *openIDConnectAuthBackend) logClaims(config *oidcConfig, allClaims map[string]interface{}) {
+	if !config.VerboseOIDCLogging {
+		return
+	}
+
+	claims := make([]string, 0, len(allClaims))
+	for name, value := range allClaims {
+		claims = append(claims, fmt.Sprintf("%s=%s", name, claimString(value)))
+	}
+	sort.Strings(claims)
+
+	b.Logger().Warn("received OIDC claims", "claims", strings.Join(claims, " "))
+}
+
+// maxAge returns how long ago the user may have authenticated at the Idp, the
+// role setting taking precedence over the config.
+func maxAge(config *oidcConfig, role *oidcRole) time.Duration {
+	if role != nil && role.MaxAge > 0 {
+		return role.MaxAge
+	}
+	return config.MaxAge
+}
+
+// validateAuthTime checks the auth_time claim is within maxAge, it fails closed
+// when the claim is missing.
+func validateAuthTime(idToken *oidc.IDToken, maxAge, leeway time.Duration) error {
+	if maxAge <= 0 {
+		return nil
+	}
+
+	var claims struct {
+		AuthTime *float64 `json:"auth_time"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+	if claims.AuthTime == nil {
+		return errors.New("max_age is configured but the ID token has no auth_time claim")
+	}
+
+	authTime := time.Unix(int64(*claims.AuthTime), 0)
+	if time.Since(authTime) > maxAge+leeway {
+		return fmt.Errorf("authentication at the Idp is older than max_age %s, log in at the Idp again", maxAge)
+	}
+
+	return nil
+}
+
+// validateACR checks the acr claim is one of the allowed values, an empty list
+// allows any value.
+func validateACR(idToken *oidc.IDToken, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	var claims struct {
+		ACR string `json:"acr"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+	if !strutil.StrListContains(allowed, claims.ACR) {
+		return fmt.Errorf("authentication context %q is not one of the allowed_acr_values", claims.ACR)
+	}
+
+	return nil
+}
+
+// validateHostedDomain checks the Google 'hd' claim is one of the allowed
+// domains, accounts outside of a hosted domain don't have the claim. An empty
+// list allows every account.
+func validateHostedDomain(idToken *oidc.IDToken, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	var claims struct {
+		HostedDomain string `json:"hd"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+	if claims.HostedDomain == "" {
+		return errors.New("the ID token has no hosted domain, the account is not part of an allowed_hosted_domains domain")
+	}
+	if !strutil.StrListContains(allowed, strings.ToLower(claims.HostedDomain)) {
+		return fmt.Errorf("hosted domain %q is not one of the allowed_hosted_domains", claims.HostedDomain)
+	}
+
+	return nil
+}
+
+// validateAuthentication checks how the user authenticated at the Idp: the
+// auth_time against max_age, the acr claim and the Google hosted domain. Every
+// login path runs it on the verified token.
+func validateAuthentication(config *oidcConfig, role *oidcRole, idToken *oidc.IDToken) error {
+	if err := validateAuthTime(idToken, maxAge(config, role), config.ClockSkewLeeway); err != nil {
+		return err
+	}
+	if err := validateACR(idToken, config.AllowedACRValues); err != nil {
+		return err
+	}
+	return validateHostedDomain(idToken, config.AllowedHostedDomains)
+}
+
+// tokenDurations returns the TTL, max TTL and period of issued tokens, the
+// role settings taking precedence over the config. Periodic tokens have no max
+// TTL.
+func tokenDurations(config *oidcConfig, role *oidcRole) (ttl, maxTTL, period time.Duration) {
+	ttl, maxTTL, period = config.TTL, config.MaxTTL, config.TokenPeriod
+	if role != nil {
+		if role.TTL > 0 {
+			ttl = role.TTL
+		}
+		if role.MaxTTL > 0 {
+			maxTTL = role.MaxTTL
+		}
+		if role.TokenPeriod > 0 {
+			period = role.TokenPeriod
+		}
+	}
+	if period > 0 {
+		ttl, maxTTL = period, 0
+	}
+
+	return ttl, maxTTL, period
+}
+
+// tokenBoundCIDRs returns the CIDRs issued tokens may be used from, the role
+// setting taking precedence over the config.
+func tokenBoundCIDRs(config *oidcConfig, role *oidcRole) []string {
+	if role != nil && len(role.TokenBoundCIDRs) > 0 {
+		return role.TokenBoundCIDRs
+	}
+	return config.TokenBoundCIDRs
+}
+
+// tokenType returns the type of issued tokens, the role setting taking
+// precedence over the config.
+func tokenType(config *oidcConfig, role *oidcRole) logical.TokenType {
+	name := config.TokenType
+	if role != nil && role.TokenType != "" {
+		name = role.TokenType
+	}
+
+	switch name {
+	case "service":
+		return logical.TokenTypeService
+	case "batch":
+		return logical.TokenTypeBatch
+	default:
+		return logical.TokenTypeDefault
+	}
+}
+
+// validateTokenType checks a token_type value and that it may be combined
+// with the token period.
+func validateTokenType(name string, period time.Duration) error {
+	switch name {
+	case "", "default", "service":
+	case "batch":
+		if period > 0 {
+			return errors.New("batch tokens can't be periodic, token_period must not be set")
+		}
+	default:
+		return fmt.Errorf("token_type must be one of 'service', 'batch' or 'default', got %q", name)
+	}
+
+	return nil
+}
+
+// verifyToken checks the signature, issuer, audience and time claims of a
+// token issued by the provider. The client ID audience check may be skipped
+// when the audience is checked against bound_audiences instead.
+func (b *openIDConnectAuthBackend) verifyToken(ctx context.Context, config *oidcConfig, provider *oidcProvider,
+	skipClientIDCheck bool, rawToken string) (*oidc.IDToken, error) {
+	// The expiry is checked below with the clock skew leeway. Skipping the
+	// issuer check only skips the comparison of the 'iss' claim, the token
+	// must still be signed by the provider keys.
+	idToken, err := provider.Verifier(&oidc.Config{
+		ClientID:             config.ClientID,
+		SkipClientIDCheck:    skipClientIDCheck,
+		SkipExpiryCheck:      true,
+		SkipIssuerCheck:      config.SkipIssuerVerification,
+		SupportedSigningAlgs: config.SupportedSigningAlgs,
+	}).Verify(ctx, rawToken)
 	if err != nil {
-		return errors.New("Failed to verify ID Token: "+err.Error())
+		return nil, err
 	}
 
-	// Check for state nonce to mitigate CSRF
-	state, ok := b.stateCache.Get(req.Connection.RemoteAddr)
-	if !ok {
-		return errors.New("Could not find connection state, this request may be forged or took over 5 minutes")
+	if err := validateTimeClaims(idToken, config.ClockSkewLeeway); err != nil {
+		return nil, err
 	}
-	if state != idToken.Nonce {
-		return errors.New("state nonce not matching, this request may be forged")
+
+	return idToken, nil
+}
+
+// validateTimeClaims checks the exp, iat and nbf claims of the token, allowing
+// for the given clock drift between Vault and the Idp.
+func validateTimeClaims(idToken *oidc.IDToken, leeway time.Duration) error {
+	now := time.Now()
+
+	if !idToken.Expiry.IsZero() && now.After(idToken.Expiry.Add(leeway)) {
+		return fmt.Errorf("token is expired (expiry: %s)", idToken.Expiry.UTC().Format(time.RFC3339))
+	}
+	if idToken.IssuedAt.After(now.Add(leeway)) {
+		return errors.New("token is issued in the future")
+	}
+
+	var claims struct {
+		NotBefore *float64 `json:"nbf"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+	if claims.NotBefore != nil {
+		nbf := time.Unix(int64(*claims.NotBefore), 0)
+		if nbf.After(now.Add(leeway)) {
+			return errors.New("token is not valid yet")
+		}
 	}
 
 	return nil
 }
 
+// boundAudiences returns the audiences the token must be issued for, the
+// role setting taking precedence over the config.
+func boundAudiences(config *oidcConfig, role *oidcRole) []string {
+	if role != nil && len(role.BoundAudiences) > 0 {
+		return role.BoundAudiences
+	}
+	return config.BoundAudiences
+}
+
+// validateIDToken checks a verified token against the configured bindings,
+// the returned error is safe to be sent back to the user.
+func validateIDToken(config *oidcConfig, role *oidcRole, idToken *oidc.IDToken) error {
+	if audiences := boundAudiences(config, role); len(audiences) > 0 {
+		found := false
+		for _, aud := range idToken.Audience {
+			if strutil.StrListContains(audiences, aud) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("token audiences %q do not match any of the bound audiences", idToken.Audience)
+		}
+	}
+
+	boundSubject := config.BoundSubject
+	if role != nil && role.BoundSubject != "" {
+		boundSubject = role.BoundSubject
+	}
+	if boundSubject != "" && idToken.Subject != boundSubject {
+		return errors.New("token subject does not match the bound subject")
+	}
+
+	return nil
+}
+
+func (b *openIDConnectAuthBackend) verifyNonce(ctx context.Context, config *oidcConfig, nonce string,
+	provider *oidcProvider, token *oauth2.Token) (*oidc.IDToken, error) {
+	// Verify the ID Token signature and nonce.
+	m := loginMetricsFrom(ctx)
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		m.fail(reasonTokenInvalid)
+		return nil, errors.New("the Idp did not return an ID token, check the openid scope is allowed")
+	}
+	idToken, err := b.verifyToken(ctx, config, provider, false, rawIDToken)
+	if err != nil {
+		m.fail(reasonTokenInvalid)
+		return nil, errors.New("Failed to verify ID Token: " + sanitizeError(err))
+	}
+	m.setSubject(idToken.Subject)
+
+	// Check the nonce sent on the authorization request, the state was
+	// already checked by the callback
+	if nonce != "" && nonce != idToken.Nonce {
+		m.fail(reasonNonceMismatch)
+		return nil, errors.New("nonce check failed: the ID token nonce does not match the login request, this token may be replayed")
+	}
+
+	return idToken, nil
+}
+
 const (
 	pathCallbackSyn = `
 	Log in with a OpenID Connect.
@@ -127,5 +919,10 @@ const (
 	pathCallbackDesc = `
 	This endpoint authenticates using Auth0 with OpenID Connect. Please be sure to
 	read the note on escaping from the path-help for the 'config' endpoint.
+
+	The 'code' and 'state' are read from the query of a GET request, or from the
+	body of a POST request for Idps using response_mode=form_post, along with
+	the 'error' and 'error_description' of failed logins and the 'id_token' of
+	the implicit flow. Other parameters are ignored.
 	`
-)
\ No newline at end of file
+)
@@ -0,0 +1,214 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// failingStorage fails the reads of keys with the given prefix.
+type failingStorage struct {
+	logical.Storage
+	prefix string
+}
+
+func (s *failingStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	if strings.HasPrefix(key, s.prefix) {
+		return nil, errors.New("storage is unavailable")
+	}
+	return s.Storage.Get(ctx, key)
+}
+
+func TestCallback_Success(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, nil, nil)
+
+	state := idp.startLogin(b, storage)
+	_, resp, err := callback(b, storage, state, testCode)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("login failed: err: %v resp: %#v", err, resp)
+	}
+	if resp.Auth == nil || resp.Auth.Alias.Name != "user@example.com" {
+		t.Fatalf("unexpected auth: %#v", resp.Auth)
+	}
+	if len(resp.Auth.GroupAliases) != 2 {
+		t.Fatalf("expected 2 group aliases, got %#v", resp.Auth.GroupAliases)
+	}
+}
+
+// TestCallback_StatusClass checks the failures users can correct return error
+// responses, status 400, and the problems of Vault or of the Idp errors,
+// status 500.
+func TestCallback_StatusClass(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		claims map[string]interface{}
+		// setup runs after the login is started
+		setup      func(idp *testIdp, b *openIDConnectAuthBackend)
+		code       string
+		state      string
+		storage    func(s logical.Storage) logical.Storage
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "invalid code",
+			code:       "expired-code",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid_grant",
+		},
+		{
+			name:       "missing code",
+			code:       "",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "missing code parameter",
+		},
+		{
+			name:       "unknown state",
+			state:      "forged-state",
+			code:       testCode,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "state check failed",
+		},
+		{
+			name:       "audience mismatch",
+			config:     map[string]interface{}{"bound_audiences": "another-client"},
+			code:       testCode,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "do not match any of the bound audiences",
+		},
+		{
+			name:       "bound claims mismatch",
+			claims:     map[string]interface{}{"bound_claims": map[string]interface{}{"department": "platform"}},
+			code:       testCode,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "nonce mismatch",
+			setup: func(idp *testIdp, b *openIDConnectAuthBackend) {
+				idp.setNonce("another-nonce")
+			},
+			code:       testCode,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "nonce check failed",
+		},
+		{
+			name: "invalid signature",
+			setup: func(idp *testIdp, b *openIDConnectAuthBackend) {
+				idp.setTokenHandler(func(w http.ResponseWriter, r *http.Request) {
+					token := idp.idToken(nil)
+					writeJSON(w, http.StatusOK, map[string]interface{}{
+						"access_token": "test-access-token",
+						"token_type":   "Bearer",
+						"id_token":     token[:strings.LastIndex(token, ".")+1] + "c2lnbmF0dXJl",
+					})
+				})
+			},
+			code:       testCode,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "Failed to verify ID Token",
+		},
+		{
+			name: "Idp unreachable",
+			setup: func(idp *testIdp, b *openIDConnectAuthBackend) {
+				idp.Close()
+			},
+			code:       testCode,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "storage error",
+			storage: func(s logical.Storage) logical.Storage {
+				return &failingStorage{Storage: s, prefix: statePrefix}
+			},
+			code:       testCode,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := getBackend(t)
+			idp := newTestIdp(t)
+			defer idp.Close()
+			idp.configure(b, storage, tt.config, tt.claims)
+
+			state := idp.startLogin(b, storage)
+			if tt.state != "" {
+				state = tt.state
+			}
+			if tt.setup != nil {
+				tt.setup(idp, b)
+			}
+			if tt.storage != nil {
+				storage = tt.storage(storage)
+			}
+
+			req, resp, err := callback(b, storage, state, tt.code)
+			status, _ := logical.RespondErrorCommon(req, resp, err)
+			if status != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: err: %v resp: %#v", tt.wantStatus, status, err, resp)
+			}
+			if tt.wantError != "" && !strings.Contains(resp.Error().Error(), tt.wantError) {
+				t.Fatalf("expected an error containing %q, got %q", tt.wantError, resp.Error())
+			}
+		})
+	}
+}
+
+// TestCallback_NilConnection checks callbacks of requests without connection
+// information, as forwarded by some plugin clients, are handled with the
+// exchange rate limit and the lockouts by source enabled.
+func TestCallback_NilConnection(t *testing.T) {
+	if source := requestSource(&logical.Request{}, "fallback"); source != "fallback" {
+		t.Fatalf("expected the fallback source, got %q", source)
+	}
+
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, map[string]interface{}{
+		"exchange_rate_limit": 10,
+		"lockout_threshold":   5,
+		"lockout_by_source":   true,
+	}, nil)
+
+	tests := []struct {
+		name       string
+		state      string
+		code       string
+		wantStatus int
+	}{
+		{"invalid code", "", "expired-code", http.StatusBadRequest},
+		{"unknown state", "forged-state", testCode, http.StatusBadRequest},
+		{"success", "", testCode, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := idp.startLogin(b, storage)
+			if tt.state != "" {
+				state = tt.state
+			}
+
+			req, resp, err := callback(b, storage, state, tt.code)
+			if req.Connection != nil {
+				t.Fatal("expected the callback request to have no connection")
+			}
+			status, _ := logical.RespondErrorCommon(req, resp, err)
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: err: %v resp: %#v", tt.wantStatus, status, err, resp)
+			}
+		})
+	}
+}
@@ -3,10 +3,15 @@ package oidc
 import (
 	"context"
 	"encoding/json"
-	"github.com/coreos/go-oidc"
+	"fmt"
 	"github.com/go-errors/errors"
-	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/strutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -14,24 +19,88 @@ import (
 
 func pathClaimsConfig(b *openIDConnectAuthBackend) *framework.Path {
 	return &framework.Path{
-		Pattern: `claims$`,
+		Pattern: `claims/?$`,
 		Fields: map[string]*framework.FieldSchema{
 			"user_claim": {
 				Type:        framework.TypeString,
-				Description: `The claim to use for the Identity entity alias name`,
+				Description: `The claim to use for the Identity entity alias name, e.g. 'sub' for a name that never changes. Nested claims are selected with a JSON pointer.`,
+			},
+			"alias_name_source": {
+				Type:        framework.TypeString,
+				Description: `Where the Identity entity alias name is read from, 'user_claim' (default) for the username, 'sub' for a name that never changes, 'email', 'preferred_username' or 'claim:<name>' for another claim. The 'sub' claim is added to the alias metadata unless it is the source.`,
+			},
+			"username_strip_prefix": {
+				Type:        framework.TypeString,
+				Description: `Prefix removed from the username, matched case insensitively, e.g. 'DOMAIN\'`,
+			},
+			"username_strip_domain": {
+				Type:        framework.TypeString,
+				Description: `Email domain removed from the username, matched case insensitively, e.g. 'corp.example.com' turns 'user@corp.example.com' into 'user'`,
+			},
+			"username_lowercase": {
+				Type:        framework.TypeBool,
+				Description: `Lowercase the username`,
+			},
+			"transform_groups": {
+				Type:        framework.TypeBool,
+				Description: `Apply the username transformations to the group names as well`,
 			},
 			"groups_claim": {
 				Type:        framework.TypeString,
-				Description: `The claim to use for the Identity group alias names`,
+				Description: `The claim to use for the Identity group alias names, nested claims are selected with a JSON pointer, e.g. '/resource_access/vault/roles'`,
+			},
+			"groups_claim_source": {
+				Type:        framework.TypeString,
+				Description: `Where to read the groups claim from when both the ID token and UserInfo contain it, 'userinfo' (default) or 'id_token'`,
+			},
+			"groups_case_insensitive": {
+				Type:        framework.TypeBool,
+				Description: `Match group names case insensitively when looking up the policies attached with the groups endpoint`,
+			},
+			"groups_normalize_case": {
+				Type:        framework.TypeString,
+				Description: `Case conversion applied to group names before the group aliases are created, 'none' (default), 'lower' or 'upper'`,
+			},
+			"groups_trim_whitespace": {
+				Type:        framework.TypeBool,
+				Description: `Trim leading and trailing whitespace from group names before the group aliases are created`,
+			},
+			"groups_filter": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `List of group names to keep, values may begin or end with '*' to match a prefix or a suffix, e.g. 'vault-*'. Applied after the groups normalization and before max_groups. Defaults to all the groups.`,
+			},
+			"max_groups": {
+				Type:        framework.TypeInt,
+				Description: `Maximum number of group aliases of a login, 0 (default) for no limit`,
+			},
+			"groups_overflow_behavior": {
+				Type:        framework.TypeString,
+				Description: `What happens to logins with more groups than max_groups, 'truncate' (default) keeps the first ones in lexical order with a warning, 'deny' fails the login`,
+			},
+			"resolve_claim_sources": {
+				Type:        framework.TypeBool,
+				Description: `Resolve the aggregated and distributed claims listed in '_claim_names', fetching the distributed ones from their source endpoint`,
+			},
+			"allowed_email_domains": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `Domains the 'email' claim of users must belong to, compared case insensitively. Logins without an email claim or with an unverified email fail when set`,
+			},
+			"require_verified_email": {
+				Type:        framework.TypeBool,
+				Description: `Fail logins unless the 'email_verified' claim is true`,
 			},
 			"groups_delimiter": {
 				Type:        framework.TypeString,
-				Description: `The groups claim's data delimiter, default is comma-delimited`,
+				Description: `The groups claim's data delimiter, default is comma-delimited. Only applies to groups claims holding a string, e.g. ';' for ADFS, list claims are used as is`,
 			},
 			"display_name_claim": {
 				Type:        framework.TypeString,
 				Description: `The claim to use for the Identity entity alias display name`,
 			},
+			"display_name_template": {
+				Type:        framework.TypeString,
+				Description: `Template for the token display name, with {{claim}} placeholders replaced by the claim values, e.g. 'oidc-{{email}}'. Takes precedence over display_name_claim.`,
+			},
 			"policies_claim": {
 				Type:        framework.TypeString,
 				Description: `Claim to use for mapping policies with matching names to entity.`,
@@ -40,18 +109,62 @@ func pathClaimsConfig(b *openIDConnectAuthBackend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: `The policies claim's data delimiter, default is comma-delimited`,
 			},
+			"policies_claim_mode": {
+				Type:        framework.TypeString,
+				Description: `Whether the policies of the policies claim are merged with the policies of the role and the groups, 'merge' (default), or replace them, 'replace'`,
+			},
 			"metadata_claims": {
 				Type:        framework.TypeCommaStringSlice,
 				Description: `Claim to use for mapping claim values to entity metadata.`,
 			},
+			"metadata_claims_prefix": {
+				Type:        framework.TypeString,
+				Description: `Prefix of the metadata keys of the metadata_claims and all_metadata claims, e.g. 'oidc_', so that they don't collide with other metadata.`,
+			},
+			"max_metadata_keys": {
+				Type:        framework.TypeInt,
+				Description: `Maximum number of token and alias metadata keys, the extra keys are dropped with a warning. Defaults to 128.`,
+			},
+			"max_metadata_value_length": {
+				Type:        framework.TypeInt,
+				Description: `Maximum length of metadata values, longer values are truncated with a warning. Defaults to 512.`,
+			},
+			"max_metadata_bytes": {
+				Type:        framework.TypeInt,
+				Description: `Maximum total size of the metadata keys and values, keys are dropped with a warning until it fits. Defaults to 32768.`,
+			},
 			"all_metadata": {
 				Type:        framework.TypeBool,
 				Description: "Flag tp map all claims into metadata",
 			},
+			"claim_mappings": {
+				Type:        framework.TypeKVPairs,
+				Description: `Map of claims to the token and alias metadata keys they are copied to. Nested claims are selected with a JSON pointer, e.g. '/address/country'.`,
+			},
+			"alias_metadata_claims": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `List of claims copied into the entity alias metadata, for use in identity templates. The claim names are used as metadata keys, nested claims are selected with a JSON pointer and keyed by its last token.`,
+			},
+			"required_claims": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `List of claims which fail the login when they are missing from the ID token and UserInfo. Other missing claims only add a warning to the login response. Nested claims are selected with a JSON pointer.`,
+			},
+			"bound_claims": {
+				Type:        framework.TypeMap,
+				Description: `Map of claims to the value, or list of values, they must match for a login to be accepted. Nested claims are selected with a JSON pointer, e.g. '/realm_access/roles'.`,
+			},
+			"bound_claims_type": {
+				Type:        framework.TypeString,
+				Description: `How string claims are compared to the bound_claims values, 'string' (default) for exact matches or 'glob' for patterns such as 'team-*'`,
+			},
 		},
+		ExistenceCheck: b.pathClaimsConfigExistenceCheck,
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:   b.pathClaimsConfigRead,
+			logical.CreateOperation: b.pathClaimsConfigWrite,
 			logical.UpdateOperation: b.pathClaimsConfigWrite,
+			logical.DeleteOperation: b.pathClaimsConfigDelete,
+			logical.ListOperation:   b.pathClaimsConfigList,
 		},
 
 		HelpSynopsis:    claimsHelpSyn,
@@ -61,8 +174,16 @@ func pathClaimsConfig(b *openIDConnectAuthBackend) *framework.Path {
 
 func (b *openIDConnectAuthBackend) claimsConfig(ctx context.Context, s logical.Storage) (*oidcClaimsConfig, error) {
 	b.l.RLock()
-	defer b.l.RUnlock()
+	cached := b.cachedClaimsConfig
+	b.l.RUnlock()
+	if cached != nil {
+		return cached, nil
+	}
 
+	// The upgrade writes the entry back, it runs under the write lock so that
+	// concurrent reads store it once
+	b.l.Lock()
+	defer b.l.Unlock()
 	if b.cachedClaimsConfig != nil {
 		return b.cachedClaimsConfig, nil
 	}
@@ -81,6 +202,13 @@ func (b *openIDConnectAuthBackend) claimsConfig(ctx context.Context, s logical.S
 			return nil, err
 		}
 	}
+	upgraded, err := result.upgrade()
+	if err != nil {
+		return nil, err
+	}
+	if upgraded {
+		b.storeUpgraded(ctx, s, claimsConfigPath, result)
+	}
 
 	b.cachedClaimsConfig = result
 
@@ -98,46 +226,194 @@ func (b *openIDConnectAuthBackend) pathClaimsConfigRead(ctx context.Context, req
 
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"user_claim":         config.UserClaim,
-			"display_name_claim": config.DisplayNameClaim,
-			"groups_claim":       config.GroupsClaim,
-			"groups_delimiter":   config.GroupsDelimiter,
-			"policies_claim":    config.PoliciesClaim,
-			"policies_delimiter": config.PoliciesDelimiter,
-			"all_metadata":       config.AllMetadata,
-			"metadata_claims":    config.MetadataClaims,
+			"user_claim":                config.UserClaim,
+			"display_name_claim":        config.DisplayNameClaim,
+			"alias_name_source":         config.AliasNameSource,
+			"username_strip_prefix":     config.UsernameStripPrefix,
+			"username_strip_domain":     config.UsernameStripDomain,
+			"username_lowercase":        config.UsernameLowercase,
+			"transform_groups":          config.TransformGroups,
+			"display_name_template":     config.DisplayNameTemplate,
+			"groups_claim":              config.GroupsClaim,
+			"groups_delimiter":          config.GroupsDelimiter,
+			"groups_claim_source":       config.GroupsClaimSource,
+			"groups_case_insensitive":   config.GroupsCaseInsensitive,
+			"groups_normalize_case":     config.GroupsNormalizeCase,
+			"groups_trim_whitespace":    config.GroupsTrimWhitespace,
+			"groups_filter":             config.GroupsFilter,
+			"max_groups":                config.MaxGroups,
+			"groups_overflow_behavior":  config.GroupsOverflowBehavior,
+			"resolve_claim_sources":     config.ResolveClaimSources,
+			"allowed_email_domains":     config.AllowedEmailDomains,
+			"require_verified_email":    config.RequireVerifiedEmail,
+			"policies_claim":            config.PoliciesClaim,
+			"policies_delimiter":        config.PoliciesDelimiter,
+			"policies_claim_mode":       config.PoliciesClaimMode,
+			"all_metadata":              config.AllMetadata,
+			"metadata_claims":           config.MetadataClaims,
+			"metadata_claims_prefix":    config.MetadataClaimsPrefix,
+			"max_metadata_keys":         config.MaxMetadataKeys,
+			"max_metadata_value_length": config.MaxMetadataValueLength,
+			"max_metadata_bytes":        config.MaxMetadataBytes,
+			"bound_claims":              config.BoundClaims,
+			"bound_claims_type":         config.BoundClaimsType,
+			"claim_mappings":            config.ClaimMappings,
+			"alias_metadata_claims":     config.AliasMetadataClaims,
+			"required_claims":           config.RequiredClaims,
 		},
 	}
 
 	return resp, nil
 }
 
+func (b *openIDConnectAuthBackend) pathClaimsConfigExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	config, err := b.claimsConfig(ctx, req.Storage)
+	if err != nil {
+		return false, err
+	}
+
+	return config != nil, nil
+}
+
 func (b *openIDConnectAuthBackend) pathClaimsConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	config := &oidcClaimsConfig{
-		UserClaim:         d.Get("user_claim").(string),
-		GroupsClaim:       d.Get("groups_claim").(string),
-		GroupsDelimiter:   d.Get("groups_delimiter").(string),
-		DisplayNameClaim:  d.Get("display_name_claim").(string),
-		PoliciesClaim:     d.Get("policies_claim").(string),
-		PoliciesDelimiter: d.Get("policies_delimiter").(string),
-		MetadataClaims:    d.Get("metadata_claims").([]string),
-		AllMetadata:       d.Get("all_metadata").(bool),
+	// Updates keep the stored values of the fields they don't set
+	config := &oidcClaimsConfig{}
+	stored, err := b.claimsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		*config = *stored
+		// The display name claim defaults to the user claim, it follows it
+		// unless it was set
+		if _, ok := d.GetOk("display_name_claim"); !ok && config.DisplayNameClaim == config.UserClaim {
+			config.DisplayNameClaim = ""
+		}
+	}
+	updateField(d, "user_claim", &config.UserClaim)
+	updateField(d, "alias_name_source", &config.AliasNameSource)
+	updateField(d, "groups_claim", &config.GroupsClaim)
+	updateField(d, "groups_delimiter", &config.GroupsDelimiter)
+	updateField(d, "groups_claim_source", &config.GroupsClaimSource)
+	updateField(d, "groups_case_insensitive", &config.GroupsCaseInsensitive)
+	updateField(d, "groups_normalize_case", &config.GroupsNormalizeCase)
+	updateField(d, "groups_trim_whitespace", &config.GroupsTrimWhitespace)
+	updateField(d, "groups_filter", &config.GroupsFilter)
+	updateField(d, "max_groups", &config.MaxGroups)
+	updateField(d, "groups_overflow_behavior", &config.GroupsOverflowBehavior)
+	updateField(d, "resolve_claim_sources", &config.ResolveClaimSources)
+	if raw, ok := d.GetOk("allowed_email_domains"); ok {
+		config.AllowedEmailDomains = cleanEmailDomains(raw.([]string))
 	}
+	updateField(d, "require_verified_email", &config.RequireVerifiedEmail)
+	updateField(d, "display_name_claim", &config.DisplayNameClaim)
+	updateField(d, "username_strip_prefix", &config.UsernameStripPrefix)
+	if raw, ok := d.GetOk("username_strip_domain"); ok {
+		config.UsernameStripDomain = strings.TrimPrefix(raw.(string), "@")
+	}
+	updateField(d, "username_lowercase", &config.UsernameLowercase)
+	updateField(d, "transform_groups", &config.TransformGroups)
+	updateField(d, "display_name_template", &config.DisplayNameTemplate)
+	updateField(d, "policies_claim", &config.PoliciesClaim)
+	updateField(d, "policies_delimiter", &config.PoliciesDelimiter)
+	updateField(d, "policies_claim_mode", &config.PoliciesClaimMode)
+	updateField(d, "metadata_claims", &config.MetadataClaims)
+	updateField(d, "metadata_claims_prefix", &config.MetadataClaimsPrefix)
+	updateField(d, "max_metadata_keys", &config.MaxMetadataKeys)
+	updateField(d, "max_metadata_value_length", &config.MaxMetadataValueLength)
+	updateField(d, "max_metadata_bytes", &config.MaxMetadataBytes)
+	updateField(d, "all_metadata", &config.AllMetadata)
+	updateField(d, "bound_claims", &config.BoundClaims)
+	updateField(d, "bound_claims_type", &config.BoundClaimsType)
+	updateField(d, "claim_mappings", &config.ClaimMappings)
+	updateField(d, "alias_metadata_claims", &config.AliasMetadataClaims)
+	updateField(d, "required_claims", &config.RequiredClaims)
 
 	// Run checks on values
-	if config.UserClaim == ""  {
+	if config.UserClaim == "" {
 		return logical.ErrorResponse("user claim must be set."), nil
 	}
 	if config.GroupsDelimiter == "" {
 		config.GroupsDelimiter = ","
 	}
+	if config.MaxMetadataKeys <= 0 {
+		config.MaxMetadataKeys = defaultMaxMetadataKeys
+	}
+	if config.MaxMetadataValueLength <= 0 {
+		config.MaxMetadataValueLength = maxMetadataValueLength
+	}
+	if config.MaxMetadataBytes <= 0 {
+		config.MaxMetadataBytes = defaultMaxMetadataBytes
+	}
+	switch config.GroupsClaimSource {
+	case "":
+		config.GroupsClaimSource = groupsSourceUserInfo
+	case groupsSourceUserInfo, groupsSourceIDToken:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("groups_claim_source must be %q or %q.", groupsSourceUserInfo, groupsSourceIDToken)), nil
+	}
+	switch config.GroupsNormalizeCase {
+	case "":
+		config.GroupsNormalizeCase = groupsCaseNone
+	case groupsCaseNone, groupsCaseLower, groupsCaseUpper:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("groups_normalize_case must be %q, %q or %q.", groupsCaseNone, groupsCaseLower, groupsCaseUpper)), nil
+	}
+	if config.MaxGroups < 0 {
+		return logical.ErrorResponse("max_groups can't be negative"), nil
+	}
+	switch config.GroupsOverflowBehavior {
+	case "":
+		config.GroupsOverflowBehavior = groupsOverflowTruncate
+	case groupsOverflowTruncate, groupsOverflowDeny:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("groups_overflow_behavior must be %q or %q.", groupsOverflowTruncate, groupsOverflowDeny)), nil
+	}
 	if config.DisplayNameClaim == "" {
 		config.DisplayNameClaim = config.UserClaim
 	}
+	if config.AliasNameSource == "" {
+		config.AliasNameSource = aliasSourceUserClaim
+	}
+	if err := validateAliasNameSource(config.AliasNameSource); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := config.validateClaimSelectors(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateTemplate(config.DisplayNameTemplate); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid display_name_template: %s", err)), nil
+	}
 	if config.PoliciesDelimiter == "" {
 		config.PoliciesDelimiter = ","
 	}
+	boundClaimsType, err := validateBoundClaimsType(config.BoundClaimsType, config.BoundClaims)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	config.BoundClaimsType = boundClaimsType
+	switch config.PoliciesClaimMode {
+	case "":
+		config.PoliciesClaimMode = policiesClaimMerge
+	case policiesClaimMerge, policiesClaimReplace:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("policies_claim_mode must be %q or %q.", policiesClaimMerge, policiesClaimReplace)), nil
+	}
+	for claim, key := range config.ClaimMappings {
+		if strutil.StrListContains(reservedMetadataKeys, key) {
+			return logical.ErrorResponse(fmt.Sprintf("claim %q is mapped to the reserved metadata key %q", claim, key)), nil
+		}
+	}
+	for _, claim := range config.AliasMetadataClaims {
+		if err := validateClaimSelector(claim); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid alias_metadata_claims entry %q: %s", claim, err)), nil
+		}
+		if err := validateMetadataKey(aliasMetadataKey(claim)); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid alias_metadata_claims entry: %s", err)), nil
+		}
+	}
 
+	config.Version = storageVersion
 	entry, err := logical.StorageEntryJSON(claimsConfigPath, config)
 	if err != nil {
 		return nil, err
@@ -146,72 +422,262 @@ func (b *openIDConnectAuthBackend) pathClaimsConfigWrite(ctx context.Context, re
 		return nil, err
 	}
 
-	b.reset()
-
-	var resp *logical.Response
+	b.resetClaimsConfig()
 
+	var warnings []string
 	if len(config.MetadataClaims) > 0 && config.AllMetadata {
-		resp = &logical.Response{
-			Warnings: []string{
-				"all_metadata enabled, metadata_claims will be ignored.",
-			},
+		warnings = append(warnings, "all_metadata enabled, metadata_claims will be ignored.")
+	}
+	if stored != nil && stored.aliasNameSource() != config.AliasNameSource {
+		warnings = append(warnings, fmt.Sprintf("alias_name_source changed from %q to %q: the entity alias names change at the next login of each user, "+
+			"Vault creates a new entity for them and the policies, groups and metadata of their current entity no longer apply. "+
+			"The 'sub' alias metadata allows matching the new entities with the old ones.", stored.aliasNameSource(), config.AliasNameSource))
+	}
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
+
+	return nil, nil
+}
+
+// pathClaimsConfigList lists the claims copied into metadata by claim_mappings.
+func (b *openIDConnectAuthBackend) pathClaimsConfigList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.claimsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return sortedListResponse(nil), nil
+	}
+
+	claims := make([]string, 0, len(config.ClaimMappings))
+	for claim := range config.ClaimMappings {
+		claims = append(claims, claim)
+	}
+
+	return sortedListResponse(claims), nil
+}
+
+func (b *openIDConnectAuthBackend) pathClaimsConfigDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, claimsConfigPath); err != nil {
+		return nil, err
+	}
+
+	b.resetClaimsConfig()
+
+	return &logical.Response{
+		Warnings: []string{
+			"claims config deleted, logins will fail until it is written again.",
+		},
+	}, nil
+}
+
+// mergeClaims combines the ID token and UserInfo claims, UserInfo values taking
+// precedence unless the groups claim is configured to be read from the ID
+// token. The identity claims of the ID token are always kept.
+func (c *oidcClaimsConfig) mergeClaims(idTokenClaims, userInfoClaims map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(idTokenClaims)+len(userInfoClaims))
+	for k, v := range idTokenClaims {
+		merged[k] = v
+	}
+	for k, v := range userInfoClaims {
+		merged[k] = v
+	}
+	for _, k := range idTokenOnlyClaims {
+		if v, ok := idTokenClaims[k]; ok {
+			merged[k] = v
 		}
 	}
 
-	return resp, nil
+	if c.GroupsClaim != "" && c.GroupsClaimSource == groupsSourceIDToken {
+		root := claimRoot(c.GroupsClaim)
+		if grp, ok := idTokenClaims[root]; ok {
+			merged[root] = grp
+		}
+	}
+
+	return merged
 }
 
-func (c *oidcClaimsConfig) parseUserInfo(info *oidc.UserInfo) (*UserEntry, error) {
+// parseClaims maps the claims to the Vault user. The groups fetched by the
+// provider_config provider are added to the ones of the groups claim.
+func (c *oidcClaimsConfig) parseClaims(allClaims map[string]interface{}, providerGroups []string) (*UserEntry, error) {
 	user := &UserEntry{}
 	user.Metadata = make(map[string]string)
-	var rawClaims map[string]*json.RawMessage
-	err := info.Claims(&rawClaims)
-	if err != nil {
-		return nil, errwrap.Wrapf("failed to encode claims: {{err}}", err)
+
+	for _, claim := range c.RequiredClaims {
+		if _, ok := getClaim(allClaims, claim); !ok {
+			return nil, fmt.Errorf("required claim %q is not present in the ID token or UserInfo", claim)
+		}
 	}
 
-	if usr, ok := rawClaims[c.UserClaim]; ok {
-		user.Username =strings.Trim(string(*usr), "\"")
-		user.Metadata["username"] = user.Username
-	} else {
-		return nil, errors.New("Failed to get user claim")
+	// The username is the entity alias name by default, a blank one would
+	// create an orphan entity
+	usr, ok := getClaim(allClaims, c.UserClaim)
+	if !ok || usr == nil || claimString(usr) == "" {
+		return nil, fmt.Errorf("user claim %q is missing or empty", c.UserClaim)
+	}
+	user.Username = c.transformName(claimString(usr))
+	if user.Username == "" {
+		return nil, fmt.Errorf("user claim %q is empty after the username transformations", c.UserClaim)
+	}
+	user.Metadata["username"] = user.Username
+
+	var err error
+	user.AliasName, err = c.parseAliasName(allClaims, user.Username)
+	if err != nil {
+		return nil, err
 	}
 
-	if c.GroupsClaim != "" {
-		if grp, ok :=  rawClaims[c.GroupsClaim]; ok {
-			user.Groups = strings.Split(strings.Trim(string(*grp), "\""), c.GroupsDelimiter)
+	// A missing groups claim only fails the login when it is required, the
+	// required claims were checked above
+	grp, ok := getClaim(allClaims, c.GroupsClaim)
+	if c.GroupsClaim != "" && !ok {
+		if providerGroups == nil {
+			user.Warnings = append(user.Warnings, fmt.Sprintf("groups claim %q not present in ID token or UserInfo, no group aliases were added", c.GroupsClaim))
 		} else {
-			return nil, errors.New("Failed to get groups claim")
+			user.Warnings = append(user.Warnings, fmt.Sprintf("groups claim %q not present in ID token or UserInfo, only the groups of the provider were added", c.GroupsClaim))
+		}
+	}
+	if c.GroupsClaim != "" && ok {
+		// Objects and numbers are not group names, a pointer selecting them
+		// is a mistake in the claims config
+		switch value := grp.(type) {
+		case string:
+			user.Groups = splitClaim(value, c.GroupsDelimiter)
+		case []interface{}:
+			for _, item := range value {
+				user.Groups = append(user.Groups, claimString(item))
+			}
+		default:
+			return nil, fmt.Errorf("groups claim %q is not a string or a list", c.GroupsClaim)
+		}
+	}
+	if c.GroupsClaim != "" || providerGroups != nil {
+		user.Groups = c.mapGroups(append(user.Groups, providerGroups...))
+		var warning string
+		if user.Groups, warning, err = c.limitGroups(user.Groups); err != nil {
+			return nil, err
+		}
+		if warning != "" {
+			user.Warnings = append(user.Warnings, warning)
 		}
 	}
 
 	if c.PoliciesClaim != "" {
-		if pol, ok :=  rawClaims[c.PoliciesClaim]; ok {
-			user.Policies = strings.Split(strings.Trim(string(*pol), "\""), c.PoliciesDelimiter)
+		if pol, ok := getClaim(allClaims, c.PoliciesClaim); ok {
+			var warnings []string
+			user.Policies, warnings = c.claimPolicies(pol)
+			user.Warnings = append(user.Warnings, warnings...)
 		} else {
-			return nil, errors.New("Failed to get policies claim")
+			user.Warnings = append(user.Warnings, fmt.Sprintf("policies claim %q not present in ID token or UserInfo, no policies were added from it", c.PoliciesClaim))
 		}
 	}
 
-	if dn, ok := rawClaims[c.DisplayNameClaim]; ok {
-		user.DisplayName =strings.Trim(string(*dn), "\"")
+	if c.DisplayNameTemplate != "" {
+		var missing []string
+		user.DisplayName, missing = renderTemplate(c.DisplayNameTemplate, allClaims)
+		for _, claim := range missing {
+			user.Warnings = append(user.Warnings, fmt.Sprintf("claim %q of the display_name_template is missing, it was left empty", claim))
+		}
+	} else if c.DisplayNameClaim == c.UserClaim {
+		user.DisplayName = user.Username
+	} else if dn, ok := getClaim(allClaims, c.DisplayNameClaim); ok {
+		user.DisplayName = claimString(dn)
 	} else {
 		user.DisplayName = user.Username
 	}
 
-	err = c.parseMetadata(&rawClaims, &user.Metadata)
+	err = c.parseMetadata(allClaims, user)
 	if err != nil {
 		return nil, err
 	}
 
+	user.AliasMetadata = make(map[string]string)
+	for claim, key := range c.ClaimMappings {
+		value, ok := getClaim(allClaims, claim)
+		if !ok {
+			user.Warnings = append(user.Warnings, fmt.Sprintf("claim_mappings claim %q not present in ID token or UserInfo, metadata %q was not set", claim, key))
+			continue
+		}
+		user.Metadata[key] = claimString(value)
+		user.AliasMetadata[key] = claimString(value)
+	}
+	for _, claim := range c.AliasMetadataClaims {
+		value, ok := getClaim(allClaims, claim)
+		if !ok {
+			user.Warnings = append(user.Warnings, fmt.Sprintf("claim %q is missing, it was not added to the alias metadata", claim))
+			continue
+		}
+		user.AliasMetadata[aliasMetadataKey(claim)] = claimString(value)
+	}
+	// The subject identifies the user when the alias name changes at the Idp
+	if c.aliasNameSource() != aliasSourceSubject {
+		if sub, ok := allClaims["sub"]; ok {
+			user.AliasMetadata["sub"] = claimString(sub)
+		}
+	}
+
 	return user, nil
 }
 
-func (c *oidcClaimsConfig) parseMetadata(claims *map[string]*json.RawMessage, metadata *map[string]string) error {
+// aliasNameSource returns the alias_name_source, claims configs written before
+// it existed use the username.
+func (c *oidcClaimsConfig) aliasNameSource() string {
+	if c.AliasNameSource == "" {
+		return aliasSourceUserClaim
+	}
+	return c.AliasNameSource
+}
+
+// parseAliasName returns the entity alias name read from the
+// alias_name_source, a blank one would create an orphan entity.
+func (c *oidcClaimsConfig) parseAliasName(allClaims map[string]interface{}, username string) (string, error) {
+	source := c.aliasNameSource()
+	if source == aliasSourceUserClaim {
+		return username, nil
+	}
+
+	claim := strings.TrimPrefix(source, aliasSourceClaimPrefix)
+	value, ok := getClaim(allClaims, claim)
+	if !ok || value == nil || claimString(value) == "" {
+		return "", fmt.Errorf("claim %q of the alias_name_source is missing or empty", claim)
+	}
+
+	return claimString(value), nil
+}
+
+// validateAliasNameSource checks the alias_name_source, claims given with the
+// 'claim:' prefix may be JSON pointers.
+func validateAliasNameSource(source string) error {
+	switch source {
+	case aliasSourceUserClaim, aliasSourceSubject, aliasSourceEmail, aliasSourcePreferredUsername:
+		return nil
+	}
+
+	claim := strings.TrimPrefix(source, aliasSourceClaimPrefix)
+	if claim == source || claim == "" {
+		return fmt.Errorf("alias_name_source must be %q, %q, %q, %q or %q followed by a claim name", aliasSourceUserClaim,
+			aliasSourceSubject, aliasSourceEmail, aliasSourcePreferredUsername, aliasSourceClaimPrefix)
+	}
+	if err := validateClaimSelector(claim); err != nil {
+		return fmt.Errorf("invalid alias_name_source: %s", err)
+	}
+
+	return nil
+}
+
+// parseMetadata copies the metadata_claims, or all the claims, into the user
+// metadata. Keys and values over the metadata limits are dropped or truncated
+// with a warning rather than failing the login, as are the claims named after
+// a key set by the backend.
+func (c *oidcClaimsConfig) parseMetadata(claims map[string]interface{}, user *UserEntry) error {
+	metadata := make(map[string]string)
+
 	// Add all claims to metadata
 	if c.AllMetadata {
-		for k, v := range *claims {
-			(*metadata)[k] = strings.Trim(string(*v), "\"")
+		for k, v := range claims {
+			metadata[k] = claimString(v)
 		}
 	} else {
 		for _, claim := range c.MetadataClaims {
@@ -224,36 +690,732 @@ func (c *oidcClaimsConfig) parseMetadata(claims *map[string]*json.RawMessage, me
 				}
 				claim = kv[0]
 				claimKey = kv[1]
+			} else if strings.HasPrefix(claim, "/") {
+				claimKey = pointerName(claim)
 			}
 
-			if md, ok := (*claims)[claim]; ok {
-				(*metadata)[claimKey] = strings.Trim(string(*md), "\"")
+			md, ok := getClaim(claims, claim)
+			if !ok {
+				user.Warnings = append(user.Warnings, fmt.Sprintf("metadata_claims claim %q not present in ID token or UserInfo, metadata %q was not set", claim, claimKey))
+				continue
 			}
+			metadata[claimKey] = claimString(md)
+		}
+	}
+
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value := metadata[k]
+		k = c.MetadataClaimsPrefix + k
+		if strutil.StrListContains(reservedMetadataKeys, k) {
+			user.Warnings = append(user.Warnings, fmt.Sprintf("metadata key %q is reserved, the claim was not added to the metadata", k))
+			continue
+		}
+		if len(k) > maxMetadataKeyLength {
+			user.Warnings = append(user.Warnings, fmt.Sprintf("metadata key %q is longer than %d characters, it was not added to the metadata", k, maxMetadataKeyLength))
+			continue
+		}
+		user.Metadata[k] = value
+	}
+
+	return nil
+}
+
+// templatePlaceholder matches the {{claim}} placeholders of a template, the
+// claim may be a JSON pointer.
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// validateTemplate checks that every '{{' of the template starts a well formed
+// placeholder.
+func validateTemplate(tmpl string) error {
+	stripped := templatePlaceholder.ReplaceAllString(tmpl, "")
+	if strings.Contains(stripped, "{{") || strings.Contains(stripped, "}}") {
+		return errors.New("template contains a malformed placeholder")
+	}
+
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(tmpl, -1) {
+		if err := validateClaimSelector(match[1]); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// renderTemplate replaces the placeholders with the claim values, the claims
+// which are missing are rendered empty and returned.
+func renderTemplate(tmpl string, allClaims map[string]interface{}) (string, []string) {
+	var missing []string
+	rendered := templatePlaceholder.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		claim := templatePlaceholder.FindStringSubmatch(placeholder)[1]
+		value, ok := getClaim(allClaims, claim)
+		if !ok {
+			missing = append(missing, claim)
+			return ""
+		}
+		return claimString(value)
+	})
+
+	return rendered, missing
+}
+
+// transformName applies the username transformations, in order: strip the
+// prefix, strip the email domain, lowercase.
+func (c *oidcClaimsConfig) transformName(name string) string {
+	if prefix := c.UsernameStripPrefix; prefix != "" && len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+		name = name[len(prefix):]
+	}
+	if domain := "@" + c.UsernameStripDomain; c.UsernameStripDomain != "" && len(name) > len(domain) &&
+		strings.EqualFold(name[len(name)-len(domain):], domain) {
+		name = name[:len(name)-len(domain)]
+	}
+	if c.UsernameLowercase {
+		name = strings.ToLower(name)
+	}
+
+	return name
+}
+
+// mapGroups applies the username transformations when transform_groups is set,
+// then normalizes the groups.
+func (c *oidcClaimsConfig) mapGroups(groups []string) []string {
+	if c.TransformGroups {
+		for i, grp := range groups {
+			groups[i] = c.transformName(grp)
+		}
+	}
+
+	return c.normalizeGroups(groups)
+}
+
+// limitGroups keeps the groups matching groups_filter and applies max_groups.
+// Truncated groups are sorted first so that a login always keeps the same
+// groups, whatever order the Idp returns them in.
+func (c *oidcClaimsConfig) limitGroups(groups []string) ([]string, string, error) {
+	if len(c.GroupsFilter) > 0 {
+		filtered := make([]string, 0, len(groups))
+		for _, grp := range groups {
+			if strutil.StrListContainsGlob(c.GroupsFilter, grp) {
+				filtered = append(filtered, grp)
+			}
+		}
+		groups = filtered
+	}
+
+	if c.MaxGroups <= 0 || len(groups) <= c.MaxGroups {
+		return groups, "", nil
+	}
+	if c.GroupsOverflowBehavior == groupsOverflowDeny {
+		return nil, "", fmt.Errorf("the user is in %d groups, over max_groups %d", len(groups), c.MaxGroups)
+	}
+
+	sorted := make([]string, len(groups))
+	copy(sorted, groups)
+	sort.Strings(sorted)
+	return sorted[:c.MaxGroups], fmt.Sprintf("the user is in %d groups, only the first %d in lexical order were kept, see max_groups", len(groups), c.MaxGroups), nil
+}
+
+// splitClaim splits a delimited string claim, trimming the values and
+// dropping the empty ones.
+func splitClaim(value, delimiter string) []string {
+	var values []string
+	for _, item := range strings.Split(value, delimiter) {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+
+	return values
+}
+
+// normalizeGroups applies the configured case conversion and whitespace
+// trimming to the group names, dropping the duplicates and empty names this
+// produces.
+func (c *oidcClaimsConfig) normalizeGroups(groups []string) []string {
+	normalized := make([]string, 0, len(groups))
+	seen := make(map[string]bool, len(groups))
+	for _, grp := range groups {
+		if c.GroupsTrimWhitespace {
+			grp = strings.TrimSpace(grp)
+		}
+		switch c.GroupsNormalizeCase {
+		case groupsCaseLower:
+			grp = strings.ToLower(grp)
+		case groupsCaseUpper:
+			grp = strings.ToUpper(grp)
+		}
+
+		if grp == "" || seen[grp] {
+			continue
+		}
+		seen[grp] = true
+		normalized = append(normalized, grp)
+	}
+
+	return normalized
+}
+
+// Metadata limits of the identity store, and the defaults of the configurable
+// limits
+const (
+	maxMetadataKeyLength   = 128
+	maxMetadataValueLength = 512
+
+	defaultMaxMetadataKeys  = 128
+	defaultMaxMetadataBytes = 32768
+)
+
+// limitMetadata applies the configured metadata limits. Keys are kept in a
+// deterministic order, the reserved keys first and then by name, so that the
+// same claims always drop the same keys. Warnings list what was truncated or
+// dropped.
+func (c *oidcClaimsConfig) limitMetadata(metadata map[string]string) []string {
+	maxKeys, maxValue, maxBytes := c.MaxMetadataKeys, c.MaxMetadataValueLength, c.MaxMetadataBytes
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxMetadataKeys
+	}
+	if maxValue <= 0 {
+		maxValue = maxMetadataValueLength
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxMetadataBytes
+	}
+
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		if !strutil.StrListContains(reservedMetadataKeys, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for i := len(reservedMetadataKeys) - 1; i >= 0; i-- {
+		if _, ok := metadata[reservedMetadataKeys[i]]; ok {
+			keys = append([]string{reservedMetadataKeys[i]}, keys...)
+		}
+	}
+
+	var warnings, truncated, dropped []string
+	size := 0
+	for i, k := range keys {
+		value := metadata[k]
+		if len(value) > maxValue {
+			value = value[:maxValue]
+			for !utf8.ValidString(value) {
+				value = value[:len(value)-1]
+			}
+			metadata[k] = value
+			truncated = append(truncated, k)
+		}
+
+		if i >= maxKeys || size+len(k)+len(value) > maxBytes {
+			delete(metadata, k)
+			dropped = append(dropped, k)
+			continue
+		}
+		size += len(k) + len(value)
+	}
+
+	if len(truncated) > 0 {
+		warnings = append(warnings, fmt.Sprintf("metadata values over %d characters were truncated: %s", maxValue, strings.Join(truncated, ", ")))
+	}
+	if len(dropped) > 0 {
+		warnings = append(warnings, fmt.Sprintf("metadata over the limit of %d keys or %d bytes was dropped: %s", maxKeys, maxBytes, strings.Join(dropped, ", ")))
+	}
+
+	return warnings
+}
+
+// validateMetadataKey checks a claim name used as an alias metadata key
+// against the identity store limits.
+func validateMetadataKey(key string) error {
+	switch {
+	case key == "":
+		return errors.New("metadata key can't be empty")
+	case len(key) > maxMetadataKeyLength:
+		return fmt.Errorf("metadata key %q is longer than %d characters", key, maxMetadataKeyLength)
+	case strutil.StrListContains(reservedMetadataKeys, key):
+		return fmt.Errorf("metadata key %q is reserved", key)
+	}
+
+	for _, r := range key {
+		if r < 0x21 || r > 0x7e {
+			return fmt.Errorf("metadata key %q must only contain printable ASCII characters without spaces", key)
+		}
+	}
+
+	return nil
+}
+
+// getClaim returns the claim named by the selector. A selector starting with
+// '/' is a JSON pointer into nested claims, any other selector is the name of
+// a top level claim.
+func getClaim(allClaims map[string]interface{}, selector string) (interface{}, bool) {
+	if !strings.HasPrefix(selector, "/") {
+		value, ok := allClaims[selector]
+		return value, ok
+	}
+
+	var current interface{} = allClaims
+	for _, token := range strings.Split(selector[1:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch v := current.(type) {
+		case map[string]interface{}:
+			next, ok := v[token]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []interface{}:
+			idx, err := strconv.Atoi(token)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			current = v[idx]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// aliasMetadataKey returns the alias metadata key of an alias_metadata_claims
+// entry, the claim name or the last token of a JSON pointer.
+func aliasMetadataKey(claim string) string {
+	if strings.HasPrefix(claim, "/") {
+		return pointerName(claim)
+	}
+	return claim
+}
+
+// pointerName returns the last reference token of a JSON pointer, unescaped,
+// as the name of the claim it selects.
+func pointerName(pointer string) string {
+	name := pointer[strings.LastIndex(pointer, "/")+1:]
+	return strings.Replace(strings.Replace(name, "~1", "/", -1), "~0", "~", -1)
+}
+
+// validateClaimSelectors checks the selectors of every claim reference of the
+// claims config.
+func (c *oidcClaimsConfig) validateClaimSelectors() error {
+	selectors := map[string]string{
+		"user_claim":         c.UserClaim,
+		"groups_claim":       c.GroupsClaim,
+		"policies_claim":     c.PoliciesClaim,
+		"display_name_claim": c.DisplayNameClaim,
+	}
+	for _, claim := range c.MetadataClaims {
+		selectors["metadata_claims entry "+claim] = strings.SplitN(claim, "=", 2)[0]
+	}
+	for claim := range c.ClaimMappings {
+		selectors["claim_mappings entry "+claim] = claim
+	}
+	for claim := range c.BoundClaims {
+		selectors["bound_claims entry "+claim] = claim
+	}
+	for _, claim := range c.RequiredClaims {
+		selectors["required_claims entry "+claim] = claim
+	}
+
+	for name, selector := range selectors {
+		if err := validateClaimSelector(selector); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateClaimSelector checks that a selector given as a JSON pointer is
+// well formed, see RFC 6901.
+func validateClaimSelector(selector string) error {
+	if !strings.HasPrefix(selector, "/") {
+		return nil
+	}
+	if selector == "/" {
+		return errors.New("JSON pointer must reference a claim")
+	}
+
+	for i := 0; i < len(selector); i++ {
+		if selector[i] != '~' {
+			continue
+		}
+		if i+1 >= len(selector) || (selector[i+1] != '0' && selector[i+1] != '1') {
+			return fmt.Errorf("JSON pointer %q contains an invalid escape sequence", selector)
+		}
+	}
+
+	return nil
+}
+
+// claimRoot returns the name of the top level claim a selector reads from.
+func claimRoot(selector string) string {
+	if !strings.HasPrefix(selector, "/") {
+		return selector
+	}
+
+	root := strings.SplitN(selector[1:], "/", 2)[0]
+	return strings.Replace(strings.Replace(root, "~1", "/", -1), "~0", "~", -1)
+}
+
+// claimString returns string claims as is and the JSON encoding of any other
+// claim value.
+func claimString(claim interface{}) string {
+	if s, ok := claim.(string); ok {
+		return s
+	}
+
+	encoded, err := json.Marshal(claim)
+	if err != nil {
+		return fmt.Sprint(claim)
+	}
+
+	return string(encoded)
+}
+
+// claimPolicies returns the policies of the policies claim, a list or a
+// delimited string. Names which are not valid policy names and the root policy
+// are dropped with a warning.
+func (c *oidcClaimsConfig) claimPolicies(claim interface{}) ([]string, []string) {
+	var names []string
+	if list, ok := claim.([]interface{}); ok {
+		for _, item := range list {
+			names = append(names, claimString(item))
+		}
+	} else {
+		names = strings.Split(claimString(claim), c.PoliciesDelimiter)
+	}
+
+	var policies, warnings []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "":
+		case name == "root":
+			warnings = append(warnings, "the root policy of the policies claim was ignored")
+		case !policyNameRe.MatchString(name):
+			warnings = append(warnings, fmt.Sprintf("invalid policy name %q of the policies claim was ignored", name))
+		default:
+			policies = append(policies, name)
+		}
+	}
+
+	return strutil.RemoveDuplicates(policies, false), warnings
+}
+
+// tokenPolicies returns the policies of the token from the policies claim and
+// the policies of the role and the groups. With the 'replace' mode the claim
+// policies are used alone as soon as the claim has any.
+func (c *oidcClaimsConfig) tokenPolicies(claimPolicies, mappedPolicies []string) []string {
+	if c != nil && c.PoliciesClaimMode == policiesClaimReplace && len(claimPolicies) > 0 {
+		return strutil.RemoveDuplicates(append([]string{}, claimPolicies...), false)
+	}
+	return strutil.RemoveDuplicates(append(append([]string{}, claimPolicies...), mappedPolicies...), false)
+}
+
+// validateEmail checks that the email of the user is verified when
+// require_verified_email is set, a warning is returned instead when the
+// unverified email identifies the user.
+func (c *oidcClaimsConfig) validateEmail(allClaims map[string]interface{}) (string, error) {
+	if _, ok := allClaims["email"]; !ok && !c.RequireVerifiedEmail {
+		return "", nil
+	}
+
+	if claimTrue(allClaims["email_verified"]) {
+		return "", nil
+	}
+	if c.RequireVerifiedEmail {
+		return "", errors.New("the email of the user is not verified, it is required by require_verified_email")
+	}
+	if c.usesEmail() {
+		return "the email of the user is not verified by the Idp and is used as the username, alias name or display name, set require_verified_email to deny such logins", nil
+	}
+
+	return "", nil
+}
+
+// usesEmail reports whether the email claim is the username, the alias name
+// or part of the display name.
+func (c *oidcClaimsConfig) usesEmail() bool {
+	if c.UserClaim == "email" {
+		return true
+	}
+	switch c.aliasNameSource() {
+	case aliasSourceEmail, aliasSourceClaimPrefix + "email":
+		return true
+	}
+	if c.DisplayNameTemplate != "" {
+		for _, match := range templatePlaceholder.FindAllStringSubmatch(c.DisplayNameTemplate, -1) {
+			if match[1] == "email" {
+				return true
+			}
+		}
+		return false
+	}
+
+	return c.DisplayNameClaim == "email"
+}
+
+// validateEmailDomain checks that the verified email of the user belongs to
+// one of the allowed_email_domains. Logins fail closed when the email is
+// missing or the Idp says it is not verified.
+func (c *oidcClaimsConfig) validateEmailDomain(allClaims map[string]interface{}) error {
+	if len(c.AllowedEmailDomains) == 0 {
+		return nil
+	}
+
+	email, _ := allClaims["email"].(string)
+	if email == "" {
+		return errors.New("the email claim is missing, it is required by allowed_email_domains")
+	}
+	if verified, ok := allClaims["email_verified"]; ok && !claimTrue(verified) {
+		return errors.New("the email of the user is not verified")
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 || !strutil.StrListContains(c.AllowedEmailDomains, strings.ToLower(email[at+1:])) {
+		return fmt.Errorf("email %q is not in one of the allowed_email_domains", email)
+	}
+
+	return nil
+}
+
+// claimTrue reports whether a boolean claim is true, some Idps send booleans
+// as strings.
+func claimTrue(claim interface{}) bool {
+	switch v := claim.(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+func cleanEmailDomains(domains []string) []string {
+	cleaned := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain != "" {
+			cleaned = append(cleaned, domain)
+		}
+	}
+
+	return strutil.RemoveDuplicates(cleaned, false)
+}
+
+// validateBoundClaimsType returns the bound claims type, 'string' by default,
+// and checks the bound claims values are valid patterns for the 'glob' type.
+func validateBoundClaimsType(boundClaimsType string, boundClaims map[string]interface{}) (string, error) {
+	switch boundClaimsType {
+	case "":
+		return boundClaimsString, nil
+	case boundClaimsString:
+		return boundClaimsType, nil
+	case boundClaimsGlob:
+	default:
+		return "", fmt.Errorf("bound_claims_type must be %q or %q.", boundClaimsString, boundClaimsGlob)
+	}
+
+	for claim, expected := range boundClaims {
+		for _, pattern := range claimValues(expected) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return "", fmt.Errorf("invalid glob %q for bound claim %q: %s", pattern, claim, err)
+			}
+		}
+	}
+
+	return boundClaimsType, nil
+}
+
+// validateBoundClaims checks that every bound claim is present in the claims
+// and matches one of its expected values. Claims holding a list match when any
+// of their values match, and missing claims never match. With the 'glob' type
+// string values are matched against the expected values as patterns, other
+// values are always compared literally.
+func validateBoundClaims(boundClaims map[string]interface{}, boundClaimsType string, allClaims map[string]interface{}) error {
+	for claim, expected := range boundClaims {
+		actual, ok := getClaim(allClaims, claim)
+		if !ok || actual == nil {
+			return fmt.Errorf("claim %q is missing", claim)
+		}
+
+		expectedValues := claimValues(expected)
+		matched := false
+		for _, value := range claimList(actual) {
+			if boundClaimMatches(expectedValues, boundClaimsType, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("claim %q does not match any of the bound values", claim)
+		}
+	}
+
+	return nil
+}
+
+// claimList returns the values of a list claim, or the claim itself.
+func claimList(claim interface{}) []interface{} {
+	switch v := claim.(type) {
+	case []interface{}:
+		return v
+	case []string:
+		values := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			values = append(values, item)
+		}
+		return values
+	}
+
+	return []interface{}{claim}
+}
+
+func boundClaimMatches(expectedValues []string, boundClaimsType string, value interface{}) bool {
+	if s, ok := value.(string); ok && boundClaimsType == boundClaimsGlob {
+		for _, pattern := range expectedValues {
+			if matched, _ := path.Match(pattern, s); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	s, ok := scalarString(value)
+	return ok && strutil.StrListContains(expectedValues, s)
+}
+
+// claimValues returns the string forms of a scalar claim, or of each scalar in
+// a list claim, so that values of different JSON types can be compared.
+func claimValues(claim interface{}) []string {
+	var values []string
+	switch v := claim.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := scalarString(item); ok {
+				values = append(values, s)
+			}
+		}
+	case []string:
+		values = append(values, v...)
+	default:
+		if s, ok := scalarString(v); ok {
+			values = append(values, s)
+		}
+	}
+
+	return values
+}
+
+func scalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	}
+
+	return "", false
+}
+
 type UserEntry struct {
-	Username	string
-	DisplayName string
-	Groups 		[]string
-	Policies 	[]string
-	Metadata    map[string]string
+	Username      string
+	AliasName     string
+	DisplayName   string
+	Groups        []string
+	Policies      []string
+	Metadata      map[string]string
+	AliasMetadata map[string]string
+	Warnings      []string
 }
 
 type oidcClaimsConfig struct {
-	DisplayNameClaim  string   `json:"display_name_claim"`
-	UserClaim         string   `json:"user_claim"`
-	GroupsClaim       string   `json:"groups_claim"`
-	GroupsDelimiter   string   `json:"groups_delimiter"`
-	PoliciesClaim     string   `json:"policies_claim"`
-	PoliciesDelimiter string   `json:"policies_delimiter"`
-	MetadataClaims    []string `json:"metadata_claims"`
-	AllMetadata       bool     `json:"all_metadata"`
+	DisplayNameClaim       string                 `json:"display_name_claim"`
+	DisplayNameTemplate    string                 `json:"display_name_template"`
+	UsernameStripPrefix    string                 `json:"username_strip_prefix"`
+	UsernameStripDomain    string                 `json:"username_strip_domain"`
+	UsernameLowercase      bool                   `json:"username_lowercase"`
+	TransformGroups        bool                   `json:"transform_groups"`
+	UserClaim              string                 `json:"user_claim"`
+	AliasNameSource        string                 `json:"alias_name_source"`
+	GroupsClaim            string                 `json:"groups_claim"`
+	GroupsDelimiter        string                 `json:"groups_delimiter"`
+	GroupsClaimSource      string                 `json:"groups_claim_source"`
+	GroupsCaseInsensitive  bool                   `json:"groups_case_insensitive"`
+	GroupsNormalizeCase    string                 `json:"groups_normalize_case"`
+	GroupsTrimWhitespace   bool                   `json:"groups_trim_whitespace"`
+	GroupsFilter           []string               `json:"groups_filter"`
+	MaxGroups              int                    `json:"max_groups"`
+	GroupsOverflowBehavior string                 `json:"groups_overflow_behavior"`
+	ResolveClaimSources    bool                   `json:"resolve_claim_sources"`
+	AllowedEmailDomains    []string               `json:"allowed_email_domains"`
+	RequireVerifiedEmail   bool                   `json:"require_verified_email"`
+	PoliciesClaim          string                 `json:"policies_claim"`
+	PoliciesDelimiter      string                 `json:"policies_delimiter"`
+	PoliciesClaimMode      string                 `json:"policies_claim_mode"`
+	MetadataClaims         []string               `json:"metadata_claims"`
+	MetadataClaimsPrefix   string                 `json:"metadata_claims_prefix"`
+	MaxMetadataKeys        int                    `json:"max_metadata_keys"`
+	MaxMetadataValueLength int                    `json:"max_metadata_value_length"`
+	MaxMetadataBytes       int                    `json:"max_metadata_bytes"`
+	AllMetadata            bool                   `json:"all_metadata"`
+	BoundClaims            map[string]interface{} `json:"bound_claims"`
+	BoundClaimsType        string                 `json:"bound_claims_type"`
+	ClaimMappings          map[string]string      `json:"claim_mappings"`
+	AliasMetadataClaims    []string               `json:"alias_metadata_claims"`
+	RequiredClaims         []string               `json:"required_claims"`
+
+	Version int `json:"version"`
 }
 
+const (
+	groupsSourceUserInfo = "userinfo"
+	groupsSourceIDToken  = "id_token"
+
+	groupsCaseNone  = "none"
+	groupsCaseLower = "lower"
+	groupsCaseUpper = "upper"
+
+	policiesClaimMerge   = "merge"
+	policiesClaimReplace = "replace"
+
+	boundClaimsString = "string"
+	boundClaimsGlob   = "glob"
+
+	groupsOverflowTruncate = "truncate"
+	groupsOverflowDeny     = "deny"
+
+	aliasSourceUserClaim         = "user_claim"
+	aliasSourceSubject           = "sub"
+	aliasSourceEmail             = "email"
+	aliasSourcePreferredUsername = "preferred_username"
+	aliasSourceClaimPrefix       = "claim:"
+)
+
+// policyNameRe matches the policy names accepted from the policies claim
+var policyNameRe = regexp.MustCompile(`^[a-z0-9_.\-/]+$`)
+
+// idTokenOnlyClaims identify the user and the token issuer, UserInfo can't
+// replace them.
+var idTokenOnlyClaims = []string{"sub", "iss", "aud"}
+
+// reservedMetadataKeys are set by the backend itself and can't be used as
+// claim mapping targets.
+var reservedMetadataKeys = []string{"role", "username"}
+
 const (
 	claimsHelpSyn = `
 Configures Claims mapping to Vault entity attributes.
@@ -263,5 +1425,21 @@ The JWT authentication backend validates JWTs (or OIDC) using the configured
 credentials. If using OIDC Discovery, the URL must be provided, along
 with (optionally) the CA cert to use for the connection. If performing JWT
 validation locally, a set of public keys must be provided.
+
+Listing the claims config returns the claims copied by 'claim_mappings'.
+Logins require the claims config, they fail after it is deleted.
+
+The username transformations are applied in a fixed order: 'username_strip_prefix',
+then 'username_strip_domain', then 'username_lowercase'. With 'transform_groups'
+they apply to the group names too, before the groups normalization.
+
+The groups_claim, policies_claim and the claims of metadata_claims,
+claim_mappings and alias_metadata_claims which are missing at login add a
+warning to the login response, the claims listed in 'required_claims' fail
+the login instead.
+
+The entity alias name is the username unless 'alias_name_source' selects
+another claim. Use 'sub' when the usernames or emails may change at the Idp,
+changing the source of a mount in use creates new entities for its users.
 `
 )
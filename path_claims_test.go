@@ -0,0 +1,289 @@
+package oidc
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testClaimsDocument = `{
+	"sub": "user-1",
+	"email": "user@example.com",
+	"age": 42,
+	"ratio": 0.5,
+	"active": true,
+	"groups": ["admins", "developers"],
+	"realm_access": {
+		"roles": ["reader", "writer"],
+		"level": 3
+	},
+	"resource_access": {
+		"vault": {"roles": ["operator"]}
+	},
+	"addresses": [
+		{"country": "FR", "zip": 75001},
+		{"country": "DE", "zip": 10115}
+	],
+	"a/b": "slash",
+	"m~n": "tilde",
+	"nested": {"x/y~z": {"value": "escaped"}},
+	"nothing": null
+}`
+
+func testClaims(t *testing.T) map[string]interface{} {
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(testClaimsDocument), &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestGetClaim(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     interface{}
+		found    bool
+	}{
+		// Top level names
+		{"email", "user@example.com", true},
+		{"age", float64(42), true},
+		{"ratio", 0.5, true},
+		{"active", true, true},
+		{"nothing", nil, true},
+		{"missing", nil, false},
+		{"a/b", "slash", true},
+		{"realm_access/roles", nil, false},
+
+		// Nested objects
+		{"/email", "user@example.com", true},
+		{"/realm_access/roles", []interface{}{"reader", "writer"}, true},
+		{"/realm_access/level", float64(3), true},
+		{"/resource_access/vault/roles", []interface{}{"operator"}, true},
+		{"/realm_access/missing", nil, false},
+		{"/email/domain", nil, false},
+
+		// Arrays
+		{"/groups/0", "admins", true},
+		{"/groups/1", "developers", true},
+		{"/groups/2", nil, false},
+		{"/groups/-1", nil, false},
+		{"/groups/first", nil, false},
+		{"/addresses/1/country", "DE", true},
+		{"/addresses/0/zip", float64(75001), true},
+		{"/addresses/0", map[string]interface{}{"country": "FR", "zip": float64(75001)}, true},
+
+		// Escaped tokens
+		{"/a~1b", "slash", true},
+		{"/m~0n", "tilde", true},
+		{"/nested/x~1y~0z/value", "escaped", true},
+		{"/a/b", nil, false},
+	}
+
+	claims := testClaims(t)
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			got, found := getClaim(claims, tt.selector)
+			if found != tt.found {
+				t.Fatalf("expected found %t, got %t", tt.found, found)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateClaimSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		valid    bool
+	}{
+		{"email", true},
+		{"m~n", true},
+		{"/realm_access/roles", true},
+		{"/a~1b", true},
+		{"/m~0n", true},
+		{"/groups/0", true},
+		{"/", false},
+		{"/m~2n", false},
+		{"/m~", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			err := validateClaimSelector(tt.selector)
+			if tt.valid != (err == nil) {
+				t.Fatalf("expected valid %t, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestClaimRootAndPointerName(t *testing.T) {
+	tests := []struct {
+		selector string
+		root     string
+		key      string
+	}{
+		{"groups", "groups", "groups"},
+		{"/realm_access/roles", "realm_access", "roles"},
+		{"/a~1b", "a/b", "a/b"},
+		{"/nested/x~1y~0z", "nested", "x/y~z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			if root := claimRoot(tt.selector); root != tt.root {
+				t.Fatalf("expected root %q, got %q", tt.root, root)
+			}
+			if key := aliasMetadataKey(tt.selector); key != tt.key {
+				t.Fatalf("expected alias metadata key %q, got %q", tt.key, key)
+			}
+		})
+	}
+}
+
+// TestParseClaims_Selectors checks every claim reference of the claims config
+// resolves JSON pointers.
+func TestParseClaims_Selectors(t *testing.T) {
+	config := &oidcClaimsConfig{
+		UserClaim:           "/addresses/0/country",
+		GroupsClaim:         "/realm_access/roles",
+		GroupsDelimiter:     ",",
+		DisplayNameClaim:    "/resource_access/vault/roles/0",
+		PoliciesClaim:       "/resource_access/vault/roles",
+		PoliciesDelimiter:   ",",
+		ClaimMappings:       map[string]string{"/addresses/1/zip": "zip", "/m~0n": "tilde"},
+		AliasMetadataClaims: []string{"/realm_access/level", "/a~1b"},
+	}
+
+	user, err := config.parseClaims(testClaims(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Username != "FR" {
+		t.Fatalf("unexpected username %q", user.Username)
+	}
+	if !reflect.DeepEqual(user.Groups, []string{"reader", "writer"}) {
+		t.Fatalf("unexpected groups %#v", user.Groups)
+	}
+	if user.DisplayName != "operator" {
+		t.Fatalf("unexpected display name %q", user.DisplayName)
+	}
+	if !reflect.DeepEqual(user.Policies, []string{"operator"}) {
+		t.Fatalf("unexpected policies %#v", user.Policies)
+	}
+	if user.Metadata["zip"] != "10115" || user.Metadata["tilde"] != "tilde" {
+		t.Fatalf("unexpected metadata %#v", user.Metadata)
+	}
+	wantAlias := map[string]string{
+		"zip":   "10115",
+		"tilde": "tilde",
+		"level": "3",
+		"a/b":   "slash",
+		"sub":   "user-1",
+	}
+	if !reflect.DeepEqual(user.AliasMetadata, wantAlias) {
+		t.Fatalf("unexpected alias metadata %#v", user.AliasMetadata)
+	}
+}
+
+func TestParseClaims_GroupsClaimTypes(t *testing.T) {
+	tests := []struct {
+		groupsClaim string
+		want        []string
+		wantErr     bool
+	}{
+		{groupsClaim: "groups", want: []string{"admins", "developers"}},
+		{groupsClaim: "/resource_access/vault/roles", want: []string{"operator"}},
+		{groupsClaim: "/groups/1", want: []string{"developers"}},
+		{groupsClaim: "email", want: []string{"user@example.com"}},
+		{groupsClaim: "/realm_access", wantErr: true},
+		{groupsClaim: "/realm_access/level", wantErr: true},
+		{groupsClaim: "active", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.groupsClaim, func(t *testing.T) {
+			config := &oidcClaimsConfig{
+				UserClaim:       "email",
+				GroupsClaim:     tt.groupsClaim,
+				GroupsDelimiter: ",",
+			}
+
+			user, err := config.parseClaims(testClaims(t), nil)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), tt.groupsClaim) {
+					t.Fatalf("expected an error naming %q, got %v", tt.groupsClaim, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(user.Groups, tt.want) {
+				t.Fatalf("expected groups %#v, got %#v", tt.want, user.Groups)
+			}
+		})
+	}
+}
+
+func TestValidateBoundClaims_Selectors(t *testing.T) {
+	tests := []struct {
+		name        string
+		boundClaims map[string]interface{}
+		matches     bool
+	}{
+		{"nested list", map[string]interface{}{"/realm_access/roles": "writer"}, true},
+		{"nested list mismatch", map[string]interface{}{"/realm_access/roles": "admin"}, false},
+		{"number", map[string]interface{}{"/realm_access/level": "3"}, true},
+		{"number list", map[string]interface{}{"age": []interface{}{"41", "42"}}, true},
+		{"boolean", map[string]interface{}{"active": "true"}, true},
+		{"array index", map[string]interface{}{"/addresses/1/country": "DE"}, true},
+		{"escaped pointer", map[string]interface{}{"/a~1b": "slash"}, true},
+		{"missing", map[string]interface{}{"/realm_access/missing": "x"}, false},
+		{"null", map[string]interface{}{"nothing": "null"}, false},
+	}
+
+	claims := testClaims(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBoundClaims(tt.boundClaims, boundClaimsString, claims)
+			if tt.matches != (err == nil) {
+				t.Fatalf("expected match %t, got error %v", tt.matches, err)
+			}
+		})
+	}
+}
+
+// TestValidateEmail_Warning checks unverified emails are reported when they
+// identify the user, whichever field they feed.
+func TestValidateEmail_Warning(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  oidcClaimsConfig
+		warning bool
+	}{
+		{"username", oidcClaimsConfig{UserClaim: "email", DisplayNameClaim: "email"}, true},
+		{"alias name", oidcClaimsConfig{UserClaim: "sub", DisplayNameClaim: "sub", AliasNameSource: aliasSourceEmail}, true},
+		{"alias name claim", oidcClaimsConfig{UserClaim: "sub", DisplayNameClaim: "sub", AliasNameSource: "claim:email"}, true},
+		{"display name", oidcClaimsConfig{UserClaim: "sub", DisplayNameClaim: "email"}, true},
+		{"display name template", oidcClaimsConfig{UserClaim: "sub", DisplayNameTemplate: "{{ name }} <{{ email }}>"}, true},
+		{"unused", oidcClaimsConfig{UserClaim: "sub", DisplayNameClaim: "sub"}, false},
+	}
+
+	claims := map[string]interface{}{"sub": "user-1", "email": "user@example.com", "email_verified": false}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warning, err := tt.config.validateEmail(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.warning != (warning != "") {
+				t.Fatalf("expected a warning %t, got %q", tt.warning, warning)
+			}
+		})
+	}
+}
@@ -1,11 +1,16 @@
 package oidc
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"context"
@@ -13,51 +18,46 @@ import (
 	oidc "github.com/coreos/go-oidc"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/vault/helper/parseutil"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"golang.org/x/oauth2"
 )
 
+// defaultClockSkewLeeway is the clock drift allowed on the token time claims
+// when clock_skew_leeway is not set.
+const defaultClockSkewLeeway = 60 * time.Second
+
+// skipIssuerWarning is returned by config writes and logins while
+// skip_issuer_verification is enabled.
+const skipIssuerWarning = "skip_issuer_verification is enabled, tokens of any issuer signed with the provider keys are accepted. It should only be used with Idps returning a wrong issuer."
+
+const (
+	responseModeQuery    = "query"
+	responseModeFormPost = "form_post"
+)
+
+const (
+	// defaultStateTTL is how long a started login may take when state_ttl is
+	// not set
+	defaultStateTTL = 10 * time.Minute
+
+	// maxStateTTL caps state_ttl, the states of abandoned logins stay in
+	// storage under state/ until they expire and are tidied
+	maxStateTTL = time.Hour
+)
+
 func pathConfig(b *openIDConnectAuthBackend) *framework.Path {
 	return &framework.Path{
-		Pattern: `config`,
-		Fields: map[string]*framework.FieldSchema{
-			"client_id": {
-				Type:        framework.TypeString,
-				Description: `OpenID Connect Relaying Party Client ID.`,
-			},
-			"secret_id": {
-				Type:        framework.TypeString,
-				Description: `<Required> OpenID Connect Relaying Party Secret ID.`,
-			},
-			"oidc_discovery_url": {
-				Type:        framework.TypeString,
-				Description: `<Required> OIDC Discovery URL, without any .well-known component (base path).`,
-			},
-			"redirect_url": {
-				Type:        framework.TypeString,
-				Description: `<Required> Audience claim that is valid for login.`,
-			},
-			"scopes": {
-				Type:        framework.TypeCommaStringSlice,
-				Description: "<Optional> Provided scopes.",
-			},
-			"oidc_discovery_ca_pem": {
-				Type:        framework.TypeString,
-				Description: "<Optional> The CA certificate or chain of certificates, in PEM format, to use to validate conections to the OIDC Discovery URL. If not set, system certificates are used.",
-			},
-			"ttl": {
-				Type:        framework.TypeString,
-				Description: `<Optional> Duration after which authentication will be expired`,
-			},
-			"max_ttl": {
-				Type:        framework.TypeString,
-				Description: `<Optional> Maximum duration after which authentication will be expired`,
-			},
-		},
+		Pattern:        `config$`,
+		Fields:         configFields(),
+		ExistenceCheck: b.pathConfigExistenceCheck,
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:   b.pathConfigRead,
+			logical.CreateOperation: b.pathConfigWrite,
 			logical.UpdateOperation: b.pathConfigWrite,
+			logical.DeleteOperation: b.pathConfigDelete,
 		},
 
 		HelpSynopsis:    confHelpSyn,
@@ -65,15 +65,300 @@ func pathConfig(b *openIDConnectAuthBackend) *framework.Path {
 	}
 }
 
+// pathNamedConfig manages the configs of the named providers, roles select
+// them with their 'provider'.
+func pathNamedConfig(b *openIDConnectAuthBackend) *framework.Path {
+	fields := configFields()
+	for _, k := range mountSettingFields {
+		delete(fields, k)
+	}
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: `Name of the provider.`,
+	}
+
+	return &framework.Path{
+		Pattern:        configPrefix + framework.GenericNameRegex("name") + `$`,
+		Fields:         fields,
+		ExistenceCheck: b.pathConfigExistenceCheck,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathConfigRead,
+			logical.CreateOperation: b.pathConfigWrite,
+			logical.UpdateOperation: b.pathConfigWrite,
+			logical.DeleteOperation: b.pathConfigDelete,
+		},
+
+		HelpSynopsis:    namedConfHelpSyn,
+		HelpDescription: namedConfHelpDesc,
+	}
+}
+
+func pathConfigList(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `config/?$`,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathConfigList,
+		},
+
+		HelpSynopsis:    namedConfHelpSyn,
+		HelpDescription: namedConfHelpDesc,
+	}
+}
+
+// configFields are the fields of the default and the named configs.
+func configFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"client_id": {
+			Type:        framework.TypeString,
+			Description: `OpenID Connect Relaying Party Client ID.`,
+		},
+		"secret_id": {
+			Type:        framework.TypeString,
+			Description: `<Required> OpenID Connect Relaying Party Secret ID.`,
+		},
+		"oidc_discovery_url": {
+			Type:        framework.TypeString,
+			Description: `<Required> OIDC Discovery URL, without any .well-known component (base path).`,
+		},
+		"redirect_url": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Default redirect URI of logins which don't select one, required unless allowed_redirect_uris is set.`,
+		},
+		"scopes": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "<Optional> Scopes requested from the Idp in addition to 'openid', e.g. 'email,profile,groups'.",
+		},
+		"oidc_discovery_ca_pem": {
+			Type:        framework.TypeString,
+			Description: "<Optional> The CA certificate or chain of certificates, in PEM format, to use to validate conections to the OIDC Discovery URL and the other Idp endpoints. If not set, system certificates are used.",
+		},
+		"proxy_url": {
+			Type:        framework.TypeString,
+			Description: "<Optional> URL of the HTTP or HTTPS proxy requests to the Idp are sent through, basic auth credentials may be set in the URL.",
+		},
+		"no_proxy": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "<Optional> List of hosts and domains reached without the proxy.",
+		},
+		"ttl": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Duration after which authentication will be expired`,
+		},
+		"max_ttl": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Maximum duration after which authentication will be expired`,
+		},
+		"token_period": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Issue periodic tokens renewable for this duration without expiring, can't be set with max_ttl.`,
+		},
+		"token_type": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Type of issued tokens, 'service', 'batch' or 'default'. Batch tokens are not renewable.`,
+		},
+		"token_bound_cidrs": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> List of CIDR blocks issued tokens may be used from.`,
+		},
+		"token_num_uses": {
+			Type:        framework.TypeInt,
+			Description: `<Optional> Number of times issued tokens may be used, 0 means unlimited.`,
+		},
+		"skip_userinfo": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Never call the UserInfo endpoint, claims are read from the ID token only.`,
+		},
+		"pass_access_token": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Keep the Idp access token in the token internal data, for plugins and tooling calling Idp APIs on behalf of the user. It is never added to the metadata.`,
+		},
+		"pass_access_token_in_response": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Return the Idp access token in the login response data as well, only to the client completing the login.`,
+		},
+		"default_role": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Role used by logins which don't name one. Once roles exist, logins without a role fail unless it is set.`,
+		},
+		"skip_validation": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Don't discover the provider and fetch its keys when the config is written, for setups where the Idp is unreachable at that time. Not stored.`,
+		},
+		"validate_client_credentials": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Check the client_id and secret_id against the token endpoint when the config is written. Not stored.`,
+		},
+		"refresh_failure_denies_renewal": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Deny token renewals when the Idp session can't be refreshed with the refresh token stored at login, by default a warning is logged and the login claims are kept.`,
+		},
+		"userinfo_optional": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Complete the login with the ID token claims when the UserInfo request fails.`,
+		},
+		"supported_signing_algs": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> Signing algorithms accepted on tokens, such as 'RS256'. Defaults to the algorithms listed in the discovery document, or to all the supported ones with static keys. 'none' is never accepted.`,
+		},
+		"skip_issuer_verification": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Accept tokens whose 'iss' claim doesn't match the issuer of the provider, for Idps such as Azure AD v1 returning another issuer. Signatures and audiences are still verified.`,
+		},
+		"verbose_oidc_logging": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Log the claims received at login, to debug the claims mapping. Raw tokens are never logged, it should be disabled in production.`,
+		},
+		"allowed_redirect_uris": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> List of redirect URIs allowed to be used for logins, matched exactly. Logins select one with the auth_url redirect_uri parameter.`,
+		},
+		"allow_localhost_port_wildcard": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Let localhost entries of allowed_redirect_uris use a '*' port, e.g. 'http://localhost:*/oidc/callback', matching any port.`,
+		},
+		"oidc_response_mode": {
+			Type:        framework.TypeString,
+			Description: `<Optional> How the Idp returns the authorization response, 'query' (default) or 'form_post'.`,
+		},
+		"oidc_response_types": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> Response types requested from the Idp, 'code' (default) and/or 'id_token'. With 'id_token' only, the implicit flow returns the ID token on the redirect, which requires oidc_response_mode 'form_post'.`,
+		},
+		"max_age": {
+			Type:        framework.TypeString,
+			Description: `<Optional> How long ago the user may have authenticated at the Idp, sent as max_age and checked against the 'auth_time' claim.`,
+		},
+		"acr_values": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> Authentication context classes requested from the Idp with the acr_values parameter.`,
+		},
+		"allowed_acr_values": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> List of values the ID token 'acr' claim must match for browser and device logins, checked independently of acr_values.`,
+		},
+		"allowed_hosted_domains": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> List of Google hosted domains the ID token 'hd' claim must match. The first one is sent as the 'hd' hint on the authorization URL.`,
+		},
+		"provider_config": {
+			Type:        framework.TypeMap,
+			Description: `<Optional> Idp specific settings, selected by the 'provider' key. With 'azure' the groups of users in too many groups are fetched from Microsoft Graph, see 'graph_endpoint' and 'groups_fail_open'. With 'gsuite' the groups and custom schemas are fetched from the Google Directory API. With 'keycloak' the realm and client roles are added to the groups. With 'okta' the groups are fetched from the Okta API when the groups claim is missing or truncated.`,
+		},
+		"prompt": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Prompt parameter sent on the authorization URL, space separated 'login', 'consent' and 'select_account', or 'none'.`,
+		},
+		"extra_auth_params": {
+			Type:        framework.TypeKVPairs,
+			Description: `<Optional> Additional parameters sent on the authorization URL, e.g. 'domain_hint' or 'hd'.`,
+		},
+		"bound_audiences": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> List of audiences, at least one of them must be in the token 'aud' claim.`,
+		},
+		"bound_subject": {
+			Type:        framework.TypeString,
+			Description: `<Optional> The value the token 'sub' claim must match.`,
+		},
+		"device_authorization_endpoint": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Device authorization endpoint of the Idp, read from discovery if not set.`,
+		},
+		"allowed_client_ids": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> List of client IDs allowed to log in with the client credentials grant.`,
+		},
+		"client_credentials_renewable": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Issue renewable tokens for client credentials logins.`,
+		},
+		"require_pkce": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Fail the login when no PKCE code verifier is available for the code exchange.`,
+		},
+		"jwks_url": {
+			Type:        framework.TypeString,
+			Description: `<Optional> JWKS URL of the Idp signing keys, used with the static endpoints instead of oidc_discovery_url.`,
+		},
+		"authorization_endpoint": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Authorization endpoint of the Idp, required with jwks_url.`,
+		},
+		"token_endpoint": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Token endpoint of the Idp, required with jwks_url.`,
+		},
+		"bound_issuer": {
+			Type:        framework.TypeString,
+			Description: `<Optional> The value the token 'iss' claim must match, required with jwks_url or jwt_validation_pubkeys.`,
+		},
+		"clock_skew_leeway": {
+			Type:        framework.TypeString,
+			Description: `<Optional> Clock drift allowed when checking the token 'exp', 'iat' and 'nbf' claims. Defaults to 60s, 0 disables it.`,
+		},
+		"exchange_rate_limit": {
+			Type:        framework.TypeInt,
+			Description: `<Optional> Requests per second each client may cause to the Idp token endpoint, by the client IP address. 0, the default, disables the limit.`,
+		},
+		"exchange_rate_burst": {
+			Type:        framework.TypeInt,
+			Description: `<Optional> Requests to the token endpoint allowed at once above exchange_rate_limit. Defaults to exchange_rate_limit.`,
+		},
+		"lockout_threshold": {
+			Type:        framework.TypeInt,
+			Description: `<Optional> Consecutive failed logins of a user, or of a client IP address with lockout_by_source, after which their logins are rejected for lockout_duration. 0, the default, disables the lockout.`,
+		},
+		"lockout_by_source": {
+			Type:        framework.TypeBool,
+			Description: `<Optional> Also lock out the client IP addresses after lockout_threshold failures. Behind a proxy or a NAT the users share the address of the proxy and are locked out together, unless Vault is configured to use X-Forwarded-For. Defaults to false.`,
+		},
+		"lockout_duration": {
+			Type:        framework.TypeString,
+			Description: `<Optional> How long logins are rejected after lockout_threshold failures. Defaults to 5m.`,
+		},
+		"provider_request_timeout": {
+			Type:        framework.TypeString,
+			Description: `<Optional> How long each request to the Idp may take, for discovery, the token exchange, UserInfo and the provider_config APIs. Defaults to 10s.`,
+		},
+		"state_cache_max_entries": {
+			Type:        framework.TypeInt,
+			Description: `<Optional> Pending device logins kept in memory, the oldest are evicted above it. Defaults to 10000.`,
+		},
+		"state_ttl": {
+			Type:        framework.TypeString,
+			Description: `<Optional> How long a started login may take to complete at the Idp. Defaults to 10m, at most 1h.`,
+		},
+		"jwt_validation_pubkeys": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: `<Optional> List of RSA, ECDSA (P-256, P-384 or P-521) or Ed25519 public keys, in PEM format, to verify token signatures with instead of fetching the Idp keys.`,
+		},
+	}
+}
+
 func (b *openIDConnectAuthBackend) config(ctx context.Context, s logical.Storage) (*oidcConfig, error) {
+	return b.namedConfig(ctx, s, "")
+}
+
+// namedConfig returns the config of the named provider, the default config
+// for the empty name.
+func (b *openIDConnectAuthBackend) namedConfig(ctx context.Context, s logical.Storage, name string) (*oidcConfig, error) {
 	b.l.RLock()
-	defer b.l.RUnlock()
+	cached, ok := b.cachedConfigs[name]
+	b.l.RUnlock()
+	if ok {
+		return cached, nil
+	}
 
-	if b.cachedConfig != nil {
-		return b.cachedConfig, nil
+	// The upgrade writes the entry back, it runs under the write lock so that
+	// concurrent reads store it once
+	b.l.Lock()
+	defer b.l.Unlock()
+	if cached, ok := b.cachedConfigs[name]; ok {
+		return cached, nil
 	}
 
-	entry, err := s.Get(ctx, configPath)
+	key := configStorageKey(name)
+	entry, err := s.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -87,14 +372,37 @@ func (b *openIDConnectAuthBackend) config(ctx context.Context, s logical.Storage
 			return nil, err
 		}
 	}
+	upgraded, err := result.upgrade()
+	if err != nil {
+		return nil, err
+	}
+	if upgraded {
+		b.storeUpgraded(ctx, s, key, result)
+	}
+	result.name = name
 
-	b.cachedConfig = result
+	b.cachedConfigs[name] = result
 
 	return result, nil
 }
 
+// configName returns the provider name of a config request, empty for the
+// default config.
+func configName(d *framework.FieldData) string {
+	name, _ := d.GetOk("name")
+	nameStr, _ := name.(string)
+	return nameStr
+}
+
+func configStorageKey(name string) string {
+	if name == "" {
+		return configPath
+	}
+	return configPrefix + name
+}
+
 func (b *openIDConnectAuthBackend) pathConfigRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	config, err := b.config(ctx, req.Storage)
+	config, err := b.namedConfig(ctx, req.Storage, configName(d))
 	if err != nil {
 		return nil, err
 	}
@@ -104,76 +412,335 @@ func (b *openIDConnectAuthBackend) pathConfigRead(ctx context.Context, req *logi
 
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"client_id":             config.ClientID,
-			"secret_id":             "Use the secret ID endpoint to get the Secret ID",
-			"oidc_discovery_url":    config.OIDCProviderURL,
-			"redirect_url":          config.RedirectURL,
-			"scopes":                config.Scopes,
-			"oidc_discovery_ca_pem": config.OIDCDiscoveryCAPEM,
-			"ttl":        config.TTL,
-			"max_ttl":    config.MaxTTL,
+			"client_id":                      config.ClientID,
+			"secret_id":                      "Use the secret ID endpoint to get the Secret ID",
+			"oidc_discovery_url":             config.OIDCProviderURL,
+			"redirect_url":                   config.RedirectURL,
+			"scopes":                         config.scopes(),
+			"oidc_discovery_ca_pem":          config.OIDCDiscoveryCAPEM,
+			"proxy_url":                      redactURL(config.ProxyURL),
+			"no_proxy":                       config.NoProxy,
+			"ttl":                            config.TTL,
+			"max_ttl":                        config.MaxTTL,
+			"token_period":                   config.TokenPeriod.String(),
+			"token_type":                     config.TokenType,
+			"token_bound_cidrs":              config.TokenBoundCIDRs,
+			"token_num_uses":                 config.TokenNumUses,
+			"skip_userinfo":                  config.SkipUserInfo,
+			"userinfo_optional":              config.UserInfoOptional,
+			"refresh_failure_denies_renewal": config.RefreshFailureDeniesRenewal,
+			"pass_access_token":              config.PassAccessToken,
+			"pass_access_token_in_response":  config.PassAccessTokenInResponse,
+			"verbose_oidc_logging":           config.VerboseOIDCLogging,
+			"skip_issuer_verification":       config.SkipIssuerVerification,
+			"supported_signing_algs":         config.SupportedSigningAlgs,
+			"allowed_redirect_uris":          config.AllowedRedirectURIs,
+			"allow_localhost_port_wildcard":  config.AllowLocalhostPortWildcard,
+			"oidc_response_mode":             config.OIDCResponseMode,
+			"oidc_response_types":            config.OIDCResponseTypes,
+			"max_age":                        config.MaxAge.String(),
+			"acr_values":                     config.ACRValues,
+			"prompt":                         config.Prompt,
+			"extra_auth_params":              config.ExtraAuthParams,
+			"allowed_acr_values":             config.AllowedACRValues,
+			"allowed_hosted_domains":         config.AllowedHostedDomains,
+			"provider_config":                redactProviderConfig(config.ProviderConfig),
+			"require_pkce":                   config.RequirePKCE,
+			"bound_audiences":                config.BoundAudiences,
+			"bound_subject":                  config.BoundSubject,
+			"device_authorization_endpoint":  config.DeviceAuthorizationEndpoint,
+			"allowed_client_ids":             config.AllowedClientIDs,
+			"client_credentials_renewable":   config.ClientCredentialsRenewable,
+			"jwks_url":                       config.JWKSURL,
+			"authorization_endpoint":         config.AuthorizationEndpoint,
+			"token_endpoint":                 config.TokenEndpoint,
+			"bound_issuer":                   config.BoundIssuer,
+			"jwt_validation_pubkeys":         config.JWTValidationPubKeys,
+			"clock_skew_leeway":              config.ClockSkewLeeway.String(),
+			"state_ttl":                      config.stateTTL().String(),
+			"default_role":                   config.DefaultRole,
+			"exchange_rate_limit":            config.ExchangeRateLimit,
+			"exchange_rate_burst":            config.ExchangeRateBurst,
+			"lockout_threshold":              config.LockoutThreshold,
+			"lockout_duration":               config.lockoutDuration().String(),
+			"lockout_by_source":              config.LockoutBySource,
+			"state_cache_max_entries":        config.stateCacheMaxEntries(),
+			"provider_request_timeout":       config.providerRequestTimeout().String(),
 		},
 	}
+	if config.name != "" {
+		for _, k := range mountSettingFields {
+			delete(resp.Data, k)
+		}
+	}
 
 	return resp, nil
 }
 
+func (b *openIDConnectAuthBackend) pathConfigExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	config, err := b.namedConfig(ctx, req.Storage, configName(d))
+	if err != nil {
+		return false, err
+	}
+
+	return config != nil, nil
+}
+
 func (b *openIDConnectAuthBackend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	config := &oidcConfig{
-		ClientID:           d.Get("client_id").(string),
-		SecretID:           d.Get("secret_id").(string),
-		OIDCProviderURL:    d.Get("oidc_discovery_url").(string),
-		OIDCDiscoveryCAPEM: d.Get("oidc_discovery_ca_pem").(string),
-		Scopes:             append(d.Get("scopes").([]string), oidc.ScopeOpenID),
+	// Updates keep the stored values of the fields they don't set
+	name := configName(d)
+	if strutil.StrListContains(reservedConfigNames, name) {
+		return logical.ErrorResponse(fmt.Sprintf("%q is reserved and can't be used as a provider name", name)), nil
+	}
+	// Unknown fields are ignored by the framework, the mount wide ones would
+	// be accepted and never applied
+	if name != "" {
+		for _, k := range mountSettingFields {
+			if _, ok := req.Data[k]; ok {
+				return logical.ErrorResponse(fmt.Sprintf("%s is a mount wide setting, set it on config", k)), nil
+			}
+		}
+	}
+	config := &oidcConfig{}
+	stored, err := b.namedConfig(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		*config = *stored
+	} else {
+		config.ClockSkewLeeway = defaultClockSkewLeeway
+	}
+	config.name = name
+	updateField(d, "client_id", &config.ClientID)
+	updateField(d, "secret_id", &config.SecretID)
+	updateField(d, "oidc_discovery_url", &config.OIDCProviderURL)
+	updateField(d, "oidc_discovery_ca_pem", &config.OIDCDiscoveryCAPEM)
+	updateField(d, "proxy_url", &config.ProxyURL)
+	updateField(d, "no_proxy", &config.NoProxy)
+	if raw, ok := d.GetOk("scopes"); ok {
+		config.Scopes = cleanScopes(raw.([]string))
+	}
+	updateField(d, "require_pkce", &config.RequirePKCE)
+	updateField(d, "bound_audiences", &config.BoundAudiences)
+	updateField(d, "bound_subject", &config.BoundSubject)
+	updateField(d, "device_authorization_endpoint", &config.DeviceAuthorizationEndpoint)
+	updateField(d, "allowed_client_ids", &config.AllowedClientIDs)
+	updateField(d, "client_credentials_renewable", &config.ClientCredentialsRenewable)
+	updateField(d, "jwks_url", &config.JWKSURL)
+	updateField(d, "authorization_endpoint", &config.AuthorizationEndpoint)
+	updateField(d, "token_endpoint", &config.TokenEndpoint)
+	updateField(d, "bound_issuer", &config.BoundIssuer)
+	updateField(d, "jwt_validation_pubkeys", &config.JWTValidationPubKeys)
+	updateField(d, "skip_userinfo", &config.SkipUserInfo)
+	updateField(d, "userinfo_optional", &config.UserInfoOptional)
+	updateField(d, "refresh_failure_denies_renewal", &config.RefreshFailureDeniesRenewal)
+	updateField(d, "pass_access_token", &config.PassAccessToken)
+	updateField(d, "pass_access_token_in_response", &config.PassAccessTokenInResponse)
+	updateField(d, "verbose_oidc_logging", &config.VerboseOIDCLogging)
+	updateField(d, "skip_issuer_verification", &config.SkipIssuerVerification)
+	updateField(d, "supported_signing_algs", &config.SupportedSigningAlgs)
+	updateField(d, "allowed_redirect_uris", &config.AllowedRedirectURIs)
+	updateField(d, "allow_localhost_port_wildcard", &config.AllowLocalhostPortWildcard)
+	updateField(d, "oidc_response_mode", &config.OIDCResponseMode)
+	updateField(d, "oidc_response_types", &config.OIDCResponseTypes)
+	updateField(d, "acr_values", &config.ACRValues)
+	updateField(d, "prompt", &config.Prompt)
+	updateField(d, "extra_auth_params", &config.ExtraAuthParams)
+	updateField(d, "allowed_acr_values", &config.AllowedACRValues)
+	updateField(d, "provider_config", &config.ProviderConfig)
+
+	if raw, ok := d.GetOk("allowed_hosted_domains"); ok {
+		config.AllowedHostedDomains = nil
+		for _, domain := range raw.([]string) {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				config.AllowedHostedDomains = append(config.AllowedHostedDomains, domain)
+			}
+		}
 	}
 
 	// Run checks on values
 	switch {
 	case config.ClientID == "" || config.SecretID == "":
 		return logical.ErrorResponse("client and secret id's must be set."), nil
-	case len(config.Scopes) == 0:
-		return logical.ErrorResponse("client and secret id's must be set."), nil
+	case config.OIDCProviderURL != "" && (config.staticEndpoints() || len(config.JWTValidationPubKeys) > 0):
+		return logical.ErrorResponse("oidc_discovery_url can't be set with jwks_url, jwt_validation_pubkeys, authorization_endpoint or token_endpoint, use either discovery or static endpoints"), nil
+	case len(config.JWTValidationPubKeys) > 0:
+		if config.JWKSURL != "" {
+			return logical.ErrorResponse("jwks_url and jwt_validation_pubkeys can't both be set"), nil
+		}
+		if (config.AuthorizationEndpoint == "") != (config.TokenEndpoint == "") {
+			return logical.ErrorResponse("authorization_endpoint and token_endpoint must be set together"), nil
+		}
+		if config.BoundIssuer == "" {
+			return logical.ErrorResponse("bound_issuer must be set when not using discovery"), nil
+		}
+		if _, err := parsePublicKeys(config.JWTValidationPubKeys); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		if _, err := createHTTPClient(config); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	case config.staticEndpoints():
+		if config.JWKSURL == "" || config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" {
+			return logical.ErrorResponse("jwks_url, authorization_endpoint and token_endpoint must all be set when not using discovery"), nil
+		}
+		if config.BoundIssuer == "" {
+			return logical.ErrorResponse("bound_issuer must be set when not using discovery"), nil
+		}
+		if _, err := createHTTPClient(config); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 	case config.OIDCProviderURL != "":
-		_, err := b.createProvider(config)
-		if err != nil {
-			return logical.ErrorResponse(errwrap.Wrapf("error checking discovery URL: {{err}}", err).Error()), nil
+		if _, err := createHTTPClient(config); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
 		}
 	default:
-		return logical.ErrorResponse("unknown condition"), nil
+		return logical.ErrorResponse("either oidc_discovery_url or jwks_url must be set"), nil
+	}
+	// With several allowed redirect URIs each login selects its own, the
+	// redirect_url is then only the default
+	updateField(d, "redirect_url", &config.RedirectURL)
+	if len(config.RedirectURL) == 0 && len(config.AllowedRedirectURIs) == 0 {
+		return logical.ErrorResponse("redirect_url or allowed_redirect_uris must be set."), nil
 	}
-	config.RedirectURL = d.Get("redirect_url").(string)
-	if len(config.RedirectURL) == 0 {
-		return logical.ErrorResponse("redirect_url must be set."), nil
+	if config.RedirectURL != "" && !redirectURIAllowed(config, config.AllowedRedirectURIs, config.RedirectURL) {
+		return logical.ErrorResponse("redirect_url must be one of allowed_redirect_uris."), nil
 	}
 	//config.RedirectURL += "/v1/" + req.MountPoint + callbackPath
 
-	var ttl time.Duration
-	var err error
-	ttlRaw, ok := d.GetOk("ttl")
-	if !ok || len(ttlRaw.(string)) == 0 {
-		ttl = 0
-	} else {
-		ttl, err = time.ParseDuration(ttlRaw.(string))
-		if err != nil {
-			return logical.ErrorResponse(fmt.Sprintf("Invalid 'ttl':%s", err)), nil
+	if err := updateDuration(d, "ttl", &config.TTL); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := updateDuration(d, "max_ttl", &config.MaxTTL); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	switch config.OIDCResponseMode {
+	case "":
+		config.OIDCResponseMode = responseModeQuery
+	case responseModeQuery, responseModeFormPost:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("oidc_response_mode must be %q or %q.", responseModeQuery, responseModeFormPost)), nil
+	}
+	if err := updateDuration(d, "max_age", &config.MaxAge); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if config.MaxAge < 0 {
+		return logical.ErrorResponse("max_age can't be negative"), nil
+	}
+	if err := validatePrompt(config.Prompt); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateSigningAlgs(config.SupportedSigningAlgs); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateExtraAuthParams(config.ExtraAuthParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if _, err := newCustomProvider(config); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if len(config.OIDCResponseTypes) == 0 {
+		config.OIDCResponseTypes = []string{"code"}
+	}
+	for _, responseType := range config.OIDCResponseTypes {
+		if responseType != "code" && responseType != "id_token" {
+			return logical.ErrorResponse(fmt.Sprintf("invalid oidc_response_types entry %q, must be 'code' or 'id_token'.", responseType)), nil
 		}
 	}
+	// The ID token can't be read from the URL fragment by Vault
+	if config.implicitFlow() && config.OIDCResponseMode != responseModeFormPost {
+		return logical.ErrorResponse("the implicit flow requires oidc_response_mode 'form_post'."), nil
+	}
 
-	var maxTTL time.Duration
-	maxTTLRaw, ok := d.GetOk("max_ttl")
-	if !ok || len(maxTTLRaw.(string)) == 0 {
-		maxTTL = 0
-	} else {
-		maxTTL, err = time.ParseDuration(maxTTLRaw.(string))
+	if err := updateDuration(d, "token_period", &config.TokenPeriod); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if config.TokenPeriod > 0 && config.MaxTTL > 0 {
+		return logical.ErrorResponse("token_period and max_ttl can't both be set, periodic tokens don't expire while renewed"), nil
+	}
+	updateField(d, "token_type", &config.TokenType)
+	if err := validateTokenType(config.TokenType, config.TokenPeriod); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	updateField(d, "token_bound_cidrs", &config.TokenBoundCIDRs)
+	if _, err := parseutil.ParseAddrs(config.TokenBoundCIDRs); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid token_bound_cidrs: %s", err)), nil
+	}
+	updateField(d, "token_num_uses", &config.TokenNumUses)
+	if config.TokenNumUses < 0 {
+		return logical.ErrorResponse("token_num_uses can't be negative"), nil
+	}
+
+	if err := updateDuration(d, "clock_skew_leeway", &config.ClockSkewLeeway); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if config.ClockSkewLeeway < 0 {
+		return logical.ErrorResponse("clock_skew_leeway can't be negative"), nil
+	}
+
+	if err := updateDuration(d, "state_ttl", &config.StateTTL); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if config.StateTTL < 0 || config.StateTTL > maxStateTTL {
+		return logical.ErrorResponse(fmt.Sprintf("state_ttl must be between 0 and %s", maxStateTTL)), nil
+	}
+
+	updateField(d, "exchange_rate_limit", &config.ExchangeRateLimit)
+	updateField(d, "exchange_rate_burst", &config.ExchangeRateBurst)
+	if config.ExchangeRateLimit < 0 || config.ExchangeRateBurst < 0 {
+		return logical.ErrorResponse("exchange_rate_limit and exchange_rate_burst can't be negative"), nil
+	}
+	// Roles may be created after the config
+	var warnings []string
+	updateField(d, "default_role", &config.DefaultRole)
+	if config.DefaultRole != "" {
+		role, err := b.role(ctx, req.Storage, config.DefaultRole)
 		if err != nil {
-			return logical.ErrorResponse(fmt.Sprintf("Invalid 'max_ttl':%s", err)), nil
+			return nil, err
+		}
+		if role == nil {
+			warnings = append(warnings, fmt.Sprintf("default_role %q does not exist yet, logins without a role fail until it is created", config.DefaultRole))
 		}
 	}
 
-	config.TTL = ttl
-	config.MaxTTL = maxTTL
+	updateField(d, "lockout_threshold", &config.LockoutThreshold)
+	if config.LockoutThreshold < 0 {
+		return logical.ErrorResponse("lockout_threshold can't be negative"), nil
+	}
+	if err := updateDuration(d, "lockout_duration", &config.LockoutDuration); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if config.LockoutDuration < 0 {
+		return logical.ErrorResponse("lockout_duration can't be negative"), nil
+	}
+	updateField(d, "lockout_by_source", &config.LockoutBySource)
+
+	if err := updateDuration(d, "provider_request_timeout", &config.ProviderRequestTimeout); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if config.ProviderRequestTimeout < 0 {
+		return logical.ErrorResponse("provider_request_timeout can't be negative"), nil
+	}
+
+	updateField(d, "state_cache_max_entries", &config.StateCacheMaxEntries)
+	if config.StateCacheMaxEntries < 0 {
+		return logical.ErrorResponse("state_cache_max_entries can't be negative"), nil
+	}
 
-	entry, err := logical.StorageEntryJSON(configPath, config)
+	// Air-gapped setups skip the validation, logins then fail until the Idp
+	// is reachable
+	if !d.Get("skip_validation").(bool) {
+		validationWarnings, err := b.validateProviderConfig(ctx, config, d.Get("validate_client_credentials").(bool))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		warnings = append(warnings, validationWarnings...)
+	}
+
+	config.Version = storageVersion
+	entry, err := logical.StorageEntryJSON(configStorageKey(name), config)
 	if err != nil {
 		return nil, err
 	}
@@ -181,12 +748,238 @@ func (b *openIDConnectAuthBackend) pathConfigWrite(ctx context.Context, req *log
 		return nil, err
 	}
 
-	b.reset()
+	b.resetConfig(name)
+
+	if config.VerboseOIDCLogging {
+		warnings = append(warnings, "verbose_oidc_logging is enabled and logs user claims, it should be disabled in production.")
+	}
+	if config.SkipIssuerVerification {
+		warnings = append(warnings, skipIssuerWarning)
+	}
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
 
 	return nil, nil
 }
 
-func (b *openIDConnectAuthBackend) createProvider(config *oidcConfig) (*oidc.Provider, error) {
+// validateProviderConfig discovers the provider and fetches its signing keys,
+// and optionally checks the client credentials against the token endpoint.
+// Problems preventing logins are returned as errors, the others as warnings.
+func (b *openIDConnectAuthBackend) validateProviderConfig(ctx context.Context, config *oidcConfig, validateCredentials bool) ([]string, error) {
+	client, err := createHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := b.createProvider(config, client)
+	if err != nil {
+		return nil, errwrap.Wrapf("error checking discovery URL: {{err}}", err)
+	}
+
+	var warnings []string
+	jwksURL := config.JWKSURL
+	if provider.discovered != nil {
+		var discovered struct {
+			JWKSURL string `json:"jwks_uri"`
+		}
+		if err := provider.Claims(&discovered); err != nil {
+			return nil, err
+		}
+		if discovered.JWKSURL == "" {
+			return nil, errors.New("the discovery document has no jwks_uri")
+		}
+		jwksURL = discovered.JWKSURL
+	}
+	if jwksURL != "" {
+		keyIDs, err := fetchKeyIDs(ctx, client, jwksURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch the provider keys: %s", err)
+		}
+		if len(keyIDs) == 0 {
+			warnings = append(warnings, fmt.Sprintf("the key set at %s has no keys, tokens can't be verified", jwksURL))
+		}
+	}
+	if provider.Endpoint().AuthURL == "" {
+		warnings = append(warnings, "the provider has no authorization endpoint, only JWT and client credentials logins are possible")
+	}
+
+	if validateCredentials {
+		warning, err := validateClientCredentials(ctx, client, config, provider.Endpoint().TokenURL)
+		if err != nil {
+			return nil, err
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	return warnings, nil
+}
+
+// validateClientCredentials authenticates a client credentials grant at the
+// token endpoint. Idps refuse the grant for most clients, only an
+// invalid_client error means the credentials are wrong.
+func validateClientCredentials(ctx context.Context, client *http.Client, config *oidcConfig, tokenURL string) (string, error) {
+	if tokenURL == "" {
+		return "the provider has no token endpoint, the client credentials were not checked", nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {config.ClientID},
+		"client_secret": {config.SecretID},
+	}
+	var tokenResp struct {
+		Error string `json:"error"`
+	}
+	status, err := postForm(ctx, client, tokenURL, form, &tokenResp)
+	switch {
+	case tokenResp.Error == "invalid_client":
+		return "", errors.New("the token endpoint rejected the client_id and secret_id")
+	case status == 0:
+		return "", fmt.Errorf("could not reach the token endpoint: %s", sanitizeError(err))
+	case err != nil && tokenResp.Error == "":
+		return fmt.Sprintf("could not check the client credentials, the token endpoint returned status %d", status), nil
+	}
+
+	return "", nil
+}
+
+// validatePrompt checks the prompt values defined by OpenID Connect Core 1.0,
+// 'none' can't be combined with other values.
+func validatePrompt(prompt string) error {
+	values := strings.Fields(prompt)
+	for _, value := range values {
+		switch value {
+		case "none":
+			if len(values) > 1 {
+				return errors.New("prompt 'none' can't be combined with other values")
+			}
+		case "login", "consent", "select_account":
+		default:
+			return fmt.Errorf("invalid prompt value %q, must be 'none', 'login', 'consent' or 'select_account'", value)
+		}
+	}
+
+	return nil
+}
+
+// validateSigningAlgs checks that supported_signing_algs only lists algorithms
+// the verifier supports. Unsigned tokens, 'none', are rejected explicitly so
+// that the error doesn't suggest they could be supported.
+func validateSigningAlgs(algs []string) error {
+	for _, alg := range algs {
+		switch {
+		case strings.EqualFold(alg, "none"):
+			return errors.New("unsigned tokens can't be accepted, 'none' is not allowed in supported_signing_algs")
+		case !strutil.StrListContains(staticSigningAlgs, alg):
+			return fmt.Errorf("invalid signing algorithm %q in supported_signing_algs, must be one of %s", alg, strings.Join(staticSigningAlgs, ", "))
+		}
+	}
+
+	return nil
+}
+
+// reservedAuthParams are set by the backend on the authorization URL and can't
+// be overridden with extra_auth_params.
+var reservedAuthParams = []string{
+	"state", "nonce", "client_id", "redirect_uri", "response_type", "scope",
+	"code_challenge", "code_challenge_method",
+}
+
+func validateExtraAuthParams(params map[string]string) error {
+	for k := range params {
+		if strutil.StrListContains(reservedAuthParams, strings.ToLower(k)) {
+			return fmt.Errorf("extra_auth_params can't set the reserved parameter %q", k)
+		}
+	}
+
+	return nil
+}
+
+// pathConfigDelete removes the config, logins fail until the backend is
+// configured again.
+func (b *openIDConnectAuthBackend) pathConfigDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := configName(d)
+	if err := req.Storage.Delete(ctx, configStorageKey(name)); err != nil {
+		return nil, err
+	}
+
+	b.resetConfig(name)
+
+	return nil, nil
+}
+
+// pathConfigList lists the names of the providers configured besides the
+// default config.
+func (b *openIDConnectAuthBackend) pathConfigList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, configPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedListResponse(names), nil
+}
+
+// updateField sets the config field from the request when the request sets
+// it, the field keeps its stored value otherwise.
+func updateField(d *framework.FieldData, key string, field interface{}) {
+	raw, ok := d.GetOk(key)
+	if !ok {
+		return
+	}
+
+	switch f := field.(type) {
+	case *string:
+		*f = raw.(string)
+	case *bool:
+		*f = raw.(bool)
+	case *int:
+		*f = raw.(int)
+	case *[]string:
+		*f = raw.([]string)
+	case *map[string]string:
+		*f = raw.(map[string]string)
+	case *map[string]interface{}:
+		*f = raw.(map[string]interface{})
+	default:
+		panic(fmt.Sprintf("unsupported type %T of field %q", field, key))
+	}
+}
+
+// updateDuration is updateField for the duration fields, given as strings.
+func updateDuration(d *framework.FieldData, key string, field *time.Duration) error {
+	if _, ok := d.GetOk(key); !ok {
+		return nil
+	}
+
+	dur, err := parseDuration(d, key)
+	if err != nil {
+		return err
+	}
+	*field = dur
+	return nil
+}
+
+// parseDuration reads an optional duration string field, an unset or empty
+// value is returned as a zero duration.
+func parseDuration(d *framework.FieldData, key string) (time.Duration, error) {
+	raw, ok := d.GetOk(key)
+	if !ok || len(raw.(string)) == 0 {
+		return 0, nil
+	}
+
+	dur, err := time.ParseDuration(raw.(string))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid '%s':%s", key, err)
+	}
+
+	return dur, nil
+}
+
+// createHTTPClient returns the client used for all requests to the Idp, it
+// trusts the configured CA certificates instead of the system ones when set.
+func createHTTPClient(config *oidcConfig) (*http.Client, error) {
 	var certPool *x509.CertPool
 	if config.OIDCDiscoveryCAPEM != "" {
 		certPool = x509.NewCertPool()
@@ -195,43 +988,304 @@ func (b *openIDConnectAuthBackend) createProvider(config *oidcConfig) (*oidc.Pro
 		}
 	}
 
+	// Logins mostly reach the same few Idp hosts, keep enough idle
+	// connections and TLS sessions to them to skip the handshakes
 	tr := cleanhttp.DefaultPooledTransport()
-	if certPool != nil {
-		tr.TLSClientConfig = &tls.Config{
-			RootCAs: certPool,
+	tr.MaxIdleConnsPerHost = idpMaxIdleConnsPerHost
+	tr.TLSClientConfig = &tls.Config{
+		RootCAs:            certPool,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if config.ProxyURL != "" {
+		proxyURL, err := parseProxyURL(config.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		noProxy := config.NoProxy
+		tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			if bypassProxy(req.URL.Hostname(), noProxy) {
+				return nil, nil
+			}
+			return proxyURL, nil
 		}
 	}
+
+	// The timeout also bounds the discovery and key set requests, which are
+	// made with the long-lived provider context
 	tc := &http.Client{
 		Transport: tr,
+		Timeout:   config.providerRequestTimeout(),
 	}
-	oidcCtx := context.WithValue(b.providerCtx, oauth2.HTTPClient, tc)
 
-	provider, err := oidc.NewProvider(oidcCtx, config.OIDCProviderURL)
+	return tc, nil
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("could not parse 'proxy_url' value successfully")
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, errors.New("'proxy_url' scheme must be http or https")
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.New("'proxy_url' must have a host")
+	}
+
+	return proxyURL, nil
+}
+
+// bypassProxy checks the host against the no_proxy entries, an entry matches
+// the host itself and its subdomains, and '*' matches every host.
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(entry), "."))
+		switch {
+		case entry == "":
+		case entry == "*", host == entry, strings.HasSuffix(host, "."+entry):
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactURL hides the password of the credentials embedded in a URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+
+	return u.String()
+}
+
+// createProvider discovers the Idp endpoints, or builds them from the static
+// endpoints when no discovery URL is configured.
+func (b *openIDConnectAuthBackend) createProvider(config *oidcConfig, client *http.Client) (*oidcProvider, error) {
+	oidcCtx := oidc.ClientContext(b.providerCtx, client)
+
+	if config.OIDCProviderURL == "" {
+		provider := &oidcProvider{
+			issuer: config.BoundIssuer,
+			endpoint: oauth2.Endpoint{
+				AuthURL:  config.AuthorizationEndpoint,
+				TokenURL: config.TokenEndpoint,
+			},
+		}
+		if len(config.JWTValidationPubKeys) > 0 {
+			keySet, err := newStaticKeySet(config.JWTValidationPubKeys)
+			if err != nil {
+				return nil, err
+			}
+			provider.keySet = keySet
+		} else {
+			provider.keySet = oidc.NewRemoteKeySet(oidcCtx, config.JWKSURL)
+		}
+		provider.client = client
+		return provider, nil
+	}
+
+	discovered, err := oidc.NewProvider(oidcCtx, config.OIDCProviderURL)
 	if err != nil {
 		return nil, errwrap.Wrapf("error creating provider with given values: {{err}}", err)
 	}
 
+	provider := newDiscoveredProvider(discovered)
+	provider.client = client
 	return provider, nil
 }
 
 type oidcConfig struct {
-	ClientID    string `json:"client_id"`
-	SecretID    string `json:"secret_id"`
-	RedirectURL string `json:"redirect_url"`
-	OIDCProviderURL string `json:"oidc_discovery_url"`
-	OIDCDiscoveryCAPEM   string   `json:"oidc_discovery_ca_pem"`
-	Scopes      []string `json:"scopes"`
-	TTL          time.Duration `json:"ttl" structs:"ttl" mapstructure:"ttl"`
-	MaxTTL       time.Duration `json:"max_ttl" structs:"max_ttl" mapstructure:"max_ttl"`
+	ClientID                    string                 `json:"client_id"`
+	SecretID                    string                 `json:"secret_id"`
+	RedirectURL                 string                 `json:"redirect_url"`
+	OIDCProviderURL             string                 `json:"oidc_discovery_url"`
+	OIDCDiscoveryCAPEM          string                 `json:"oidc_discovery_ca_pem"`
+	Scopes                      []string               `json:"scopes"`
+	ProxyURL                    string                 `json:"proxy_url"`
+	NoProxy                     []string               `json:"no_proxy"`
+	TTL                         time.Duration          `json:"ttl" structs:"ttl" mapstructure:"ttl"`
+	MaxTTL                      time.Duration          `json:"max_ttl" structs:"max_ttl" mapstructure:"max_ttl"`
+	RequirePKCE                 bool                   `json:"require_pkce"`
+	BoundAudiences              []string               `json:"bound_audiences"`
+	BoundSubject                string                 `json:"bound_subject"`
+	DeviceAuthorizationEndpoint string                 `json:"device_authorization_endpoint"`
+	AllowedClientIDs            []string               `json:"allowed_client_ids"`
+	ClientCredentialsRenewable  bool                   `json:"client_credentials_renewable"`
+	JWKSURL                     string                 `json:"jwks_url"`
+	AuthorizationEndpoint       string                 `json:"authorization_endpoint"`
+	TokenEndpoint               string                 `json:"token_endpoint"`
+	BoundIssuer                 string                 `json:"bound_issuer"`
+	JWTValidationPubKeys        []string               `json:"jwt_validation_pubkeys"`
+	ClockSkewLeeway             time.Duration          `json:"clock_skew_leeway"`
+	StateTTL                    time.Duration          `json:"state_ttl"`
+	DefaultRole                 string                 `json:"default_role"`
+	ExchangeRateLimit           int                    `json:"exchange_rate_limit"`
+	ExchangeRateBurst           int                    `json:"exchange_rate_burst"`
+	LockoutThreshold            int                    `json:"lockout_threshold"`
+	LockoutDuration             time.Duration          `json:"lockout_duration"`
+	LockoutBySource             bool                   `json:"lockout_by_source"`
+	StateCacheMaxEntries        int                    `json:"state_cache_max_entries"`
+	ProviderRequestTimeout      time.Duration          `json:"provider_request_timeout"`
+	TokenPeriod                 time.Duration          `json:"token_period"`
+	TokenType                   string                 `json:"token_type"`
+	TokenBoundCIDRs             []string               `json:"token_bound_cidrs"`
+	TokenNumUses                int                    `json:"token_num_uses"`
+	SkipUserInfo                bool                   `json:"skip_userinfo"`
+	UserInfoOptional            bool                   `json:"userinfo_optional"`
+	RefreshFailureDeniesRenewal bool                   `json:"refresh_failure_denies_renewal"`
+	PassAccessToken             bool                   `json:"pass_access_token"`
+	PassAccessTokenInResponse   bool                   `json:"pass_access_token_in_response"`
+	VerboseOIDCLogging          bool                   `json:"verbose_oidc_logging"`
+	SkipIssuerVerification      bool                   `json:"skip_issuer_verification"`
+	SupportedSigningAlgs        []string               `json:"supported_signing_algs"`
+	AllowedRedirectURIs         []string               `json:"allowed_redirect_uris"`
+	AllowLocalhostPortWildcard  bool                   `json:"allow_localhost_port_wildcard"`
+	OIDCResponseMode            string                 `json:"oidc_response_mode"`
+	OIDCResponseTypes           []string               `json:"oidc_response_types"`
+	MaxAge                      time.Duration          `json:"max_age"`
+	ACRValues                   []string               `json:"acr_values"`
+	Prompt                      string                 `json:"prompt"`
+	ExtraAuthParams             map[string]string      `json:"extra_auth_params"`
+	AllowedACRValues            []string               `json:"allowed_acr_values"`
+	AllowedHostedDomains        []string               `json:"allowed_hosted_domains"`
+	ProviderConfig              map[string]interface{} `json:"provider_config"`
+
+	Version int `json:"version"`
+
+	// name is the provider name of configs read from config/<name>
+	name string
+}
+
+// implicitFlow reports whether the Idp returns the ID token on the redirect
+// instead of an authorization code.
+func (c *oidcConfig) implicitFlow() bool {
+	return strutil.StrListContains(c.OIDCResponseTypes, "id_token") && !strutil.StrListContains(c.OIDCResponseTypes, "code")
+}
+
+// scopes returns the requested scopes, the openid scope is always included.
+func (c *oidcConfig) scopes() []string {
+	return cleanScopes(append([]string{oidc.ScopeOpenID}, c.Scopes...))
+}
+
+// cleanScopes drops the empty and duplicate scopes.
+func cleanScopes(scopes []string) []string {
+	cleaned := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope != "" && !strutil.StrListContains(cleaned, scope) {
+			cleaned = append(cleaned, scope)
+		}
+	}
+
+	return cleaned
+}
+
+// hash identifies the config the provider is created from.
+func (c *oidcConfig) hash() (string, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// mountSettingFields are the fields of the default config that apply to the
+// whole mount, the named configs don't take them.
+var mountSettingFields = []string{
+	"default_role",
+	"exchange_rate_limit",
+	"exchange_rate_burst",
+	"lockout_threshold",
+	"lockout_duration",
+	"lockout_by_source",
+	"state_cache_max_entries",
+}
+
+// reservedConfigNames are the config/ paths of other endpoints.
+var reservedConfigNames = []string{"rotate"}
+
+// withMountSettings returns a copy of a named provider config with the mount
+// wide settings, such as the rate limits and lockouts, of the default config.
+func (c *oidcConfig) withMountSettings(mount *oidcConfig) *oidcConfig {
+	merged := *c
+	merged.DefaultRole = mount.DefaultRole
+	merged.ExchangeRateLimit = mount.ExchangeRateLimit
+	merged.ExchangeRateBurst = mount.ExchangeRateBurst
+	merged.LockoutThreshold = mount.LockoutThreshold
+	merged.LockoutDuration = mount.LockoutDuration
+	merged.LockoutBySource = mount.LockoutBySource
+	merged.StateCacheMaxEntries = mount.StateCacheMaxEntries
+	return &merged
+}
+
+// transportHash hashes the fields the HTTP client is created from, the
+// shared client is rebuilt when it changes.
+func (c *oidcConfig) transportHash() (string, error) {
+	raw, err := json.Marshal([]interface{}{c.OIDCDiscoveryCAPEM, c.ProxyURL, c.NoProxy, c.providerRequestTimeout()})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
 }
 
-func (c *oidcConfig) config2OauthConfig(provider *oidc.Provider) oauth2.Config {
+// lockoutDuration returns how long logins are rejected once locked out.
+func (c *oidcConfig) lockoutDuration() time.Duration {
+	if c.LockoutDuration <= 0 {
+		return defaultLockoutDuration
+	}
+	return c.LockoutDuration
+}
+
+// providerRequestTimeout returns how long a request to the Idp may take, the
+// default applies to configs written without provider_request_timeout.
+func (c *oidcConfig) providerRequestTimeout() time.Duration {
+	if c.ProviderRequestTimeout <= 0 {
+		return defaultProviderRequestTimeout
+	}
+	return c.ProviderRequestTimeout
+}
+
+// stateCacheMaxEntries returns the bound of the pending device logins, the
+// default applies to configs written without state_cache_max_entries.
+func (c *oidcConfig) stateCacheMaxEntries() int {
+	if c.StateCacheMaxEntries <= 0 {
+		return defaultStateCacheMaxEntries
+	}
+	return c.StateCacheMaxEntries
+}
+
+// stateTTL returns how long a started login is kept, the default applies to
+// configs written without state_ttl.
+func (c *oidcConfig) stateTTL() time.Duration {
+	if c.StateTTL <= 0 {
+		return defaultStateTTL
+	}
+	return c.StateTTL
+}
+
+// staticEndpoints reports whether any endpoint is configured manually rather
+// than read from the discovery document.
+func (c *oidcConfig) staticEndpoints() bool {
+	return c.JWKSURL != "" || c.AuthorizationEndpoint != "" || c.TokenEndpoint != ""
+}
+
+func (c *oidcConfig) config2OauthConfig(provider *oidcProvider) oauth2.Config {
 	conf := oauth2.Config{
 		ClientID:     c.ClientID,
 		ClientSecret: c.SecretID,
 		Endpoint:     provider.Endpoint(),
 		RedirectURL:  c.RedirectURL,
-		Scopes:       c.Scopes,
+		Scopes:       c.scopes(),
 	}
 	return conf
 }
@@ -243,7 +1297,24 @@ Configures the OpenID Connect authentication backend.
 	confHelpDesc = `
 The JWT authentication backend validates JWTs (or OIDC) using the configured
 credentials. If using OIDC Discovery, the URL must be provided, along
-with (optionally) the CA cert to use for the connection. If performing JWT
-validation locally, a set of public keys must be provided.
+with (optionally) the CA cert to use for the connection. Idps without a
+discovery document are configured with 'jwks_url', 'authorization_endpoint',
+'token_endpoint' and 'bound_issuer' instead. If performing JWT validation
+locally, a set of public keys must be provided in 'jwt_validation_pubkeys',
+browser logins then also need 'authorization_endpoint' and 'token_endpoint'.
+
+Reading the config never returns the secret ID, use the 'secret-id' endpoint
+instead. Deleting the config unconfigures the backend without unmounting it.
+`
+	namedConfHelpSyn = `
+Configures additional OpenID Connect providers of the backend.
+`
+	namedConfHelpDesc = `
+Each 'config/<name>' takes the fields of 'config' and configures another Idp,
+with its own issuer and client credentials. Roles log in with it when their
+'provider' is set to the name, other logins use 'config'. The mount wide
+settings, 'default_role', the exchange rate limits, the lockouts and
+'state_cache_max_entries', are only set on 'config', which must be written for
+logins to work. 'rotate' can't be used as a name.
 `
 )
@@ -0,0 +1,134 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathConfigRotate(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `config/rotate$`,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathConfigRotate,
+		},
+
+		HelpSynopsis:    confRotateHelpSyn,
+		HelpDescription: confRotateHelpDesc,
+	}
+}
+
+// pathConfigRotate discovers the provider again and replaces the cached one,
+// logins in flight keep the provider they started with.
+func (b *openIDConnectAuthBackend) pathConfigRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("could not load OIDC configuration"), nil
+	}
+
+	hash, err := config.hash()
+	if err != nil {
+		return nil, err
+	}
+	b.l.Lock()
+	client, err := b.sharedHTTPClient(config)
+	b.l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	provider, err := b.createProvider(config, client)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	jwksURL := config.JWKSURL
+	if provider.discovered != nil {
+		var discovered struct {
+			JWKSURL string `json:"jwks_uri"`
+		}
+		if err := provider.Claims(&discovered); err != nil {
+			return nil, err
+		}
+		jwksURL = discovered.JWKSURL
+	}
+	keyIDs := []string{}
+	if jwksURL != "" {
+		if keyIDs, err = fetchKeyIDs(ctx, client, jwksURL); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("could not fetch the provider keys: %s", err)), nil
+		}
+	}
+
+	b.l.Lock()
+	entry := b.idpEntry(config.name)
+	entry.provider = provider
+	entry.providerHash = hash
+	b.l.Unlock()
+
+	endpoint := provider.Endpoint()
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"authorization_endpoint": endpoint.AuthURL,
+			"token_endpoint":         endpoint.TokenURL,
+			"jwks_url":               jwksURL,
+			"key_ids":                keyIDs,
+		},
+	}, nil
+}
+
+// fetchKeyIDs returns the key IDs of the JSON Web Key Set.
+func fetchKeyIDs(ctx context.Context, client *http.Client, jwksURL string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", jwksURL, resp.StatusCode)
+	}
+
+	var keySet struct {
+		Keys []struct {
+			KeyID string `json:"kid"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, errwrap.Wrapf("could not decode the key set: {{err}}", err)
+	}
+
+	keyIDs := make([]string, 0, len(keySet.Keys))
+	for _, key := range keySet.Keys {
+		keyIDs = append(keyIDs, key.KeyID)
+	}
+
+	return keyIDs, nil
+}
+
+const (
+	confRotateHelpSyn = `
+Discovers the OpenID Connect provider again.
+`
+	confRotateHelpDesc = `
+Drops the cached provider and its signing keys and runs the discovery again,
+for when the Idp rotated its signing keys or changed its endpoints. The
+discovered endpoints and the IDs of the signing keys are returned.
+`
+)
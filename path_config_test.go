@@ -0,0 +1,249 @@
+package oidc
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func existenceCheck(t *testing.T, b *openIDConnectAuthBackend, s logical.Storage, path string) bool {
+	t.Helper()
+
+	checkFound, exists, err := b.HandleExistenceCheck(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      path,
+		Storage:   s,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkFound {
+		t.Fatalf("%s has no existence check", path)
+	}
+
+	return exists
+}
+
+func TestConfig_UpdateKeepsFields(t *testing.T) {
+	b, storage := getBackend(t)
+	if existenceCheck(t, b, storage, "config") {
+		t.Fatal("config exists before it is written")
+	}
+
+	writeOK(t, b, storage, "config", map[string]interface{}{
+		"oidc_discovery_url": "https://idp.example.com",
+		"client_id":          testClientID,
+		"secret_id":          "test-secret",
+		"redirect_url":       testRedirectURL,
+		"scopes":             "profile,email",
+		"bound_audiences":    "vault,cli",
+		"ttl":                "30m",
+		"max_ttl":            "2h",
+		"pass_access_token":  true,
+		"extra_auth_params":  map[string]interface{}{"audience": "api"},
+		"skip_validation":    true,
+	})
+	if !existenceCheck(t, b, storage, "config") {
+		t.Fatal("config doesn't exist after it is written")
+	}
+
+	// Only the ttl is set, a create would require the client credentials
+	writeOK(t, b, storage, "config", map[string]interface{}{
+		"ttl":             "1h",
+		"skip_validation": true,
+	})
+
+	config, err := b.config(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TTL != time.Hour {
+		t.Fatalf("ttl was not updated: %s", config.TTL)
+	}
+	if config.SecretID != "test-secret" || config.ClientID != testClientID {
+		t.Fatalf("client credentials were not kept: %q %q", config.ClientID, config.SecretID)
+	}
+	if config.MaxTTL != 2*time.Hour || !config.PassAccessToken || config.RedirectURL != testRedirectURL {
+		t.Fatalf("fields were not kept: %#v", config)
+	}
+	if !reflect.DeepEqual(config.BoundAudiences, []string{"vault", "cli"}) {
+		t.Fatalf("bound_audiences were not kept: %#v", config.BoundAudiences)
+	}
+	if !reflect.DeepEqual(config.ExtraAuthParams, map[string]string{"audience": "api"}) {
+		t.Fatalf("extra_auth_params were not kept: %#v", config.ExtraAuthParams)
+	}
+
+	resp := readOK(t, b, storage, "config")
+	if resp.Data["oidc_discovery_url"] != "https://idp.example.com" {
+		t.Fatalf("unexpected config: %#v", resp.Data)
+	}
+}
+
+func TestConfig_UpdateValidatesMergedConfig(t *testing.T) {
+	b, storage := getBackend(t)
+	writeOK(t, b, storage, "config", map[string]interface{}{
+		"oidc_discovery_url": "https://idp.example.com",
+		"client_id":          testClientID,
+		"secret_id":          "test-secret",
+		"redirect_url":       testRedirectURL,
+		"max_ttl":            "1h",
+		"skip_validation":    true,
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"token_period":    "24h",
+			"skip_validation": true,
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected the stored max_ttl to conflict with token_period: err: %v resp: %#v", err, resp)
+	}
+}
+
+// TestNamedConfig_RejectsMountSettings checks the named configs reject the
+// settings only read from config, and roles the reserved provider names.
+func TestNamedConfig_RejectsMountSettings(t *testing.T) {
+	b, storage := getBackend(t)
+	named := map[string]interface{}{
+		"oidc_discovery_url": "https://idp.example.com",
+		"client_id":          testClientID,
+		"secret_id":          "test-secret",
+		"redirect_url":       testRedirectURL,
+		"skip_validation":    true,
+	}
+	writeOK(t, b, storage, "config/customers", named)
+	if resp := readOK(t, b, storage, "config/customers"); resp.Data["lockout_threshold"] != nil {
+		t.Fatalf("the named config returned a mount wide setting: %#v", resp.Data)
+	}
+
+	for _, k := range mountSettingFields {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config/customers",
+			Storage:   storage,
+			Data:      map[string]interface{}{k: "1", "skip_validation": true},
+		})
+		if err != nil || resp == nil || !resp.IsError() {
+			t.Fatalf("expected %s to be rejected on a named config: err: %v resp: %#v", k, err, resp)
+		}
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "role/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"allowed_redirect_uris": testRedirectURL,
+			"provider":              "rotate",
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "reserved") {
+		t.Fatalf("expected the rotate provider to be rejected: err: %v resp: %#v", err, resp)
+	}
+}
+
+func TestClaimsConfig_UpdateKeepsFields(t *testing.T) {
+	b, storage := getBackend(t)
+	if existenceCheck(t, b, storage, "claims") {
+		t.Fatal("claims exist before they are written")
+	}
+
+	writeOK(t, b, storage, "claims", map[string]interface{}{
+		"user_claim":      "email",
+		"groups_claim":    "/realm_access/roles",
+		"policies_claim":  "policies",
+		"metadata_claims": "name,locale",
+		"claim_mappings":  map[string]interface{}{"/address/country": "country"},
+	})
+	if !existenceCheck(t, b, storage, "claims") {
+		t.Fatal("claims don't exist after they are written")
+	}
+
+	writeOK(t, b, storage, "claims", map[string]interface{}{
+		"username_lowercase": true,
+	})
+
+	resp := readOK(t, b, storage, "claims")
+	want := map[string]interface{}{
+		"user_claim":         "email",
+		"display_name_claim": "email",
+		"groups_claim":       "/realm_access/roles",
+		"policies_claim":     "policies",
+		"metadata_claims":    []string{"name", "locale"},
+		"claim_mappings":     map[string]string{"/address/country": "country"},
+		"username_lowercase": true,
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(resp.Data[k], v) {
+			t.Fatalf("expected %s %#v, got %#v", k, v, resp.Data[k])
+		}
+	}
+
+	// The display name follows the user claim unless it was set
+	writeOK(t, b, storage, "claims", map[string]interface{}{
+		"user_claim": "preferred_username",
+	})
+	resp = readOK(t, b, storage, "claims")
+	if resp.Data["display_name_claim"] != "preferred_username" {
+		t.Fatalf("display_name_claim didn't follow user_claim: %#v", resp.Data["display_name_claim"])
+	}
+}
+
+func TestRole_UpdateKeepsFields(t *testing.T) {
+	b, storage := getBackend(t)
+	if existenceCheck(t, b, storage, "role/admin") {
+		t.Fatal("role exists before it is written")
+	}
+
+	writeOK(t, b, storage, "role/admin", map[string]interface{}{
+		"policies":              "admin,audit",
+		"ttl":                   "15m",
+		"max_ttl":               "1h",
+		"bound_claims":          map[string]interface{}{"department": "platform"},
+		"bound_audiences":       "vault",
+		"allowed_redirect_uris": testRedirectURL,
+	})
+	if !existenceCheck(t, b, storage, "role/admin") {
+		t.Fatal("role doesn't exist after it is written")
+	}
+
+	writeOK(t, b, storage, "role/admin", map[string]interface{}{
+		"ttl": "30m",
+	})
+
+	role, err := b.role(context.Background(), storage, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role.TTL != 30*time.Minute || role.MaxTTL != time.Hour {
+		t.Fatalf("unexpected ttls: %s %s", role.TTL, role.MaxTTL)
+	}
+	if !reflect.DeepEqual(role.Policies, []string{"admin", "audit"}) {
+		t.Fatalf("policies were not kept: %#v", role.Policies)
+	}
+	if !reflect.DeepEqual(role.BoundClaims, map[string]interface{}{"department": "platform"}) {
+		t.Fatalf("bound_claims were not kept: %#v", role.BoundClaims)
+	}
+	if !reflect.DeepEqual(role.BoundAudiences, []string{"vault"}) || !reflect.DeepEqual(role.AllowedRedirectURIs, []string{testRedirectURL}) {
+		t.Fatalf("fields were not kept: %#v", role)
+	}
+
+	// The merged role is validated, the stored max_ttl is below the new ttl
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "role/admin",
+		Storage:   storage,
+		Data:      map[string]interface{}{"ttl": "2h"},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error response: err: %v resp: %#v", err, resp)
+	}
+}
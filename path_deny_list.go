@@ -0,0 +1,144 @@
+package oidc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const denyListPath string = "deny_list"
+
+func pathDenyList(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: denyListPath + `$`,
+		Fields: map[string]*framework.FieldSchema{
+			"denied_subjects": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `List of subjects, the 'sub' claim, which may not log in. Values may begin or end with '*' to match a prefix or a suffix.`,
+			},
+			"denied_users": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `List of usernames, as mapped from the user_claim, which may not log in. Values may begin or end with '*' to match a prefix or a suffix.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathDenyListRead,
+			logical.UpdateOperation: b.pathDenyListWrite,
+			logical.DeleteOperation: b.pathDenyListDelete,
+		},
+
+		HelpSynopsis:    denyListHelpSyn,
+		HelpDescription: denyListHelpDesc,
+	}
+}
+
+type denyList struct {
+	DeniedSubjects []string `json:"denied_subjects"`
+	DeniedUsers    []string `json:"denied_users"`
+}
+
+// denied reports whether the subject or the username is denied.
+func (l *denyList) denied(subject, username string) bool {
+	if l == nil {
+		return false
+	}
+	return (subject != "" && strutil.StrListContainsGlob(l.DeniedSubjects, subject)) ||
+		(username != "" && strutil.StrListContainsGlob(l.DeniedUsers, username))
+}
+
+// denyList is read from storage on every login, so that an update applies to
+// the next login on every node.
+func (b *openIDConnectAuthBackend) denyList(ctx context.Context, s logical.Storage) (*denyList, error) {
+	entry, err := s.Get(ctx, denyListPath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	result := &denyList{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (b *openIDConnectAuthBackend) pathDenyListRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	list, err := b.denyList(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"denied_subjects": list.DeniedSubjects,
+			"denied_users":    list.DeniedUsers,
+		},
+	}, nil
+}
+
+func (b *openIDConnectAuthBackend) pathDenyListWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	list, err := b.denyList(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = &denyList{}
+	}
+
+	if raw, ok := d.GetOk("denied_subjects"); ok {
+		list.DeniedSubjects = cleanDenyList(raw.([]string))
+	}
+	if raw, ok := d.GetOk("denied_users"); ok {
+		list.DeniedUsers = cleanDenyList(raw.([]string))
+	}
+
+	entry, err := logical.StorageEntryJSON(denyListPath, list)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *openIDConnectAuthBackend) pathDenyListDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, denyListPath); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func cleanDenyList(values []string) []string {
+	cleaned := make([]string, 0, len(values))
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			cleaned = append(cleaned, value)
+		}
+	}
+
+	return strutil.RemoveDuplicates(cleaned, false)
+}
+
+const (
+	denyListHelpSyn = `
+Denies the login of given users.
+`
+	denyListHelpDesc = `
+Logins of the subjects and usernames of the deny list fail with a permission
+denied error once the token of the Idp is verified, before any policy is
+attached. Tokens of denied users can't be renewed. The list takes effect
+immediately, for users who were off-boarded but are still active at the Idp.
+`
+)
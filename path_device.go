@@ -0,0 +1,397 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/oauth2"
+)
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// defaultStateCacheMaxEntries bounds the pending device logins when
+	// state_cache_max_entries is not set
+	defaultStateCacheMaxEntries = 10000
+)
+
+func pathDeviceAuth(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `device/auth$`,
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: `<Optional> The role to log in against.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathDeviceAuth,
+		},
+
+		HelpSynopsis:    deviceAuthHelpSyn,
+		HelpDescription: deviceAuthHelpDesc,
+	}
+}
+
+func pathDevicePoll(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `device/poll$`,
+		Fields: map[string]*framework.FieldSchema{
+			"request_id": {
+				Type:        framework.TypeString,
+				Description: `The request ID returned by the device/auth endpoint.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.instrumentLogin("device", b.pathDevicePoll),
+		},
+
+		HelpSynopsis:    devicePollHelpSyn,
+		HelpDescription: devicePollHelpDesc,
+	}
+}
+
+func (b *openIDConnectAuthBackend) pathDeviceAuth(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("could not load OIDC configuration"), nil
+	}
+
+	roleName, resp, err := b.loginRoleName(ctx, req.Storage, config, d.Get("role").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	if roleName != "" {
+		role, err := b.role(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q could not be found", roleName)), nil
+		}
+	}
+	config, resp, err = b.roleConfig(ctx, req.Storage, config, roleName)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("error getting provider for login operation: {{err}}", err)
+	}
+
+	endpoint, err := deviceAuthorizationEndpoint(config, provider)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	form := url.Values{
+		"client_id":     {config.ClientID},
+		"client_secret": {config.SecretID},
+		"scope":         {strings.Join(config.scopes(), " ")},
+	}
+	var authResp deviceAuthResponse
+	authCtx, cancel := idpContext(ctx, config)
+	defer cancel()
+	if _, err := postForm(authCtx, provider.client, endpoint, form, &authResp); err != nil {
+		if timeoutErr := idpTimeout(authCtx, "device authorization", err); timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		return nil, errwrap.Wrapf("device authorization request failed: {{err}}", err)
+	}
+	if authResp.DeviceCode == "" || authResp.UserCode == "" {
+		return nil, errors.New("device authorization response is missing the device or user code")
+	}
+
+	// Google names the field verification_url
+	if authResp.VerificationURI == "" {
+		authResp.VerificationURI = authResp.VerificationURL
+	}
+	if authResp.Interval <= 0 {
+		authResp.Interval = 5
+	}
+	if authResp.ExpiresIn <= 0 {
+		authResp.ExpiresIn = 300
+	}
+
+	requestID, err := randomString(32)
+	if err != nil {
+		return nil, errwrap.Wrapf("error to generate request id: {{err}}", err)
+	}
+
+	expiresIn := time.Duration(authResp.ExpiresIn) * time.Second
+	b.stateCache.Set(requestID, &deviceState{
+		DeviceCode: authResp.DeviceCode,
+		Role:       roleName,
+		Interval:   authResp.Interval,
+		Created:    time.Now(),
+	}, expiresIn)
+	if b.stateCache.ItemCount() > config.stateCacheMaxEntries() {
+		b.sweepStateCache(config.stateCacheMaxEntries())
+	}
+
+	resp = &logical.Response{
+		Data: map[string]interface{}{
+			"request_id":                requestID,
+			"user_code":                 authResp.UserCode,
+			"verification_uri":          authResp.VerificationURI,
+			"verification_uri_complete": authResp.VerificationURIComplete,
+			"expires_in":                authResp.ExpiresIn,
+			"interval":                  authResp.Interval,
+		},
+	}
+
+	return resp, nil
+}
+
+func (b *openIDConnectAuthBackend) pathDevicePoll(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	requestID := d.Get("request_id").(string)
+	if requestID == "" {
+		return logical.ErrorResponse("request_id must be set."), nil
+	}
+
+	cached, expiration, ok := b.stateCache.GetWithExpiration(requestID)
+	if !ok {
+		loginMetricsFrom(ctx).fail(reasonStateInvalid)
+		return logical.ErrorResponse("device login request not found or expired, restart the login"), nil
+	}
+	// The cached state is shared by concurrent polls, it is copied and the
+	// copy replaces it when updated
+	state := *cached.(*deviceState)
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("could not load OIDC configuration"), nil
+	}
+	claimsConfig, err := b.claimsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if claimsConfig == nil {
+		return logical.ErrorResponse("could not load OIDC Mapping configuration"), nil
+	}
+	config, resp, err := b.roleConfig(ctx, req.Storage, config, state.Role)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("error getting provider for login operation: {{err}}", err)
+	}
+	ctx = provider.clientContext(ctx)
+
+	form := url.Values{
+		"grant_type":    {deviceCodeGrantType},
+		"device_code":   {state.DeviceCode},
+		"client_id":     {config.ClientID},
+		"client_secret": {config.SecretID},
+	}
+	if !b.allowExchange(config, requestSource(req, requestID)) {
+		return rateLimitedResponse(ctx, req)
+	}
+	var tokenResp deviceTokenResponse
+	m := loginMetricsFrom(ctx)
+	tokenCtx, cancel := idpContext(ctx, config)
+	defer cancel()
+	start := time.Now()
+	status, err := postForm(tokenCtx, provider.client, provider.Endpoint().TokenURL, form, &tokenResp)
+	m.measure(stageExchange, start)
+	if err != nil && status != http.StatusBadRequest && status != http.StatusUnauthorized {
+		m.fail(reasonExchangeFailed)
+		if timeoutErr := idpTimeout(tokenCtx, "token", err); timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		return nil, errwrap.Wrapf("device token request failed: {{err}}", err)
+	}
+
+	// Pending states are described in RFC 8628 section 3.5
+	switch tokenResp.Error {
+	case "":
+	case "authorization_pending":
+		return pendingDeviceResponse(tokenResp.Error, state.Interval), nil
+	case "slow_down":
+		state.Interval += 5
+		if ttl := time.Until(expiration); ttl > 0 {
+			// Fails when the login was completed or swept meanwhile
+			_ = b.stateCache.Replace(requestID, &state, ttl)
+		}
+		return pendingDeviceResponse(tokenResp.Error, state.Interval), nil
+	case "expired_token":
+		b.stateCache.Delete(requestID)
+		return logical.ErrorResponse("device code expired, restart the login"), nil
+	case "access_denied":
+		b.stateCache.Delete(requestID)
+		m.fail(reasonIdpError)
+		return logical.ErrorResponse("login was denied at the Idp"), nil
+	default:
+		b.stateCache.Delete(requestID)
+		m.fail(reasonExchangeFailed)
+		return logical.ErrorResponse(fmt.Sprintf("device login failed: %s", tokenResp.Error)), nil
+	}
+	b.stateCache.Delete(requestID)
+
+	oauth2Token := (&oauth2.Token{
+		AccessToken:  tokenResp.AccessToken,
+		TokenType:    tokenResp.TokenType,
+		RefreshToken: tokenResp.RefreshToken,
+	}).WithExtra(map[string]interface{}{
+		"id_token": tokenResp.IDToken,
+	})
+	if tokenResp.ExpiresIn > 0 {
+		oauth2Token.Expiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+
+	return b.completeLogin(ctx, req.Storage, config, claimsConfig, provider, state.Role, "", oauth2Token)
+}
+
+func pendingDeviceResponse(status string, interval int) *logical.Response {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"status":   status,
+			"interval": interval,
+		},
+	}
+}
+
+// deviceAuthorizationEndpoint returns the configured device authorization
+// endpoint, or the one published in the provider discovery document.
+func deviceAuthorizationEndpoint(config *oidcConfig, provider *oidcProvider) (string, error) {
+	if config.DeviceAuthorizationEndpoint != "" {
+		return config.DeviceAuthorizationEndpoint, nil
+	}
+
+	var discovered struct {
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	}
+	if err := provider.Claims(&discovered); err != nil {
+		return "", err
+	}
+	if discovered.DeviceAuthorizationEndpoint == "" {
+		return "", errors.New("the provider does not publish a device_authorization_endpoint, set it in the config")
+	}
+
+	return discovered.DeviceAuthorizationEndpoint, nil
+}
+
+// postForm posts the form to the endpoint and decodes the JSON response into
+// result, the HTTP status code is returned alongside errors.
+func postForm(ctx context.Context, client *http.Client, endpoint string, form url.Values, result interface{}) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return resp.StatusCode, fmt.Errorf("could not decode response with status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// sweepStateCache deletes the expired device logins, which the cache would
+// otherwise keep until its next cleanup, then evicts the oldest ones above
+// maxEntries. It returns how many were evicted.
+func (b *openIDConnectAuthBackend) sweepStateCache(maxEntries int) int {
+	b.stateCache.DeleteExpired()
+
+	items := b.stateCache.Items()
+	evicted := 0
+	if len(items) > maxEntries {
+		ids := make([]string, 0, len(items))
+		for id := range items {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return items[ids[i]].Object.(*deviceState).Created.Before(items[ids[j]].Object.(*deviceState).Created)
+		})
+		for _, id := range ids[:len(ids)-maxEntries] {
+			b.stateCache.Delete(id)
+			evicted++
+		}
+	}
+
+	setStateCacheEntries(b.stateCache.ItemCount())
+	return evicted
+}
+
+// deviceState is kept in the state cache between the device authorization
+// request and the successful poll.
+type deviceState struct {
+	DeviceCode string
+	Role       string
+	Interval   int
+	Created    time.Time
+}
+
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURL         string `json:"verification_url"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+const (
+	deviceAuthHelpSyn = `
+Starts an OpenID Connect device authorization login.
+`
+	deviceAuthHelpDesc = `
+Starts the device authorization grant of RFC 8628, for hosts which can't run
+a browser. The user must open 'verification_uri' on another device and enter
+'user_code', while the host polls the 'device/poll' endpoint with the returned
+'request_id'.
+`
+	devicePollHelpSyn = `
+Completes an OpenID Connect device authorization login.
+`
+	devicePollHelpDesc = `
+Polls the Idp token endpoint for a device login started with 'device/auth'.
+The response has a 'status' of 'authorization_pending' or 'slow_down' until
+the user approves the login, waiting 'interval' seconds between polls is
+expected. Once approved the login completes like the 'callback' endpoint.
+`
+)
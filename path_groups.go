@@ -0,0 +1,199 @@
+package oidc
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathGroupsList(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `groups/?$`,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathGroupList,
+		},
+
+		HelpSynopsis:    groupHelpSyn,
+		HelpDescription: groupHelpDesc,
+	}
+}
+
+func pathGroups(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: groupPrefix + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: `Name of the Idp group.`,
+			},
+			"policies": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `List of policies attached to members of the group.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathGroupRead,
+			logical.UpdateOperation: b.pathGroupWrite,
+			logical.DeleteOperation: b.pathGroupDelete,
+		},
+
+		HelpSynopsis:    groupHelpSyn,
+		HelpDescription: groupHelpDesc,
+	}
+}
+
+// groupKey returns the storage key of a group, names are lower cased when the
+// claims configuration asks for case insensitive group names.
+func (b *openIDConnectAuthBackend) groupKey(ctx context.Context, s logical.Storage, name string) (string, error) {
+	claimsConfig, err := b.claimsConfig(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	if claimsConfig != nil && claimsConfig.GroupsCaseInsensitive {
+		name = strings.ToLower(name)
+	}
+
+	return groupPrefix + name, nil
+}
+
+func (b *openIDConnectAuthBackend) group(ctx context.Context, s logical.Storage, name string) (*oidcGroup, error) {
+	key, err := b.groupKey(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	result := &oidcGroup{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// groupPolicies returns the policies attached to the given Idp groups.
+func (b *openIDConnectAuthBackend) groupPolicies(ctx context.Context, s logical.Storage, groups []string) ([]string, error) {
+	var policies []string
+	for _, name := range groups {
+		if name == "" {
+			continue
+		}
+
+		group, err := b.group(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if group != nil {
+			policies = append(policies, group.Policies...)
+		}
+	}
+
+	return policies, nil
+}
+
+func (b *openIDConnectAuthBackend) pathGroupList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	groups, err := req.Storage.List(ctx, groupPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedListResponse(groups), nil
+}
+
+// sortedListResponse returns the keys sorted, an empty list is returned as an
+// empty keys array.
+func sortedListResponse(keys []string) *logical.Response {
+	if keys == nil {
+		keys = []string{}
+	}
+	sort.Strings(keys)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"keys": keys,
+		},
+	}
+}
+
+func (b *openIDConnectAuthBackend) pathGroupRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	group, err := b.group(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"policies": group.Policies,
+		},
+	}
+
+	return resp, nil
+}
+
+func (b *openIDConnectAuthBackend) pathGroupWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("group name must be set."), nil
+	}
+
+	key, err := b.groupKey(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	group := &oidcGroup{
+		Policies: policyutil.SanitizePolicies(d.Get("policies").([]string), false),
+	}
+
+	entry, err := logical.StorageEntryJSON(key, group)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *openIDConnectAuthBackend) pathGroupDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	key, err := b.groupKey(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Delete(ctx, key); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+type oidcGroup struct {
+	Policies []string `json:"policies"`
+}
+
+const (
+	groupHelpSyn = `
+Manages policies attached to Idp groups.
+`
+	groupHelpDesc = `
+Users logging in get the policies attached to the groups read from their
+groups claim, in addition to the policies of the role and of the policies
+claim. Group names are matched case insensitively when the claims
+configuration sets 'groups_case_insensitive'.
+`
+)
@@ -0,0 +1,102 @@
+package oidc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathLockouts(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `lockouts$`,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathLockoutsRead,
+		},
+
+		HelpSynopsis:    lockoutsHelpSyn,
+		HelpDescription: lockoutsHelpDesc,
+	}
+}
+
+func pathLockoutsClear(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `lockouts/clear$`,
+		Fields: map[string]*framework.FieldSchema{
+			"subject": {
+				Type:        framework.TypeString,
+				Description: `Subject of the user, the 'sub' claim, to clear the lockout of.`,
+			},
+			"source": {
+				Type:        framework.TypeString,
+				Description: `Client IP address to clear the lockout of.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathLockoutsClear,
+		},
+
+		HelpSynopsis:    lockoutsHelpSyn,
+		HelpDescription: lockoutsHelpDesc,
+	}
+}
+
+func (b *openIDConnectAuthBackend) pathLockoutsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	subjects := map[string]interface{}{}
+	sources := map[string]interface{}{}
+	for key, lockedUntil := range b.lockedKeys() {
+		until := lockedUntil.UTC().Format(time.RFC3339)
+		switch {
+		case strings.HasPrefix(key, lockoutSubjectKey("")):
+			subjects[strings.TrimPrefix(key, lockoutSubjectKey(""))] = until
+		case strings.HasPrefix(key, lockoutSourceKey("")):
+			sources[strings.TrimPrefix(key, lockoutSourceKey(""))] = until
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"subjects": subjects,
+			"sources":  sources,
+		},
+	}, nil
+}
+
+func (b *openIDConnectAuthBackend) pathLockoutsClear(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	subject := d.Get("subject").(string)
+	source := d.Get("source").(string)
+	if subject == "" && source == "" {
+		return logical.ErrorResponse("subject or source must be set"), nil
+	}
+
+	cleared := false
+	if subject != "" && b.clearLockout(lockoutSubjectKey(subject)) {
+		cleared = true
+	}
+	if source != "" && b.clearLockout(lockoutSourceKey(source)) {
+		cleared = true
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"cleared": cleared,
+		},
+	}, nil
+}
+
+const (
+	lockoutsHelpSyn = `
+Lists and clears the lockouts after failed logins.
+`
+	lockoutsHelpDesc = `
+With 'lockout_threshold' set on the config, users, and client IP addresses
+with 'lockout_by_source', are locked out for 'lockout_duration' after that many
+consecutive failed logins. Behind a proxy or a NAT all the users share a client
+IP address, unless Vault uses X-Forwarded-For, and are locked out together.
+Their logins are then rejected without contacting the Idp. Reading 'lockouts'
+returns the locked out subjects and sources with the time their lockout ends,
+writing 'lockouts/clear' with a 'subject' or a 'source' ends it right away.
+`
+)
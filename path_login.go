@@ -2,11 +2,19 @@ package oidc
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/coreos/go-oidc"
-	"github.com/fatih/structs"
-	"github.com/hashicorp/vault/plugins/helper/database/credsutil"
-	"github.com/patrickmn/go-cache"
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"golang.org/x/oauth2"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/logical"
@@ -16,8 +24,19 @@ import (
 func pathLogin(b *openIDConnectAuthBackend) *framework.Path {
 	return &framework.Path{
 		Pattern: `login$`,
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: `<Optional> The role to log in against.`,
+			},
+			"jwt": {
+				Type:        framework.TypeString,
+				Description: `The signed JWT issued by the Idp, used to log in without the code flow.`,
+			},
+		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:           b.pathLogin,
+			logical.UpdateOperation:         b.instrumentLogin("jwt", b.pathLoginJWT),
 			logical.AliasLookaheadOperation: b.pathLoginAliasLookahead,
 		},
 		HelpSynopsis:    pathLoginSyn,
@@ -49,27 +68,437 @@ func (b *openIDConnectAuthBackend) pathLogin(ctx context.Context, req *logical.R
 		return logical.ErrorResponse("could not load OIDC configuration"), nil
 	}
 
+	roleName, resp, err := b.loginRoleName(ctx, req.Storage, config, d.Get("role").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	config, resp, err = b.roleConfig(ctx, req.Storage, config, roleName)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
 	provider, err := b.getProvider(ctx, config)
 	if err != nil {
 		return nil, errwrap.Wrapf("error getting provider for login operation: {{err}}", err)
 	}
 
+	if config.RedirectURL == "" {
+		return logical.ErrorResponse("no default redirect_url is configured, use the auth_url endpoint with a redirect_uri."), nil
+	}
+	resp, err = b.validateLoginRole(ctx, req.Storage, config, roleName, config.RedirectURL)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	if provider.Endpoint().AuthURL == "" {
+		return logical.ErrorResponse("authorization_endpoint must be configured to start a browser login"), nil
+	}
+
+	authURL, _, err := b.createAuthURL(ctx, req.Storage, config, provider, roleName, config.RedirectURL, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the authorization URL is returned, the oauth2 config holds the
+	// client secret and this endpoint is unauthenticated
+	resp = &logical.Response{
+		Redirect: authURL,
+		Data: map[string]interface{}{
+			"auth_url": authURL,
+		},
+	}
+
+	return resp, nil
+}
+
+func (b *openIDConnectAuthBackend) pathLoginJWT(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rawToken := d.Get("jwt").(string)
+	if rawToken == "" {
+		return logical.ErrorResponse("jwt must be set."), nil
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("could not load OIDC configuration"), nil
+	}
+	claimsConfig, err := b.claimsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if claimsConfig == nil {
+		return logical.ErrorResponse("could not load OIDC Mapping configuration"), nil
+	}
+
+	roleName, resp, err := b.loginRoleName(ctx, req.Storage, config, d.Get("role").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	var role *oidcRole
+	if roleName != "" {
+		role, err = b.role(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q could not be found", roleName)), nil
+		}
+	}
+	config, resp, err = b.roleConfig(ctx, req.Storage, config, roleName)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("error getting provider for login operation: {{err}}", err)
+	}
+
+	// Verify the signature, issuer, audience and time claims of the token.
+	// Tokens issued for another client are accepted when bound_audiences are
+	// set.
+	skipClientIDCheck := len(boundAudiences(config, role)) > 0
+	idToken, err := b.verifyToken(ctx, config, provider, skipClientIDCheck, rawToken)
+	m := loginMetricsFrom(ctx)
+	if err != nil {
+		m.fail(reasonTokenInvalid)
+		return logical.ErrorResponse("Failed to verify JWT: " + sanitizeError(err)), nil
+	}
+	m.setSubject(idToken.Subject)
+	if lockedUntil := b.lockedOut(config, lockoutSubjectKey(idToken.Subject)); !lockedUntil.IsZero() {
+		return lockedOutResponse(ctx, lockedUntil), nil
+	}
+	if err := validateIDToken(config, role, idToken); err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateAuthentication(config, role, idToken); err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var allClaims map[string]interface{}
+	if err := idToken.Claims(&allClaims); err != nil {
+		return nil, errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+	if err := claimsConfig.validateEmailDomain(allClaims); err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	emailWarning, err := claimsConfig.validateEmail(allClaims)
+	if err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// Map token claims from Idp to Vault user
+	b.logClaims(config, allClaims)
+	userData, err := claimsConfig.parseClaims(allClaims, nil)
+	if err != nil {
+		m.fail(reasonClaimsMappingFailed)
+		return logical.ErrorResponse("Failed to map user claims: " + err.Error()), nil
+	}
+	if emailWarning != "" {
+		userData.Warnings = append(userData.Warnings, emailWarning)
+	}
+
+	return b.buildAuthResponse(ctx, req.Storage, config, claimsConfig, roleName, role, userData, allClaims)
+}
+
+func (b *openIDConnectAuthBackend) pathLoginRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("OIDC configuration has been deleted, renewal is not allowed"), nil
+	}
+
+	deniedUsers, err := b.denyList(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	// The metadata is read by the token holder, the internal data is
+	// authoritative
+	subject, _ := req.Auth.InternalData["subject"].(string)
+	username, _ := req.Auth.InternalData["username"].(string)
+	if deniedUsers.denied(subject, username) {
+		return nil, logical.ErrPermissionDenied
+	}
+
+	claimsConfig, err := b.claimsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappedPolicies []string
+	var role *oidcRole
+	roleName, _ := req.Auth.InternalData["role"].(string)
+	if roleName != "" {
+		role, err = b.role(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q has been deleted, renewal is not allowed", roleName)), nil
+		}
+
+		mappedPolicies = append(mappedPolicies, role.Policies...)
+	}
+	config, resp, err := b.roleConfig(ctx, req.Storage, config, roleName)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	groupPolicies, err := b.groupPolicies(ctx, req.Storage, internalStrings(req.Auth.InternalData["groups"]))
+	if err != nil {
+		return nil, err
+	}
+	policies := claimsConfig.tokenPolicies(internalStrings(req.Auth.InternalData["claim_policies"]), append(mappedPolicies, groupPolicies...))
+
+	// Deny renewal when the mapping would no longer grant the token policies
+	if !policyutil.EquivalentPolicies(policies, req.Auth.TokenPolicies) {
+		return logical.ErrorResponse("policies have changed since login, renewal is not allowed"), nil
+	}
+
+	resp = &logical.Response{Auth: req.Auth}
+
+	// Refresh the Idp session to check the user still maps to the token
+	if refreshToken, _ := req.Auth.InternalData["refresh_token"].(string); refreshToken != "" {
+		newRefreshToken, denied, err := b.refreshClaims(ctx, req.Storage, config, role, req.Auth, refreshToken)
+		switch {
+		case err == errRefreshDenied:
+			return denied, nil
+		case err != nil && config.RefreshFailureDeniesRenewal:
+			return logical.ErrorResponse(fmt.Sprintf("renewal is not allowed: %s", err)), nil
+		case err != nil:
+			b.Logger().Warn("could not refresh the Idp session, renewing with the login claims", "error", err)
+			resp.AddWarning("the Idp session could not be refreshed, the token was renewed with the login claims")
+		default:
+			resp.Auth.InternalData["refresh_token"] = newRefreshToken
+		}
+	}
+
+	ttl, maxTTL, period := tokenDurations(config, role)
+	resp.Auth.TTL = ttl
+	resp.Auth.MaxTTL = maxTTL
+	resp.Auth.Period = period
+
+	return resp, nil
+}
+
+// internalStrings converts a string list read back from the auth internal
+// data, where it may have been decoded as a list of interfaces.
+func internalStrings(raw interface{}) []string {
+	switch v := raw.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
+// validateLoginRole checks that the role a login is started for exists and
+// that the config and role accept the redirect URI, an error response is
+// returned otherwise.
+func (b *openIDConnectAuthBackend) validateLoginRole(ctx context.Context, s logical.Storage, config *oidcConfig, roleName, redirectURI string) (*logical.Response, error) {
+	if !redirectURIAllowed(config, config.AllowedRedirectURIs, redirectURI) {
+		return logical.ErrorResponse(fmt.Sprintf("redirect_uri %q is not allowed", redirectURI)), nil
+	}
+	if roleName == "" {
+		return nil, nil
+	}
+
+	role, err := b.role(ctx, s, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("role %q could not be found", roleName)), nil
+	}
+	if !redirectURIAllowed(config, role.AllowedRedirectURIs, redirectURI) {
+		return logical.ErrorResponse(fmt.Sprintf("redirect_uri %q is not allowed for role %q", redirectURI, roleName)), nil
+	}
+
+	return nil, nil
+}
+
+// redirectURIAllowed checks the redirect URI against an allow list, an empty
+// list allows any URI. Entries must match exactly, except for localhost
+// entries with a '*' port when allow_localhost_port_wildcard is set, which
+// match any port as used by the CLI listener.
+func redirectURIAllowed(config *oidcConfig, allowed []string, redirectURI string) bool {
+	if len(allowed) == 0 || strutil.StrListContains(allowed, redirectURI) {
+		return true
+	}
+	if !config.AllowLocalhostPortWildcard {
+		return false
+	}
+
+	uri, err := url.Parse(redirectURI)
+	if err != nil || !isLocalhost(uri.Hostname()) {
+		return false
+	}
+	if _, err := strconv.Atoi(uri.Port()); err != nil {
+		return false
+	}
+
+	for _, entry := range allowed {
+		// url.Parse rejects a '*' port, replace it before parsing
+		if !strings.Contains(entry, ":*/") && !strings.HasSuffix(entry, ":*") {
+			continue
+		}
+		pattern, err := url.Parse(strings.Replace(entry, ":*", ":0", 1))
+		if err != nil || !isLocalhost(pattern.Hostname()) {
+			continue
+		}
+		if pattern.Scheme == uri.Scheme && pattern.Hostname() == uri.Hostname() &&
+			pattern.Path == uri.Path && pattern.RawQuery == uri.RawQuery {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// createAuthURL generates the state, nonce and PKCE verifier of a new login,
+// stores them and returns the authorization URL the user must be sent to along
+// with the state.
+func (b *openIDConnectAuthBackend) createAuthURL(ctx context.Context, s logical.Storage, config *oidcConfig, provider *oidcProvider, roleName, redirectURI, clientNonce string) (string, string, error) {
 	// Generate nonce
-	nonce, err := credsutil.RandomAlphaNumeric(16, true)
+	nonce, err := randomString(16)
+	if err != nil {
+		return "", "", errwrap.Wrapf("error to generate state nonce: {{err}}", err)
+	}
+
+	// Generate PKCE code verifier
+	verifier, challenge, err := generateCodeVerifier()
+	if err != nil {
+		return "", "", errwrap.Wrapf("error to generate code verifier: {{err}}", err)
+	}
+
+	// Generate an opaque state parameter used to look up the login on callback
+	stateID, err := randomString(32)
+	if err != nil {
+		return "", "", errwrap.Wrapf("error to generate state: {{err}}", err)
+	}
+
+	// Store the nonce keyed by the state parameter to check for CSRF attempts,
+	// in storage so the callback may be handled by another node
+	err = b.storeLoginState(ctx, s, stateID, &loginState{
+		Nonce:        nonce,
+		Role:         roleName,
+		RedirectURI:  redirectURI,
+		CodeVerifier: verifier,
+		Expiration:   time.Now().Add(config.stateTTL()),
+		ClientNonce:  clientNonce,
+	})
 	if err != nil {
-		return nil, errwrap.Wrapf("error to generate state nonce: {{err}}", err)
+		return "", "", errwrap.Wrapf("error to store login state: {{err}}", err)
 	}
 
-	// Set nonce as state parameter in cache with Remote address to check for CSRF attempts
-	b.stateCache.Set(req.Connection.RemoteAddr, nonce, cache.DefaultExpiration)
 	oauthConfig := config.config2OauthConfig(provider)
+	oauthConfig.RedirectURL = redirectURI
 
-	resp := &logical.Response{
-		Redirect: oauthConfig.AuthCodeURL(stateLogin, oidc.Nonce(nonce)),
-		Data: structs.New(oauthConfig).Map(),
+	authOpts := []oauth2.AuthCodeOption{
+		oidc.Nonce(nonce),
 	}
 
-	return resp, nil
+	// Ask the Idp to authenticate the user again when its session is older
+	// than max_age, auth_time is then checked on callback
+	var role *oidcRole
+	if roleName != "" {
+		if role, err = b.role(ctx, s, roleName); err != nil {
+			return "", "", err
+		}
+	}
+	// Extra parameters come first, the ones set from dedicated options below
+	// take precedence
+	extraParams := map[string]string{}
+	for k, v := range config.ExtraAuthParams {
+		extraParams[k] = v
+	}
+	if role != nil {
+		for k, v := range role.ExtraAuthParams {
+			extraParams[k] = v
+		}
+	}
+	extraOpts := make([]oauth2.AuthCodeOption, 0, len(extraParams))
+	for k, v := range extraParams {
+		extraOpts = append(extraOpts, oauth2.SetAuthURLParam(k, v))
+	}
+	authOpts = append(extraOpts, authOpts...)
+
+	if config.Prompt != "" {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("prompt", config.Prompt))
+	}
+	// Google pre-filters the account chooser on the hosted domain
+	if len(config.AllowedHostedDomains) > 0 {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("hd", config.AllowedHostedDomains[0]))
+	}
+	if len(config.ACRValues) > 0 {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("acr_values", strings.Join(config.ACRValues, " ")))
+	}
+	if age := maxAge(config, role); age > 0 {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("max_age", strconv.FormatInt(int64(age/time.Second), 10)))
+	}
+	if config.implicitFlow() {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("response_type", "id_token"))
+	} else {
+		if len(config.OIDCResponseTypes) > 1 {
+			authOpts = append(authOpts, oauth2.SetAuthURLParam("response_type", strings.Join(config.OIDCResponseTypes, " ")))
+		}
+		authOpts = append(authOpts,
+			oauth2.SetAuthURLParam("code_challenge", challenge),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	}
+	// query is the default response mode of the code flow, it isn't sent
+	if config.OIDCResponseMode == responseModeFormPost {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("response_mode", responseModeFormPost))
+	}
+
+	authURL := oauthConfig.AuthCodeURL(stateID, authOpts...)
+
+	return authURL, stateID, nil
+}
+
+// randomString returns size bytes from a cryptographically secure source,
+// encoded so that it can be used in URLs.
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// generateCodeVerifier creates a PKCE code verifier and its S256 code
+// challenge, as described in RFC 7636.
+func generateCodeVerifier() (string, string, error) {
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return verifier, challenge, nil
 }
 
 const (
@@ -77,10 +506,12 @@ const (
 	Log in with a OpenID Connect.
 	`
 
- 	pathLoginDesc = `
+	pathLoginDesc = `
 	This endpoint authenticates using Auth0 with OpenID Connect. Please be sure to
 	read the note on escaping from the path-help for the 'config' endpoint.
-	`
 
- 	stateLogin = "Vault-Login"
-)
\ No newline at end of file
+	Reading this endpoint redirects to the Idp to start the code flow, while
+	writing a 'jwt' issued by the Idp logs in directly, which is suited for
+	machines and CI jobs.
+	`
+)
@@ -0,0 +1,196 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+func pathLoginClient(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `login/client$`,
+		Fields: map[string]*framework.FieldSchema{
+			"client_id": {
+				Type:        framework.TypeString,
+				Description: `OpenID Connect client ID of the service.`,
+			},
+			"client_secret": {
+				Type:        framework.TypeString,
+				Description: `OpenID Connect client secret of the service.`,
+			},
+			"role": {
+				Type:        framework.TypeString,
+				Description: `<Optional> The role to log in against.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.instrumentLogin("client", b.pathLoginClient),
+		},
+
+		HelpSynopsis:    pathLoginClientSyn,
+		HelpDescription: pathLoginClientDesc,
+	}
+}
+
+func (b *openIDConnectAuthBackend) pathLoginClient(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	clientID := d.Get("client_id").(string)
+	clientSecret := d.Get("client_secret").(string)
+	if clientID == "" || clientSecret == "" {
+		return logical.ErrorResponse("client_id and client_secret must be set."), nil
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("could not load OIDC configuration"), nil
+	}
+	claimsConfig, err := b.claimsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if claimsConfig == nil {
+		return logical.ErrorResponse("could not load OIDC Mapping configuration"), nil
+	}
+
+	roleName, resp, err := b.loginRoleName(ctx, req.Storage, config, d.Get("role").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	var role *oidcRole
+	if roleName != "" {
+		role, err = b.role(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q could not be found", roleName)), nil
+		}
+	}
+	config, resp, err = b.roleConfig(ctx, req.Storage, config, roleName)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	// Clients are allowed by the provider of the role, a client of one
+	// issuer can't log in with the role of another
+	if !strutil.StrListContains(config.AllowedClientIDs, clientID) {
+		return logical.ErrorResponse(fmt.Sprintf("client %q is not allowed to log in", clientID)), nil
+	}
+
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return nil, errwrap.Wrapf("error getting provider for login operation: {{err}}", err)
+	}
+	ctx = provider.clientContext(ctx)
+
+	ccConfig := &clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     provider.Endpoint().TokenURL,
+		Scopes:       config.scopes(),
+	}
+	if !b.allowExchange(config, requestSource(req, clientID)) {
+		return rateLimitedResponse(ctx, req)
+	}
+	tokenCtx, cancel := idpContext(ctx, config)
+	defer cancel()
+	start := time.Now()
+	token, err := ccConfig.Token(b.clientContext(tokenCtx))
+	loginMetricsFrom(ctx).measure(stageExchange, start)
+	if err != nil {
+		loginMetricsFrom(ctx).fail(reasonExchangeFailed)
+		if timeoutErr := idpTimeout(tokenCtx, "token", err); timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		return logical.ErrorResponse("Failed to get client credentials token: " + sanitizeError(err)), nil
+	}
+
+	// Verify the ID token if the Idp returned one, the access token otherwise
+	rawToken, _ := token.Extra("id_token").(string)
+	skipClientIDCheck := false
+	if rawToken == "" {
+		rawToken = token.AccessToken
+		skipClientIDCheck = true
+	}
+
+	clientConfig := *config
+	clientConfig.ClientID = clientID
+	idToken, err := b.verifyToken(ctx, &clientConfig, provider, skipClientIDCheck, rawToken)
+	m := loginMetricsFrom(ctx)
+	if err != nil {
+		m.fail(reasonTokenInvalid)
+		return logical.ErrorResponse("Failed to verify client credentials token: " + sanitizeError(err)), nil
+	}
+	m.setSubject(idToken.Subject)
+	if lockedUntil := b.lockedOut(config, lockoutSubjectKey(idToken.Subject)); !lockedUntil.IsZero() {
+		return lockedOutResponse(ctx, lockedUntil), nil
+	}
+	if err := validateIDToken(config, role, idToken); err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := validateAuthentication(config, role, idToken); err != nil {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var allClaims map[string]interface{}
+	if err := idToken.Claims(&allClaims); err != nil {
+		return nil, errwrap.Wrapf("failed to decode claims: {{err}}", err)
+	}
+
+	// Access tokens don't have to be issued for Vault, check they belong to
+	// the client that authenticated
+	if skipClientIDCheck && !tokenIssuedTo(allClaims, clientID) {
+		m.fail(reasonTokenRejected)
+		return logical.ErrorResponse("client credentials token was not issued to the client"), nil
+	}
+
+	b.logClaims(config, allClaims)
+	userData, err := claimsConfig.parseClaims(allClaims, nil)
+	if err != nil {
+		m.fail(reasonClaimsMappingFailed)
+		return logical.ErrorResponse("Failed to map user claims: " + err.Error()), nil
+	}
+	userData.Metadata["client_id"] = clientID
+
+	resp, err = b.buildAuthResponse(ctx, req.Storage, config, claimsConfig, roleName, role, userData, allClaims)
+	if err != nil || resp.Auth == nil {
+		return resp, err
+	}
+	resp.Auth.Renewable = config.ClientCredentialsRenewable && resp.Auth.TokenType != logical.TokenTypeBatch
+
+	return resp, nil
+}
+
+// tokenIssuedTo checks the claims identifying the client an access token was
+// issued to.
+func tokenIssuedTo(allClaims map[string]interface{}, clientID string) bool {
+	for _, claim := range []string{"azp", "client_id", "appid", "cid", "sub"} {
+		if value, ok := allClaims[claim].(string); ok && value == clientID {
+			return true
+		}
+	}
+
+	return false
+}
+
+const (
+	pathLoginClientSyn = `
+	Log in with OpenID Connect client credentials.
+	`
+
+	pathLoginClientDesc = `
+	This endpoint authenticates services holding their own OpenID Connect
+	client credentials using the client credentials grant. Only the client IDs
+	listed in the config 'allowed_client_ids' may log in, and the issued tokens
+	are not renewable unless 'client_credentials_renewable' is set.
+	`
+)
@@ -0,0 +1,111 @@
+package oidc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func loginJWT(b *openIDConnectAuthBackend, s logical.Storage, jwt string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Storage:   s,
+		Data:      map[string]interface{}{"jwt": jwt},
+	})
+}
+
+// TestLoginJWT_AuthenticationChecks checks JWT logins enforce the hosted
+// domains, max_age and acr values as the callback does.
+func TestLoginJWT_AuthenticationChecks(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    map[string]interface{}
+		claims    map[string]interface{}
+		wantError string
+	}{
+		{
+			name:   "allowed hosted domain",
+			config: map[string]interface{}{"allowed_hosted_domains": "example.com"},
+			claims: map[string]interface{}{"hd": "example.com"},
+		},
+		{
+			name:      "other hosted domain",
+			config:    map[string]interface{}{"allowed_hosted_domains": "example.com"},
+			claims:    map[string]interface{}{"hd": "gmail.com"},
+			wantError: "is not one of the allowed_hosted_domains",
+		},
+		{
+			name:      "no hosted domain",
+			config:    map[string]interface{}{"allowed_hosted_domains": "example.com"},
+			wantError: "the ID token has no hosted domain",
+		},
+		{
+			name:      "missing auth_time",
+			config:    map[string]interface{}{"max_age": "1h"},
+			wantError: "has no auth_time claim",
+		},
+		{
+			name:      "old auth_time",
+			config:    map[string]interface{}{"max_age": "1h"},
+			claims:    map[string]interface{}{"auth_time": time.Now().Add(-2 * time.Hour).Unix()},
+			wantError: "older than max_age",
+		},
+		{
+			name:      "acr mismatch",
+			config:    map[string]interface{}{"allowed_acr_values": "mfa"},
+			claims:    map[string]interface{}{"acr": "pwd"},
+			wantError: "is not one of the allowed_acr_values",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, storage := getBackend(t)
+			idp := newTestIdp(t)
+			defer idp.Close()
+			idp.configure(b, storage, tt.config, nil)
+
+			resp, err := loginJWT(b, storage, idp.idToken(tt.claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantError == "" {
+				if resp == nil || resp.IsError() || resp.Auth == nil {
+					t.Fatalf("login failed: %#v", resp)
+				}
+				return
+			}
+			if resp == nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), tt.wantError) {
+				t.Fatalf("expected an error containing %q, got %#v", tt.wantError, resp)
+			}
+		})
+	}
+}
+
+// TestLoginRenew_DeniedUsername checks an Idp claim named username can't
+// replace the username checked against the deny list on renewal.
+func TestLoginRenew_DeniedUsername(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	idp.configure(b, storage, nil, map[string]interface{}{"all_metadata": true})
+	idp.setClaim("username", "someone-else")
+
+	resp, err := loginJWT(b, storage, idp.idToken(nil))
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("login failed: err: %v resp: %#v", err, resp)
+	}
+	if resp.Auth.Metadata["username"] != "user@example.com" {
+		t.Fatalf("the username metadata was replaced by the claim: %#v", resp.Auth.Metadata)
+	}
+
+	writeOK(t, b, storage, denyListPath, map[string]interface{}{"denied_users": "user@example.com"})
+	_, err = b.pathLoginRenew(context.Background(), &logical.Request{Storage: storage, Auth: resp.Auth}, nil)
+	if err != logical.ErrPermissionDenied {
+		t.Fatalf("expected the renewal to be denied, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package oidc
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathPoll(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `poll$`,
+		Fields: map[string]*framework.FieldSchema{
+			"state": {
+				Type:        framework.TypeString,
+				Description: `The state returned by the auth_url endpoint.`,
+			},
+			"client_nonce": {
+				Type:        framework.TypeString,
+				Description: `The client nonce given to the auth_url endpoint.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.instrumentLogin("poll", b.pathPoll),
+		},
+
+		HelpSynopsis:    pollHelpSyn,
+		HelpDescription: pollHelpDesc,
+	}
+}
+
+func (b *openIDConnectAuthBackend) pathPoll(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	stateID := d.Get("state").(string)
+	clientNonce := d.Get("client_nonce").(string)
+	if stateID == "" || clientNonce == "" {
+		return logical.ErrorResponse("state and client_nonce must be set."), nil
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("could not load OIDC configuration"), nil
+	}
+	claimsConfig, err := b.claimsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if claimsConfig == nil {
+		return logical.ErrorResponse("could not load OIDC Mapping configuration"), nil
+	}
+
+	state, err := b.readLoginState(ctx, req.Storage, stateID)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading login state: {{err}}", err)
+	}
+	if state == nil || state.ClientNonce == "" ||
+		subtle.ConstantTimeCompare([]byte(state.ClientNonce), []byte(clientNonce)) != 1 {
+		loginMetricsFrom(ctx).fail(reasonStateInvalid)
+		return logical.ErrorResponse("login not found or expired, restart the login"), nil
+	}
+	if state.Code == "" && state.IDToken == "" {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"status": "authorization_pending",
+			},
+		}, nil
+	}
+
+	if !b.allowExchange(config, requestSource(req, stateID)) {
+		return rateLimitedResponse(ctx, req)
+	}
+	// Concurrent polls may both see the code, only the one taking the state
+	// exchanges it
+	state, err = b.takeLoginState(ctx, req.Storage, stateID)
+	if err != nil {
+		return nil, storageError("error reading login state", err)
+	}
+	if state == nil {
+		loginMetricsFrom(ctx).fail(reasonStateInvalid)
+		return logical.ErrorResponse("state already used or expired, restart the login"), nil
+	}
+
+	return b.exchangeCode(ctx, req.Storage, config, claimsConfig, state, state.Code, state.IDToken)
+}
+
+const (
+	pollHelpSyn = `
+Completes an OpenID Connect login redirected to the callback endpoint.
+`
+	pollHelpDesc = `
+Completes a login started with a 'client_nonce' on the 'auth_url' endpoint.
+The response has a 'status' of 'authorization_pending' until the browser
+reached the 'callback' endpoint, the token is then returned to the client
+instead of being shown in the browser.
+`
+)
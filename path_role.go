@@ -0,0 +1,400 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/helper/parseutil"
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathRoleList(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `role/?$`,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathRoleList,
+		},
+
+		HelpSynopsis:    roleHelpSyn,
+		HelpDescription: roleHelpDesc,
+	}
+}
+
+func pathRole(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: rolePrefix + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: `Name of the role.`,
+			},
+			"policies": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `<Optional> List of policies attached to tokens issued with this role.`,
+			},
+			"ttl": {
+				Type:        framework.TypeString,
+				Description: `<Optional> Duration after which authentication will be expired, overrides the config ttl.`,
+			},
+			"max_ttl": {
+				Type:        framework.TypeString,
+				Description: `<Optional> Maximum duration after which authentication will be expired, overrides the config max_ttl.`,
+			},
+			"token_period": {
+				Type:        framework.TypeString,
+				Description: `<Optional> Issue periodic tokens renewable for this duration without expiring, overrides the config token_period. Can't be set with max_ttl.`,
+			},
+			"token_type": {
+				Type:        framework.TypeString,
+				Description: `<Optional> Type of issued tokens, 'service', 'batch' or 'default'. Overrides the config token_type.`,
+			},
+			"token_bound_cidrs": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `<Optional> List of CIDR blocks issued tokens may be used from. Overrides the config token_bound_cidrs.`,
+			},
+			"token_num_uses": {
+				Type:        framework.TypeInt,
+				Description: `<Optional> Number of times issued tokens may be used, 0 means unlimited. Overrides the config token_num_uses.`,
+			},
+			"token_explicit_max_ttl": {
+				Type:        framework.TypeString,
+				Description: `<Optional> Hard limit on the lifetime of issued tokens, applied even when the mount max TTL is longer.`,
+			},
+			"pass_access_token": {
+				Type:        framework.TypeBool,
+				Description: `<Optional> Keep the Idp access token in the token internal data. Enabled when set on the config or the role.`,
+			},
+			"pass_access_token_in_response": {
+				Type:        framework.TypeBool,
+				Description: `<Optional> Return the Idp access token in the login response data as well. Enabled when set on the config or the role.`,
+			},
+			"max_age": {
+				Type:        framework.TypeString,
+				Description: `<Optional> How long ago the user may have authenticated at the Idp. Overrides the config max_age.`,
+			},
+			"extra_auth_params": {
+				Type:        framework.TypeKVPairs,
+				Description: `<Optional> Additional parameters sent on the authorization URL, merged over the config extra_auth_params.`,
+			},
+			"bound_claims": {
+				Type:        framework.TypeMap,
+				Description: `<Optional> Map of claims and the values they must have for a login to be accepted. Nested claims are selected with a JSON pointer, e.g. '/realm_access/roles'.`,
+			},
+			"bound_claims_type": {
+				Type:        framework.TypeString,
+				Description: `<Optional> How string claims are compared to the bound_claims values, 'string' (default) for exact matches or 'glob' for patterns such as 'team-*'.`,
+			},
+			"bound_audiences": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `<Optional> List of audiences, at least one of them must be in the token 'aud' claim. Overrides the config bound_audiences.`,
+			},
+			"bound_subject": {
+				Type:        framework.TypeString,
+				Description: `<Optional> The value the token 'sub' claim must match. Overrides the config bound_subject.`,
+			},
+			"allowed_redirect_uris": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `<Optional> List of redirect URIs allowed to be used with this role.`,
+			},
+			"provider": {
+				Type:        framework.TypeString,
+				Description: `<Optional> Name of the provider, written to config/<name>, logins with this role use. Defaults to the provider of 'config'.`,
+			},
+		},
+		ExistenceCheck: b.pathRoleExistenceCheck,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathRoleRead,
+			logical.CreateOperation: b.pathRoleWrite,
+			logical.UpdateOperation: b.pathRoleWrite,
+			logical.DeleteOperation: b.pathRoleDelete,
+		},
+
+		HelpSynopsis:    roleHelpSyn,
+		HelpDescription: roleHelpDesc,
+	}
+}
+
+func (b *openIDConnectAuthBackend) pathRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, rolePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedListResponse(roles), nil
+}
+
+// loginRoleName returns the role of a login, the default_role when the request
+// names none. Logins without any role are only allowed while no role exists,
+// as they were before roles were added.
+func (b *openIDConnectAuthBackend) loginRoleName(ctx context.Context, s logical.Storage, config *oidcConfig, roleName string) (string, *logical.Response, error) {
+	if roleName != "" {
+		return roleName, nil, nil
+	}
+	if config.DefaultRole != "" {
+		return config.DefaultRole, nil, nil
+	}
+
+	roles, err := s.List(ctx, rolePrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(roles) > 0 {
+		return "", logical.ErrorResponse("a role is required, set the role parameter or the default_role of the config"), nil
+	}
+
+	return "", nil, nil
+}
+
+// roleConfig returns the config of the provider logins with the role use, the
+// default config for logins without a role or with a role without provider.
+// Named providers share the mount wide settings of the default config.
+func (b *openIDConnectAuthBackend) roleConfig(ctx context.Context, s logical.Storage, config *oidcConfig, roleName string) (*oidcConfig, *logical.Response, error) {
+	if roleName == "" {
+		return config, nil, nil
+	}
+	role, err := b.role(ctx, s, roleName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if role == nil || role.Provider == "" {
+		return config, nil, nil
+	}
+
+	named, err := b.namedConfig(ctx, s, role.Provider)
+	if err != nil {
+		return nil, nil, err
+	}
+	if named == nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("provider %q of role %q is not configured", role.Provider, roleName)), nil
+	}
+
+	return named.withMountSettings(config), nil, nil
+}
+
+func (b *openIDConnectAuthBackend) role(ctx context.Context, s logical.Storage, name string) (*oidcRole, error) {
+	entry, err := s.Get(ctx, rolePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	result := &oidcRole{}
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+	upgraded, err := result.upgrade(rolePrefix + name)
+	if err != nil {
+		return nil, err
+	}
+	if upgraded {
+		b.storeUpgraded(ctx, s, rolePrefix+name, result)
+	}
+
+	return result, nil
+}
+
+func (b *openIDConnectAuthBackend) pathRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := b.role(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"policies":                      role.Policies,
+			"ttl":                           role.TTL.String(),
+			"max_ttl":                       role.MaxTTL.String(),
+			"token_period":                  role.TokenPeriod.String(),
+			"token_type":                    role.TokenType,
+			"token_bound_cidrs":             role.TokenBoundCIDRs,
+			"token_num_uses":                role.TokenNumUses,
+			"token_explicit_max_ttl":        role.TokenExplicitMaxTTL.String(),
+			"max_age":                       role.MaxAge.String(),
+			"pass_access_token":             role.PassAccessToken,
+			"pass_access_token_in_response": role.PassAccessTokenInResponse,
+			"extra_auth_params":             role.ExtraAuthParams,
+			"bound_claims":                  role.BoundClaims,
+			"bound_claims_type":             role.BoundClaimsType,
+			"bound_audiences":               role.BoundAudiences,
+			"bound_subject":                 role.BoundSubject,
+			"allowed_redirect_uris":         role.AllowedRedirectURIs,
+			"provider":                      role.Provider,
+		},
+	}
+
+	return resp, nil
+}
+
+func (b *openIDConnectAuthBackend) pathRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	role, err := b.role(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+
+	return role != nil, nil
+}
+
+func (b *openIDConnectAuthBackend) pathRoleWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if name == "" {
+		return logical.ErrorResponse("role name must be set."), nil
+	}
+
+	// Updates keep the stored values of the fields they don't set
+	role, err := b.role(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		role = &oidcRole{}
+	}
+	if raw, ok := d.GetOk("policies"); ok {
+		role.Policies = policyutil.SanitizePolicies(raw.([]string), false)
+	}
+	updateField(d, "bound_claims", &role.BoundClaims)
+	updateField(d, "bound_audiences", &role.BoundAudiences)
+	updateField(d, "bound_subject", &role.BoundSubject)
+	updateField(d, "allowed_redirect_uris", &role.AllowedRedirectURIs)
+	updateField(d, "provider", &role.Provider)
+	if strutil.StrListContains(reservedConfigNames, role.Provider) {
+		return logical.ErrorResponse(fmt.Sprintf("provider %q is reserved", role.Provider)), nil
+	}
+
+	if err := updateDuration(d, "ttl", &role.TTL); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := updateDuration(d, "max_ttl", &role.MaxTTL); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if role.MaxTTL > 0 && role.TTL > role.MaxTTL {
+		return logical.ErrorResponse("ttl should not be greater than max_ttl."), nil
+	}
+	if err := updateDuration(d, "token_period", &role.TokenPeriod); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if role.TokenPeriod > 0 && role.MaxTTL > 0 {
+		return logical.ErrorResponse("token_period and max_ttl can't both be set, periodic tokens don't expire while renewed"), nil
+	}
+	updateField(d, "token_type", &role.TokenType)
+	if err := validateTokenType(role.TokenType, role.TokenPeriod); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	updateField(d, "token_bound_cidrs", &role.TokenBoundCIDRs)
+	if _, err := parseutil.ParseAddrs(role.TokenBoundCIDRs); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid token_bound_cidrs: %s", err)), nil
+	}
+	updateField(d, "token_num_uses", &role.TokenNumUses)
+	if role.TokenNumUses < 0 {
+		return logical.ErrorResponse("token_num_uses can't be negative"), nil
+	}
+	if err := updateDuration(d, "token_explicit_max_ttl", &role.TokenExplicitMaxTTL); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if role.TokenExplicitMaxTTL > 0 && role.TTL > role.TokenExplicitMaxTTL {
+		return logical.ErrorResponse("ttl should not be greater than token_explicit_max_ttl."), nil
+	}
+	updateField(d, "pass_access_token", &role.PassAccessToken)
+	updateField(d, "pass_access_token_in_response", &role.PassAccessTokenInResponse)
+	if err := updateDuration(d, "max_age", &role.MaxAge); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if role.MaxAge < 0 {
+		return logical.ErrorResponse("max_age can't be negative"), nil
+	}
+	for claim := range role.BoundClaims {
+		if err := validateClaimSelector(claim); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid bound_claims entry %s: %s", claim, err)), nil
+		}
+	}
+	updateField(d, "bound_claims_type", &role.BoundClaimsType)
+	if role.BoundClaimsType, err = validateBoundClaimsType(role.BoundClaimsType, role.BoundClaims); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	updateField(d, "extra_auth_params", &role.ExtraAuthParams)
+	if err := validateExtraAuthParams(role.ExtraAuthParams); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	role.Version = storageVersion
+	entry, err := logical.StorageEntryJSON(rolePrefix+name, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	// Vault caps lease TTLs to the mount max, tell the operator instead of
+	// letting tokens silently get a shorter TTL
+	var resp *logical.Response
+	if mountMaxTTL := b.System().MaxLeaseTTL(); role.TTL > mountMaxTTL || role.MaxTTL > mountMaxTTL {
+		resp = &logical.Response{}
+		resp.AddWarning(fmt.Sprintf("ttl or max_ttl exceed the mount max TTL of %s, issued tokens will be capped to it", mountMaxTTL))
+	}
+	// Providers may be configured after the role
+	if role.Provider != "" {
+		provider, err := b.namedConfig(ctx, req.Storage, role.Provider)
+		if err != nil {
+			return nil, err
+		}
+		if provider == nil {
+			if resp == nil {
+				resp = &logical.Response{}
+			}
+			resp.AddWarning(fmt.Sprintf("provider %q is not configured yet, logins with this role fail until config/%s is written", role.Provider, role.Provider))
+		}
+	}
+
+	return resp, nil
+}
+
+func (b *openIDConnectAuthBackend) pathRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, rolePrefix+d.Get("name").(string)); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+type oidcRole struct {
+	Policies                  []string               `json:"policies"`
+	TTL                       time.Duration          `json:"ttl"`
+	MaxTTL                    time.Duration          `json:"max_ttl"`
+	TokenPeriod               time.Duration          `json:"token_period"`
+	TokenType                 string                 `json:"token_type"`
+	TokenBoundCIDRs           []string               `json:"token_bound_cidrs"`
+	TokenNumUses              int                    `json:"token_num_uses"`
+	TokenExplicitMaxTTL       time.Duration          `json:"token_explicit_max_ttl"`
+	MaxAge                    time.Duration          `json:"max_age"`
+	PassAccessToken           bool                   `json:"pass_access_token"`
+	PassAccessTokenInResponse bool                   `json:"pass_access_token_in_response"`
+	ExtraAuthParams           map[string]string      `json:"extra_auth_params"`
+	BoundClaims               map[string]interface{} `json:"bound_claims"`
+	BoundClaimsType           string                 `json:"bound_claims_type"`
+	BoundAudiences            []string               `json:"bound_audiences"`
+	BoundSubject              string                 `json:"bound_subject"`
+	AllowedRedirectURIs       []string               `json:"allowed_redirect_uris"`
+	Provider                  string                 `json:"provider"`
+
+	Version int `json:"version"`
+}
+
+const (
+	roleHelpSyn = `
+Manages roles used to log in with OpenID Connect.
+`
+	roleHelpDesc = `
+A role restricts which users may log in through it, using bound claims, and
+sets the policies and TTLs of the tokens issued to them. A role is selected
+with the 'role' parameter when starting the login flow.
+`
+)
@@ -11,7 +11,7 @@ func pathSecretID(b *openIDConnectAuthBackend) *framework.Path {
 	return &framework.Path{
 		Pattern: `secret-id$`,
 		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.ReadOperation:   b.pathSecretIDRead,
+			logical.ReadOperation: b.pathSecretIDRead,
 		},
 
 		HelpSynopsis:    secretIDHelpSyn,
@@ -30,8 +30,9 @@ func (b *openIDConnectAuthBackend) pathSecretIDRead(ctx context.Context, req *lo
 
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"client_id":             config.ClientID,
-			"secret_id":             config.SecretID,
+			"client_id":       config.ClientID,
+			"secret_id":       config.SecretID,
+			"provider_config": config.ProviderConfig,
 		},
 	}
 
@@ -43,7 +44,8 @@ const (
 Return OpenID Connect Client information.
 `
 	secretIDHelpDesc = `
-Return OpenID Connect Relaying party client ID and secret ID.
+Return OpenID Connect Relaying party client ID and secret ID, and the
+provider_config including its sensitive values.
 Used to get secret id intentionaly instead of get the secret ID whenever the backend config is red.
 `
 )
@@ -0,0 +1,51 @@
+package oidc
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathTidy(b *openIDConnectAuthBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: `tidy$`,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathTidy,
+		},
+
+		HelpSynopsis:    tidyHelpSyn,
+		HelpDescription: tidyHelpDesc,
+	}
+}
+
+func (b *openIDConnectAuthBackend) pathTidy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	deleted, err := b.tidyLoginStates(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	deletedNonces, err := b.tidyNonces(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"deleted_states": deleted,
+			"deleted_nonces": deletedNonces,
+		},
+	}, nil
+}
+
+const (
+	tidyHelpSyn = `
+Deletes the expired login states and consumed nonces.
+`
+	tidyHelpDesc = `
+Login flows which were started but never completed leave their state in
+storage. The expired states are deleted every few minutes, this endpoint
+deletes them right away and returns how many were deleted. States of logins
+still in progress are kept. The nonces of the ID tokens which were used to log
+in are kept until the tokens expire, to reject replays, and deleted along.
+`
+)
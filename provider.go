@@ -0,0 +1,251 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+	"github.com/hashicorp/vault/helper/strutil"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// staticSigningAlgs are accepted by the verifier when the keys don't come from
+// the discovery document, which otherwise lists the algorithms of the Idp. They
+// are also the values allowed in supported_signing_algs.
+var staticSigningAlgs = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+	string(jose.EdDSA),
+}
+
+// oidcProvider gives access to the Idp endpoints and signing keys, either
+// read from the discovery document or statically configured. Its methods
+// mirror the ones of oidc.Provider.
+type oidcProvider struct {
+	// discovered is nil when the endpoints are statically configured
+	discovered *oidc.Provider
+
+	// signingAlgs are the algorithms of the discovery document supported by
+	// the verifier. go-oidc drops the ones it doesn't know, such as EdDSA.
+	signingAlgs []string
+
+	issuer   string
+	endpoint oauth2.Endpoint
+	keySet   oidc.KeySet
+
+	// client sends the requests to the Idp
+	client *http.Client
+}
+
+func newDiscoveredProvider(discovered *oidc.Provider) *oidcProvider {
+	var claims struct {
+		SigningAlgs []string `json:"id_token_signing_alg_values_supported"`
+	}
+	// A malformed list leaves go-oidc pick the algorithms
+	_ = discovered.Claims(&claims)
+
+	var signingAlgs []string
+	for _, alg := range claims.SigningAlgs {
+		if strutil.StrListContains(staticSigningAlgs, alg) {
+			signingAlgs = append(signingAlgs, alg)
+		}
+	}
+
+	return &oidcProvider{
+		discovered:  discovered,
+		signingAlgs: signingAlgs,
+		endpoint:    discovered.Endpoint(),
+	}
+}
+
+// clientContext returns a context making the requests of the login operation
+// to the Idp use the HTTP client of the provider.
+func (p *oidcProvider) clientContext(ctx context.Context) context.Context {
+	if p.client == nil {
+		return ctx
+	}
+	return oidc.ClientContext(ctx, p.client)
+}
+
+func (p *oidcProvider) Endpoint() oauth2.Endpoint {
+	return p.endpoint
+}
+
+func (p *oidcProvider) Verifier(config *oidc.Config) *oidc.IDTokenVerifier {
+	verifierConfig := *config
+	if p.discovered != nil {
+		if len(verifierConfig.SupportedSigningAlgs) == 0 {
+			verifierConfig.SupportedSigningAlgs = p.signingAlgs
+		}
+		return p.discovered.Verifier(&verifierConfig)
+	}
+
+	if len(verifierConfig.SupportedSigningAlgs) == 0 {
+		verifierConfig.SupportedSigningAlgs = staticSigningAlgs
+	}
+	return oidc.NewVerifier(p.issuer, p.keySet, &verifierConfig)
+}
+
+// SupportsUserInfo reports whether the UserInfo endpoint is known, it is only
+// read from the discovery document.
+func (p *oidcProvider) SupportsUserInfo() bool {
+	return p.discovered != nil
+}
+
+// UserInfo fetches the raw UserInfo response for the access token along with
+// its content type, Idps may return a signed JWT instead of JSON.
+func (p *oidcProvider) UserInfo(ctx context.Context, client *http.Client, accessToken string) ([]byte, string, error) {
+	if p.discovered == nil {
+		return nil, "", errors.New("the UserInfo endpoint is only available with provider discovery")
+	}
+
+	var discovered struct {
+		UserInfoEndpoint string `json:"userinfo_endpoint"`
+	}
+	if err := p.discovered.Claims(&discovered); err != nil {
+		return nil, "", err
+	}
+	if discovered.UserInfoEndpoint == "" {
+		return nil, "", errors.New("the provider does not publish a userinfo_endpoint")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, discovered.UserInfoEndpoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &oauth2.RetrieveError{Response: resp, Body: body}
+	}
+
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// Claims decodes the provider discovery document into v.
+func (p *oidcProvider) Claims(v interface{}) error {
+	if p.discovered == nil {
+		return errors.New("provider discovery is not configured")
+	}
+	return p.discovered.Claims(v)
+}
+
+// signedUserInfo reports whether the UserInfo response is a JWT rather than
+// JSON, from its content type or its format.
+func signedUserInfo(contentType string, body []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mediaType {
+		case "application/jwt":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+
+	trimmed := strings.TrimSpace(string(body))
+	return !strings.HasPrefix(trimmed, "{") && strings.Count(trimmed, ".") == 2
+}
+
+// staticKeySet verifies token signatures against the configured public keys,
+// without fetching the keys of the Idp.
+type staticKeySet struct {
+	publicKeys []crypto.PublicKey
+}
+
+func newStaticKeySet(pemKeys []string) (*staticKeySet, error) {
+	publicKeys, err := parsePublicKeys(pemKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &staticKeySet{publicKeys: publicKeys}, nil
+}
+
+func (s *staticKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+
+	for _, key := range s.publicKeys {
+		if payload, err := jws.Verify(key); err == nil {
+			return payload, nil
+		}
+	}
+
+	return nil, errors.New("no known key successfully validated the token signature")
+}
+
+// parsePublicKeys decodes the RSA, ECDSA and Ed25519 public keys of the PEM
+// blocks, certificates are accepted as well.
+func parsePublicKeys(pemKeys []string) ([]crypto.PublicKey, error) {
+	publicKeys := make([]crypto.PublicKey, 0, len(pemKeys))
+	for i, raw := range pemKeys {
+		block, _ := pem.Decode([]byte(strings.TrimSpace(raw)))
+		if block == nil {
+			return nil, fmt.Errorf("jwt_validation_pubkeys entry %d is not PEM encoded", i)
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("jwt_validation_pubkeys entry %d has unsupported PEM type %q", i, block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse jwt_validation_pubkeys entry %d: %s", i, err)
+		}
+
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			publicKeys = append(publicKeys, key)
+		case *ecdsa.PublicKey:
+			switch key.Curve {
+			case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			default:
+				return nil, fmt.Errorf("jwt_validation_pubkeys entry %d uses an unsupported elliptic curve", i)
+			}
+			publicKeys = append(publicKeys, key)
+		case ed25519.PublicKey:
+			publicKeys = append(publicKeys, key)
+		default:
+			return nil, fmt.Errorf("jwt_validation_pubkeys entry %d is not an RSA, ECDSA or Ed25519 key", i)
+		}
+	}
+
+	return publicKeys, nil
+}
@@ -0,0 +1,125 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/mitchellh/mapstructure"
+	"golang.org/x/oauth2"
+)
+
+const (
+	providerAzure = "azure"
+
+	defaultGraphEndpoint = "https://graph.microsoft.com"
+
+	// maxGraphPages bounds the memberOf paging, 100 groups are returned by
+	// page
+	maxGraphPages = 100
+)
+
+// azureProvider fetches the groups of Azure AD users in too many groups to
+// be listed in the groups claim from Microsoft Graph.
+type azureProvider struct {
+	Provider       string `mapstructure:"provider"`
+	GraphEndpoint  string `mapstructure:"graph_endpoint"`
+	GroupsFailOpen bool   `mapstructure:"groups_fail_open"`
+}
+
+func (a *azureProvider) Initialize(config *oidcConfig) error {
+	if err := mapstructure.WeakDecode(config.ProviderConfig, a); err != nil {
+		return err
+	}
+
+	if a.GraphEndpoint == "" {
+		a.GraphEndpoint = defaultGraphEndpoint
+	}
+	endpoint, err := url.Parse(a.GraphEndpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return fmt.Errorf("graph_endpoint %q must be an https URL", a.GraphEndpoint)
+	}
+	a.GraphEndpoint = strings.TrimSuffix(a.GraphEndpoint, "/")
+
+	return nil
+}
+
+func (a *azureProvider) SensitiveKeys() []string {
+	return nil
+}
+
+// FetchGroups only calls Microsoft Graph when Azure AD returned the overage
+// indicator instead of the groups claim. Failures are returned as warnings
+// when groups_fail_open is set.
+func (a *azureProvider) FetchGroups(ctx context.Context, b *openIDConnectAuthBackend, allClaims map[string]interface{},
+	token *oauth2.Token) ([]string, []string, error) {
+	if !groupsOverage(allClaims, "groups") {
+		return nil, nil, nil
+	}
+
+	groups, err := a.azureGroups(ctx, b, token.AccessToken)
+	if err != nil {
+		if !a.GroupsFailOpen {
+			return nil, nil, errwrap.Wrapf("could not fetch the Azure AD groups of the user: {{err}}", err)
+		}
+		b.Logger().Warn("could not fetch the Azure AD groups of the user, logging in without groups", "error", err)
+		return []string{}, []string{"the Azure AD groups of the user could not be fetched, the login has no groups"}, nil
+	}
+
+	return groups, nil, nil
+}
+
+// groupsOverage reports whether Azure AD left the groups claim out because the
+// user is in too many groups, it is then named in _claim_names.
+func groupsOverage(allClaims map[string]interface{}, claim string) bool {
+	names, ok := allClaims["_claim_names"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	_, ok = names[claim]
+	return ok
+}
+
+// azureGroups lists the IDs of the groups the user is a direct member of, the
+// access token must allow reading them from Microsoft Graph.
+func (a *azureProvider) azureGroups(ctx context.Context, b *openIDConnectAuthBackend, accessToken string) ([]string, error) {
+	if accessToken == "" {
+		return nil, errors.New("no access token was returned by the Idp")
+	}
+
+	var groups []string
+	next := a.GraphEndpoint + "/v1.0/me/memberOf?$select=id"
+	for page := 0; next != ""; page++ {
+		if page == maxGraphPages {
+			return nil, fmt.Errorf("the user groups don't fit in %d pages", maxGraphPages)
+		}
+		// The access token is only sent to the Graph endpoint
+		if !strings.HasPrefix(next, a.GraphEndpoint+"/") {
+			return nil, fmt.Errorf("unexpected next page link %q", next)
+		}
+
+		var result struct {
+			Value []struct {
+				Type string `json:"@odata.type"`
+				ID   string `json:"id"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if _, err := b.getJSON(ctx, next, "Bearer "+accessToken, &result); err != nil {
+			return nil, err
+		}
+		for _, member := range result.Value {
+			// memberOf lists directory roles and administrative units as well
+			if member.Type == "#microsoft.graph.group" && member.ID != "" {
+				groups = append(groups, member.ID)
+			}
+		}
+		next = result.NextLink
+	}
+
+	return groups, nil
+}
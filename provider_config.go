@@ -0,0 +1,132 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"golang.org/x/oauth2"
+)
+
+// customProvider implements the Idp specific behavior selected by the
+// 'provider' key of the config provider_config.
+type customProvider interface {
+	// Initialize validates the provider_config of the config and sets up the
+	// provider
+	Initialize(config *oidcConfig) error
+
+	// FetchGroups returns the groups of the user, added to the ones of the
+	// groups claim. When not nil the groups claim may be missing. Claims
+	// fetched from the Idp may be added to allClaims before they are mapped.
+	// Warnings are returned to the user.
+	FetchGroups(ctx context.Context, b *openIDConnectAuthBackend, allClaims map[string]interface{},
+		token *oauth2.Token) (groups []string, warnings []string, err error)
+
+	// SensitiveKeys lists the provider_config keys which are not returned
+	// when the config is read
+	SensitiveKeys() []string
+}
+
+// customProviders are the supported provider_config providers.
+var customProviders = map[string]func() customProvider{
+	providerAzure:    func() customProvider { return &azureProvider{} },
+	providerGSuite:   func() customProvider { return &gsuiteProvider{} },
+	providerKeycloak: func() customProvider { return &keycloakProvider{} },
+	providerOkta:     func() customProvider { return &oktaProvider{} },
+}
+
+// newCustomProvider creates and initializes the provider selected by the
+// config provider_config, nil is returned when none is set.
+func newCustomProvider(config *oidcConfig) (customProvider, error) {
+	providerConfig := config.ProviderConfig
+	if len(providerConfig) == 0 {
+		return nil, nil
+	}
+
+	name, _ := providerConfig["provider"].(string)
+	if name == "" {
+		return nil, errors.New("provider_config must set 'provider'")
+	}
+	newProvider, ok := customProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported provider_config provider %q, supported providers are: %s", name, strings.Join(supportedProviders(), ", "))
+	}
+
+	provider := newProvider()
+	if err := provider.Initialize(config); err != nil {
+		return nil, fmt.Errorf("invalid %s provider_config: %s", name, err)
+	}
+
+	return provider, nil
+}
+
+func supportedProviders() []string {
+	names := make([]string, 0, len(customProviders))
+	for name := range customProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// redactProviderConfig returns the provider_config without the values of its
+// sensitive keys.
+func redactProviderConfig(providerConfig map[string]interface{}) map[string]interface{} {
+	name, _ := providerConfig["provider"].(string)
+	newProvider, ok := customProviders[name]
+	if !ok {
+		return providerConfig
+	}
+
+	redacted := make(map[string]interface{}, len(providerConfig))
+	for k, v := range providerConfig {
+		redacted[k] = v
+	}
+	for _, k := range newProvider().SensitiveKeys() {
+		if _, ok := redacted[k]; ok {
+			redacted[k] = "Use the secret ID endpoint to get the value"
+		}
+	}
+
+	return redacted
+}
+
+// getJSON sends a GET request to an Idp API with the Authorization header and
+// decodes the JSON response into result, the response headers are returned.
+func (b *openIDConnectAuthBackend) getJSON(ctx context.Context, endpoint, authorization string, result interface{}) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := b.httpClient(ctx).Do(req.WithContext(ctx))
+	if timeoutErr := idpTimeout(ctx, req.URL.Host+" API", err); timeoutErr != nil {
+		return nil, timeoutErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", req.URL.Host, resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, errwrap.Wrapf("could not decode the response: {{err}}", err)
+	}
+
+	return resp.Header, nil
+}
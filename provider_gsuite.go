@@ -0,0 +1,246 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/mitchellh/mapstructure"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	providerGSuite = "gsuite"
+
+	directoryEndpoint = "https://admin.googleapis.com/admin/directory/v1"
+
+	// gsuiteCacheTTL is how long the Directory API results of a user are
+	// reused, logins often come in bursts
+	gsuiteCacheTTL = time.Minute
+
+	// maxDirectoryPages bounds the paging of the group lists
+	maxDirectoryPages = 50
+)
+
+// gsuiteProvider fetches the groups and custom schema fields of Google
+// Workspace users from the Directory API, with a service account allowed to
+// impersonate an admin through domain wide delegation.
+type gsuiteProvider struct {
+	Provider              string   `mapstructure:"provider"`
+	ServiceAccount        string   `mapstructure:"gsuite_service_account"`
+	AdminImpersonate      string   `mapstructure:"gsuite_admin_impersonate"`
+	FetchGroupsEnabled    bool     `mapstructure:"fetch_groups"`
+	FetchUserInfoEnabled  bool     `mapstructure:"fetch_user_info"`
+	GroupsRecurseMaxDepth int      `mapstructure:"groups_recurse_max_depth"`
+	UserCustomSchemas     []string `mapstructure:"user_custom_schemas"`
+
+	jwtConfig *jwt.Config
+
+	// configName scopes the cached lookups to the config
+	configName string
+}
+
+func (g *gsuiteProvider) Initialize(config *oidcConfig) error {
+	g.configName = config.name
+	providerConfig := config.ProviderConfig
+	// user_custom_schemas may be written as a comma separated string
+	if schemas, ok := providerConfig["user_custom_schemas"].(string); ok {
+		copied := make(map[string]interface{}, len(providerConfig))
+		for k, v := range providerConfig {
+			copied[k] = v
+		}
+		copied["user_custom_schemas"] = strings.Split(schemas, ",")
+		providerConfig = copied
+	}
+	if err := mapstructure.WeakDecode(providerConfig, g); err != nil {
+		return err
+	}
+
+	if g.AdminImpersonate == "" {
+		return errors.New("gsuite_admin_impersonate must be set")
+	}
+	if g.GroupsRecurseMaxDepth < 0 {
+		return errors.New("groups_recurse_max_depth can't be negative")
+	}
+	schemas := g.UserCustomSchemas[:0]
+	for _, schema := range g.UserCustomSchemas {
+		if schema = strings.TrimSpace(schema); schema != "" {
+			schemas = append(schemas, schema)
+		}
+	}
+	g.UserCustomSchemas = schemas
+	if g.FetchUserInfoEnabled && len(g.UserCustomSchemas) == 0 {
+		return errors.New("user_custom_schemas must be set with fetch_user_info")
+	}
+
+	// Without a service account key the default credentials are used, they
+	// must be a service account key as well to impersonate the admin
+	keyJSON := []byte(g.ServiceAccount)
+	if len(keyJSON) == 0 {
+		creds, err := google.FindDefaultCredentials(context.Background())
+		if err != nil {
+			return errwrap.Wrapf("gsuite_service_account is not set and no default credentials were found: {{err}}", err)
+		}
+		if len(creds.JSON) == 0 {
+			return errors.New("gsuite_service_account is not set and the default credentials can't impersonate an admin")
+		}
+		keyJSON = creds.JSON
+	}
+	jwtConfig, err := google.JWTConfigFromJSON(keyJSON,
+		"https://www.googleapis.com/auth/admin.directory.group.readonly",
+		"https://www.googleapis.com/auth/admin.directory.user.readonly")
+	if err != nil {
+		return errwrap.Wrapf("invalid gsuite_service_account: {{err}}", err)
+	}
+	jwtConfig.Subject = g.AdminImpersonate
+	g.jwtConfig = jwtConfig
+
+	return nil
+}
+
+func (g *gsuiteProvider) SensitiveKeys() []string {
+	return []string{"gsuite_service_account"}
+}
+
+// FetchGroups returns the email addresses of the groups of the user, and adds
+// the fields of the custom schemas as claims named after the schema, which
+// can then be mapped with claim_mappings.
+func (g *gsuiteProvider) FetchGroups(ctx context.Context, b *openIDConnectAuthBackend, allClaims map[string]interface{},
+	token *oauth2.Token) ([]string, []string, error) {
+	if !g.FetchGroupsEnabled && !g.FetchUserInfoEnabled {
+		return nil, nil, nil
+	}
+
+	userKey, _ := allClaims["sub"].(string)
+	if userKey == "" {
+		return nil, nil, errors.New("the ID token has no subject to look the Google Workspace user up")
+	}
+
+	directoryToken, err := g.jwtConfig.TokenSource(b.clientContext(ctx)).Token()
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("could not authenticate to the Directory API: {{err}}", err)
+	}
+
+	if g.FetchUserInfoEnabled {
+		schemas, err := g.customSchemas(ctx, b, directoryToken.AccessToken, userKey)
+		if err != nil {
+			return nil, nil, errwrap.Wrapf("could not fetch the Google Workspace user custom schemas: {{err}}", err)
+		}
+		for schema, fields := range schemas {
+			allClaims[schema] = fields
+		}
+	}
+
+	if !g.FetchGroupsEnabled {
+		return nil, nil, nil
+	}
+	groups, err := g.groups(ctx, b, directoryToken.AccessToken, userKey)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("could not fetch the Google Workspace groups of the user: {{err}}", err)
+	}
+
+	return groups, nil, nil
+}
+
+// groups lists the groups the user is a member of, and the groups those are
+// members of up to groups_recurse_max_depth levels.
+func (g *gsuiteProvider) groups(ctx context.Context, b *openIDConnectAuthBackend, accessToken, userKey string) ([]string, error) {
+	cacheKey := providerCacheKey(g.configName, fmt.Sprintf("%s/groups/%d/%s", providerGSuite, g.GroupsRecurseMaxDepth, userKey))
+	if cached, ok := b.providerCache.Get(cacheKey); ok {
+		return cached.([]string), nil
+	}
+
+	groups := []string{}
+	seen := make(map[string]bool)
+	members := []string{userKey}
+	for depth := 0; depth <= g.GroupsRecurseMaxDepth && len(members) > 0; depth++ {
+		var next []string
+		for _, member := range members {
+			memberGroups, err := g.memberGroups(ctx, b, accessToken, member)
+			if err != nil {
+				return nil, err
+			}
+			for _, group := range memberGroups {
+				if seen[group] {
+					continue
+				}
+				seen[group] = true
+				groups = append(groups, group)
+				next = append(next, group)
+			}
+		}
+		members = next
+	}
+
+	b.providerCache.Set(cacheKey, groups, gsuiteCacheTTL)
+	return groups, nil
+}
+
+// memberGroups lists the email addresses of the groups the user or group is a
+// direct member of.
+func (g *gsuiteProvider) memberGroups(ctx context.Context, b *openIDConnectAuthBackend, accessToken, userKey string) ([]string, error) {
+	var groups []string
+	pageToken := ""
+	for page := 0; ; page++ {
+		if page == maxDirectoryPages {
+			return nil, fmt.Errorf("the groups of %q don't fit in %d pages", userKey, maxDirectoryPages)
+		}
+
+		query := url.Values{
+			"userKey":    {userKey},
+			"maxResults": {"200"},
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		var result struct {
+			Groups []struct {
+				Email string `json:"email"`
+			} `json:"groups"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if _, err := b.getJSON(ctx, directoryEndpoint+"/groups?"+query.Encode(), "Bearer "+accessToken, &result); err != nil {
+			return nil, err
+		}
+		for _, group := range result.Groups {
+			if group.Email != "" {
+				groups = append(groups, group.Email)
+			}
+		}
+
+		if pageToken = result.NextPageToken; pageToken == "" {
+			return groups, nil
+		}
+	}
+}
+
+// customSchemas returns the fields of the user_custom_schemas by schema.
+func (g *gsuiteProvider) customSchemas(ctx context.Context, b *openIDConnectAuthBackend, accessToken, userKey string) (map[string]interface{}, error) {
+	cacheKey := providerCacheKey(g.configName, fmt.Sprintf("%s/schemas/%s/%s", providerGSuite, strings.Join(g.UserCustomSchemas, ","), userKey))
+	if cached, ok := b.providerCache.Get(cacheKey); ok {
+		return cached.(map[string]interface{}), nil
+	}
+
+	query := url.Values{
+		"projection":      {"custom"},
+		"customFieldMask": {strings.Join(g.UserCustomSchemas, ",")},
+	}
+	var user struct {
+		CustomSchemas map[string]interface{} `json:"customSchemas"`
+	}
+	if _, err := b.getJSON(ctx, directoryEndpoint+"/users/"+url.PathEscape(userKey)+"?"+query.Encode(), "Bearer "+accessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.CustomSchemas == nil {
+		user.CustomSchemas = make(map[string]interface{})
+	}
+
+	b.providerCache.Set(cacheKey, user.CustomSchemas, gsuiteCacheTTL)
+	return user.CustomSchemas, nil
+}
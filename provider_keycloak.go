@@ -0,0 +1,69 @@
+package oidc
+
+import (
+	"context"
+
+	"github.com/mitchellh/mapstructure"
+	"golang.org/x/oauth2"
+)
+
+const providerKeycloak = "keycloak"
+
+// keycloakProvider adds the Keycloak realm roles and the roles of a client,
+// read from the realm_access and resource_access claims, to the groups.
+type keycloakProvider struct {
+	Provider          string `mapstructure:"provider"`
+	ClientID          string `mapstructure:"client_id"`
+	RealmRolesPrefix  string `mapstructure:"realm_roles_prefix"`
+	ClientRolesPrefix string `mapstructure:"client_roles_prefix"`
+}
+
+// Initialize defaults the client the roles are read for to the config
+// client_id.
+func (k *keycloakProvider) Initialize(config *oidcConfig) error {
+	if err := mapstructure.WeakDecode(config.ProviderConfig, k); err != nil {
+		return err
+	}
+	if k.ClientID == "" {
+		k.ClientID = config.ClientID
+	}
+
+	return nil
+}
+
+func (k *keycloakProvider) SensitiveKeys() []string {
+	return nil
+}
+
+// FetchGroups doesn't call Keycloak, the roles are in the token claims. Roles
+// are prefixed with realm_roles_prefix and client_roles_prefix, e.g. 'realm:'
+// and 'client:', so that realm and client roles with the same name differ.
+func (k *keycloakProvider) FetchGroups(ctx context.Context, b *openIDConnectAuthBackend, allClaims map[string]interface{},
+	token *oauth2.Token) ([]string, []string, error) {
+	groups := []string{}
+
+	if realmAccess, ok := allClaims["realm_access"].(map[string]interface{}); ok {
+		groups = append(groups, keycloakRoles(realmAccess, k.RealmRolesPrefix)...)
+	}
+	if resourceAccess, ok := allClaims["resource_access"].(map[string]interface{}); ok {
+		if clientAccess, ok := resourceAccess[k.ClientID].(map[string]interface{}); ok {
+			groups = append(groups, keycloakRoles(clientAccess, k.ClientRolesPrefix)...)
+		}
+	}
+
+	return groups, nil, nil
+}
+
+// keycloakRoles returns the prefixed roles of a realm_access or
+// resource_access entry.
+func keycloakRoles(access map[string]interface{}, prefix string) []string {
+	list, _ := access["roles"].([]interface{})
+	roles := make([]string, 0, len(list))
+	for _, item := range list {
+		if role, ok := item.(string); ok && role != "" {
+			roles = append(roles, prefix+role)
+		}
+	}
+
+	return roles
+}
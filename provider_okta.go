@@ -0,0 +1,224 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/mitchellh/mapstructure"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	providerOkta = "okta"
+
+	// oktaGroupsClaimCap is the number of groups after which Okta truncates
+	// the groups claim
+	oktaGroupsClaimCap = 100
+
+	// maxOktaPages bounds the paging of the user groups
+	maxOktaPages = 50
+)
+
+var linkNextRe = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// oktaProvider fetches the groups of the user from the Okta API when the
+// groups claim is missing or truncated. It authenticates with an API token,
+// or with OAuth for Okta using a service app and its private key.
+type oktaProvider struct {
+	Provider       string `mapstructure:"provider"`
+	OrgURL         string `mapstructure:"org_url"`
+	APIToken       string `mapstructure:"api_token"`
+	ClientID       string `mapstructure:"client_id"`
+	PrivateKey     string `mapstructure:"private_key"`
+	GroupsClaim    string `mapstructure:"groups_claim"`
+	GroupsFailOpen bool   `mapstructure:"groups_fail_open"`
+
+	privateKey *rsa.PrivateKey
+}
+
+func (o *oktaProvider) Initialize(config *oidcConfig) error {
+	if err := mapstructure.WeakDecode(config.ProviderConfig, o); err != nil {
+		return err
+	}
+
+	orgURL, err := url.Parse(o.OrgURL)
+	if err != nil || orgURL.Scheme != "https" || orgURL.Host == "" {
+		return fmt.Errorf("org_url %q must be an https URL", o.OrgURL)
+	}
+	o.OrgURL = strings.TrimSuffix(o.OrgURL, "/")
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = "groups"
+	}
+
+	switch {
+	case o.APIToken != "" && (o.ClientID != "" || o.PrivateKey != ""):
+		return errors.New("api_token can't be set along with client_id and private_key")
+	case o.APIToken != "":
+	case o.ClientID != "" && o.PrivateKey != "":
+		block, _ := pem.Decode([]byte(strings.TrimSpace(o.PrivateKey)))
+		if block == nil {
+			return errors.New("private_key is not PEM encoded")
+		}
+		if o.privateKey, err = parseRSAPrivateKey(block.Bytes); err != nil {
+			return errwrap.Wrapf("invalid private_key: {{err}}", err)
+		}
+	default:
+		return errors.New("either api_token or client_id and private_key must be set")
+	}
+
+	return nil
+}
+
+func (o *oktaProvider) SensitiveKeys() []string {
+	return []string{"api_token", "private_key"}
+}
+
+// FetchGroups calls the Okta API only when the groups claim is missing or has
+// as many groups as Okta puts in the claim at most.
+func (o *oktaProvider) FetchGroups(ctx context.Context, b *openIDConnectAuthBackend, allClaims map[string]interface{},
+	token *oauth2.Token) ([]string, []string, error) {
+	claimGroups, _ := getClaim(allClaims, o.GroupsClaim)
+	if list, ok := claimGroups.([]interface{}); ok && len(list) < oktaGroupsClaimCap {
+		return nil, nil, nil
+	}
+
+	groups, err := o.userGroups(ctx, b, allClaims)
+	if err != nil {
+		if !o.GroupsFailOpen {
+			return nil, nil, errwrap.Wrapf("could not fetch the Okta groups of the user: {{err}}", err)
+		}
+		b.Logger().Warn("could not fetch the Okta groups of the user, logging in with the groups claim only", "error", err)
+		return nil, []string{"the Okta groups of the user could not be fetched, only the groups of the token were used"}, nil
+	}
+
+	return groups, nil, nil
+}
+
+// userGroups lists the names of the groups of the user following the Link
+// header pagination.
+func (o *oktaProvider) userGroups(ctx context.Context, b *openIDConnectAuthBackend, allClaims map[string]interface{}) ([]string, error) {
+	userID, _ := allClaims["sub"].(string)
+	if userID == "" {
+		return nil, errors.New("the ID token has no subject to look the Okta user up")
+	}
+
+	authorization, err := o.authorization(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []string{}
+	next := o.OrgURL + "/api/v1/users/" + url.PathEscape(userID) + "/groups?limit=200"
+	for page := 0; next != ""; page++ {
+		if page == maxOktaPages {
+			return nil, fmt.Errorf("the user groups don't fit in %d pages", maxOktaPages)
+		}
+		// The credentials are only sent to the Okta org
+		if !strings.HasPrefix(next, o.OrgURL+"/") {
+			return nil, fmt.Errorf("unexpected next page link %q", next)
+		}
+
+		var result []struct {
+			Profile struct {
+				Name string `json:"name"`
+			} `json:"profile"`
+		}
+		header, err := b.getJSON(ctx, next, authorization, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range result {
+			if group.Profile.Name != "" {
+				groups = append(groups, group.Profile.Name)
+			}
+		}
+
+		next = ""
+		for _, link := range header["Link"] {
+			if match := linkNextRe.FindStringSubmatch(link); match != nil {
+				next = match[1]
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// authorization returns the Authorization header of the Okta API requests.
+// With OAuth for Okta an access token is requested with a client assertion
+// signed by the private key.
+func (o *oktaProvider) authorization(ctx context.Context, b *openIDConnectAuthBackend) (string, error) {
+	if o.APIToken != "" {
+		return "SSWS " + o.APIToken, nil
+	}
+
+	tokenURL := o.OrgURL + "/oauth2/v1/token"
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: o.privateKey}, nil)
+	if err != nil {
+		return "", err
+	}
+	jti, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	assertion, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   o.ClientID,
+		Subject:  o.ClientID,
+		Audience: jwt.Audience{tokenURL},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		ID:       jti,
+	}).CompactSerialize()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"scope":                 {"okta.users.read okta.groups.read"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	}
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if _, err := postForm(ctx, b.httpClient(ctx), tokenURL, form, &tokenResp); err != nil {
+		return "", errwrap.Wrapf("could not get an Okta API access token: {{err}}", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", errors.New("the Okta token response has no access token")
+	}
+
+	return "Bearer " + tokenResp.AccessToken, nil
+}
+
+// parseRSAPrivateKey decodes PKCS#1 and PKCS#8 RSA private keys.
+func parseRSAPrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,326 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const testIssuer = "https://issuer.example.com"
+
+// testKey is a signing key of the fixtures, with its key ID in the key sets.
+type testKey struct {
+	alg     jose.SignatureAlgorithm
+	kid     string
+	private interface{}
+	public  interface{}
+}
+
+// testKeys returns a key of each supported key type and curve.
+func testKeys(t *testing.T) []testKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []testKey{
+		{alg: jose.RS256, kid: "rsa", private: rsaKey, public: &rsaKey.PublicKey},
+		{alg: jose.PS256, kid: "rsa-pss", private: rsaKey, public: &rsaKey.PublicKey},
+	}
+
+	for _, ec := range []struct {
+		alg   jose.SignatureAlgorithm
+		kid   string
+		curve elliptic.Curve
+	}{
+		{jose.ES256, "p256", elliptic.P256()},
+		{jose.ES384, "p384", elliptic.P384()},
+		{jose.ES512, "p521", elliptic.P521()},
+	} {
+		key, err := ecdsa.GenerateKey(ec.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, testKey{alg: ec.alg, kid: ec.kid, private: key, public: &key.PublicKey})
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, testKey{alg: jose.EdDSA, kid: "ed25519", private: private, public: public})
+
+	return keys
+}
+
+// sign returns a token for testClientID signed by the key, with the given key
+// ID in its header.
+func (k testKey) sign(t *testing.T, issuer, kid string) string {
+	return signToken(t, jose.SigningKey{
+		Algorithm: k.alg,
+		Key:       jose.JSONWebKey{Key: k.private, KeyID: kid},
+	}, map[string]interface{}{
+		"iss": issuer,
+		"aud": testClientID,
+		"sub": "user-" + k.kid,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+}
+
+func (k testKey) pem(t *testing.T) string {
+	der, err := x509.MarshalPKIXPublicKey(k.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// newKeySetServer serves a discovery document and a key set with all the
+// keys, the RSA PSS fixture shares the key of the RSA one.
+func newKeySetServer(keys []testKey) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		algs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			algs = append(algs, string(k.alg))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                server.URL,
+			"authorization_endpoint":                server.URL + "/auth",
+			"token_endpoint":                        server.URL + "/token",
+			"jwks_uri":                              server.URL + "/keys",
+			"id_token_signing_alg_values_supported": algs,
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		set := jose.JSONWebKeySet{}
+		for _, k := range keys {
+			set.Keys = append(set.Keys, jose.JSONWebKey{Key: k.public, KeyID: k.kid, Algorithm: string(k.alg), Use: "sig"})
+		}
+		writeJSON(w, http.StatusOK, set)
+	})
+	server = httptest.NewServer(mux)
+
+	return server
+}
+
+func testProvider(t *testing.T, b *openIDConnectAuthBackend, config *oidcConfig) *oidcProvider {
+	client, err := createHTTPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := b.createProvider(config, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestVerifyToken_StaticKeys(t *testing.T) {
+	b, _ := getBackend(t)
+	keys := testKeys(t)
+
+	var pemKeys []string
+	for _, k := range keys {
+		pemKeys = append(pemKeys, k.pem(t))
+	}
+	config := &oidcConfig{
+		ClientID:             testClientID,
+		BoundIssuer:          testIssuer,
+		JWTValidationPubKeys: pemKeys,
+	}
+	provider := testProvider(t, b, config)
+
+	for _, k := range keys {
+		t.Run(string(k.alg), func(t *testing.T) {
+			idToken, err := b.verifyToken(context.Background(), config, provider, false, k.sign(t, testIssuer, ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if idToken.Subject != "user-"+k.kid {
+				t.Fatalf("unexpected subject %q", idToken.Subject)
+			}
+		})
+	}
+
+	// Tokens signed by another key of the same type are rejected
+	for _, k := range testKeys(t) {
+		t.Run(string(k.alg)+" unknown key", func(t *testing.T) {
+			if _, err := b.verifyToken(context.Background(), config, provider, false, k.sign(t, testIssuer, "")); err == nil {
+				t.Fatal("expected a token signed by an unknown key to be rejected")
+			}
+		})
+	}
+}
+
+func TestVerifyToken_SupportedSigningAlgs(t *testing.T) {
+	b, _ := getBackend(t)
+	keys := testKeys(t)
+
+	var pemKeys []string
+	for _, k := range keys {
+		pemKeys = append(pemKeys, k.pem(t))
+	}
+	config := &oidcConfig{
+		ClientID:             testClientID,
+		BoundIssuer:          testIssuer,
+		JWTValidationPubKeys: pemKeys,
+		SupportedSigningAlgs: []string{"ES256", "EdDSA"},
+	}
+	provider := testProvider(t, b, config)
+
+	for _, k := range keys {
+		t.Run(string(k.alg), func(t *testing.T) {
+			_, err := b.verifyToken(context.Background(), config, provider, false, k.sign(t, testIssuer, ""))
+			allowed := k.alg == jose.ES256 || k.alg == jose.EdDSA
+			if allowed != (err == nil) {
+				t.Fatalf("expected allowed %t, got error %v", allowed, err)
+			}
+		})
+	}
+}
+
+// TestVerifyToken_MixedKeySet checks the key of a token is selected by its key
+// ID in a key set with keys of every type, both with discovery and a static
+// jwks_url.
+func TestVerifyToken_MixedKeySet(t *testing.T) {
+	b, _ := getBackend(t)
+	keys := testKeys(t)
+	server := newKeySetServer(keys)
+	defer server.Close()
+
+	configs := map[string]*oidcConfig{
+		"discovery": {
+			ClientID:        testClientID,
+			OIDCProviderURL: server.URL,
+		},
+		"jwks_url": {
+			ClientID:    testClientID,
+			BoundIssuer: server.URL,
+			JWKSURL:     server.URL + "/keys",
+		},
+	}
+
+	for name, config := range configs {
+		provider := testProvider(t, b, config)
+		if name == "discovery" && len(provider.signingAlgs) != len(keys) {
+			t.Fatalf("expected the discovered algorithms to include every key type, got %#v", provider.signingAlgs)
+		}
+
+		for _, k := range keys {
+			t.Run(name+"/"+string(k.alg), func(t *testing.T) {
+				token := k.sign(t, server.URL, k.kid)
+				idToken, err := b.verifyToken(context.Background(), config, provider, false, token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if idToken.Subject != "user-"+k.kid {
+					t.Fatalf("unexpected subject %q", idToken.Subject)
+				}
+
+				// Tokens without a key ID are checked against every key
+				if _, err := b.verifyToken(context.Background(), config, provider, false, k.sign(t, server.URL, "")); err != nil {
+					t.Fatalf("token without a key ID was rejected: %v", err)
+				}
+			})
+		}
+	}
+
+	// A token naming another key, or an unknown one, is rejected even though
+	// its signing key is in the set
+	config := configs["jwks_url"]
+	provider := testProvider(t, b, config)
+	for _, kid := range []string{"p384", "ed25519", "unknown"} {
+		t.Run("key ID "+kid, func(t *testing.T) {
+			token := keys[2].sign(t, server.URL, kid)
+			if _, err := b.verifyToken(context.Background(), config, provider, false, token); err == nil {
+				t.Fatalf("expected a %s token with key ID %q to be rejected", keys[2].alg, kid)
+			}
+		})
+	}
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+	}, &certKey.PublicKey, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224DER, err := x509.MarshalPKIXPublicKey(&p224Key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(blockType string, der []byte) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+	}
+
+	tests := []struct {
+		name    string
+		pem     string
+		wantErr string
+	}{
+		{name: "PKCS1 RSA", pem: encode("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey))},
+		{name: "certificate", pem: encode("CERTIFICATE", certDER)},
+		{name: "indented", pem: "\n  " + testKeys(t)[2].pem(t) + "\n"},
+		{name: "P-224", pem: encode("PUBLIC KEY", p224DER), wantErr: "unsupported elliptic curve"},
+		{name: "private key", pem: encode("EC PRIVATE KEY", []byte("key")), wantErr: "unsupported PEM type"},
+		{name: "not PEM", pem: "not a key", wantErr: "not PEM encoded"},
+	}
+	for _, k := range testKeys(t) {
+		tests = append(tests, struct {
+			name    string
+			pem     string
+			wantErr string
+		}{name: string(k.alg), pem: k.pem(t)})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parsePublicKeys([]string{tt.pem})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil || len(keys) != 1 {
+				t.Fatalf("unexpected result %#v: %v", keys, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package oidc
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/time/rate"
+)
+
+// allowExchange reports whether a request to the Idp token endpoint on behalf
+// of the given source is allowed by the exchange rate limit. Each source has
+// its own token bucket, buckets of idle sources expire from the cache.
+func (b *openIDConnectAuthBackend) allowExchange(config *oidcConfig, source string) bool {
+	if config.ExchangeRateLimit <= 0 {
+		return true
+	}
+
+	if cached, ok := b.exchangeLimiters.Get(source); ok {
+		return cached.(*rate.Limiter).Allow()
+	}
+
+	burst := config.ExchangeRateBurst
+	if burst <= 0 {
+		burst = config.ExchangeRateLimit
+	}
+	limiter := rate.NewLimiter(rate.Limit(config.ExchangeRateLimit), burst)
+	// Add fails when another request created the bucket meanwhile
+	if err := b.exchangeLimiters.Add(source, limiter, cache.DefaultExpiration); err != nil {
+		if cached, ok := b.exchangeLimiters.Get(source); ok {
+			limiter = cached.(*rate.Limiter)
+		}
+	}
+
+	return limiter.Allow()
+}
+
+// requestSource returns the IP address of the client, the fallback is used for
+// requests without connection information.
+func requestSource(req *logical.Request, fallback string) string {
+	if req.Connection == nil || req.Connection.RemoteAddr == "" {
+		return fallback
+	}
+	if host, _, err := net.SplitHostPort(req.Connection.RemoteAddr); err == nil {
+		return host
+	}
+	return req.Connection.RemoteAddr
+}
+
+// rateLimitedResponse is returned with status 429 when the exchange rate
+// limit is exceeded.
+func rateLimitedResponse(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	loginMetricsFrom(ctx).fail(reasonRateLimited)
+	return logical.RespondWithStatusCode(logical.ErrorResponse("too many login attempts, retry later"), req, http.StatusTooManyRequests)
+}
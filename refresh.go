@@ -0,0 +1,141 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"golang.org/x/oauth2"
+)
+
+// errRefreshDenied is returned by refreshClaims when the refreshed claims no
+// longer match the token, renewal must then be denied whatever the config.
+var errRefreshDenied = errors.New("refresh denied")
+
+// refreshClaims uses the refresh token stored at login to refresh the Idp
+// session and maps the claims again. The renewal is denied with an error
+// response when the user, the claim policies or the groups changed since
+// login. The returned refresh token replaces the stored one.
+func (b *openIDConnectAuthBackend) refreshClaims(ctx context.Context, s logical.Storage, config *oidcConfig,
+	role *oidcRole, auth *logical.Auth, refreshToken string) (string, *logical.Response, error) {
+	claimsConfig, err := b.claimsConfig(ctx, s)
+	if err != nil {
+		return "", nil, err
+	}
+	if claimsConfig == nil {
+		return "", nil, errors.New("could not load OIDC Mapping configuration")
+	}
+	provider, err := b.getProvider(ctx, config)
+	if err != nil {
+		return "", nil, errwrap.Wrapf("error getting provider for renew operation: {{err}}", err)
+	}
+	ctx = provider.clientContext(ctx)
+
+	oauthConfig := config.config2OauthConfig(provider)
+	refreshCtx, cancel := idpContext(ctx, config)
+	defer cancel()
+	token, err := oauthConfig.TokenSource(b.clientContext(refreshCtx), &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if timeoutErr := idpTimeout(refreshCtx, "token refresh", err); timeoutErr != nil {
+		return "", nil, timeoutErr
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to refresh the Idp session: %s", sanitizeError(err))
+	}
+
+	// The refresh response may have no ID token, the claims then come from
+	// UserInfo only and its subject is checked against the login one
+	var idTokenClaims, userInfoClaims map[string]interface{}
+	subject, _ := auth.InternalData["subject"].(string)
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken != "" {
+		idToken, err := b.verifyToken(ctx, config, provider, false, rawIDToken)
+		if err != nil {
+			return "", nil, errwrap.Wrapf("failed to verify the refreshed ID token: {{err}}", err)
+		}
+		if err := idToken.Claims(&idTokenClaims); err != nil {
+			return "", nil, errwrap.Wrapf("failed to decode claims: {{err}}", err)
+		}
+		subject = idToken.Subject
+	}
+	if provider.SupportsUserInfo() && !config.SkipUserInfo && token.AccessToken != "" {
+		userInfoCtx, cancel := idpContext(ctx, config)
+		defer cancel()
+		body, contentType, err := provider.UserInfo(userInfoCtx, provider.client, token.AccessToken)
+		if timeoutErr := idpTimeout(userInfoCtx, "UserInfo", err); timeoutErr != nil {
+			return "", nil, timeoutErr
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to refresh the UserInfo claims: %s", sanitizeError(err))
+		}
+		if userInfoClaims, err = b.decodeUserInfo(ctx, config, provider, contentType, body, subject); err != nil {
+			return "", nil, err
+		}
+	}
+	if idTokenClaims == nil && userInfoClaims == nil {
+		return "", nil, errors.New("the refresh returned neither an ID token nor UserInfo claims")
+	}
+	allClaims := claimsConfig.mergeClaims(idTokenClaims, userInfoClaims)
+
+	var providerGroups []string
+	custom, err := newCustomProvider(config)
+	if err != nil {
+		return "", nil, err
+	}
+	if custom != nil {
+		if providerGroups, _, err = custom.FetchGroups(ctx, b, allClaims, token); err != nil {
+			return "", nil, err
+		}
+	}
+
+	b.logClaims(config, allClaims)
+	userData, err := claimsConfig.parseClaims(allClaims, providerGroups)
+	if err != nil {
+		return "", logical.ErrorResponse(fmt.Sprintf("claims no longer map to a user, renewal is not allowed: %s", err)), errRefreshDenied
+	}
+
+	if userData.Username != auth.Metadata["username"] {
+		return "", logical.ErrorResponse("the refreshed claims belong to another user, renewal is not allowed"), errRefreshDenied
+	}
+	if err := validateBoundClaims(claimsConfig.BoundClaims, claimsConfig.BoundClaimsType, allClaims); err != nil {
+		return "", logical.ErrorResponse(fmt.Sprintf("bound claims no longer match, renewal is not allowed: %s", err)), errRefreshDenied
+	}
+	if role != nil {
+		if err := validateBoundClaims(role.BoundClaims, role.BoundClaimsType, allClaims); err != nil {
+			return "", logical.ErrorResponse(fmt.Sprintf("role bound claims no longer match, renewal is not allowed: %s", err)), errRefreshDenied
+		}
+	}
+	if !policyutil.EquivalentPolicies(userData.Policies, internalStrings(auth.InternalData["claim_policies"])) {
+		return "", logical.ErrorResponse("claim policies have changed since login, renewal is not allowed"), errRefreshDenied
+	}
+	if !sameStrings(userData.Groups, internalStrings(auth.InternalData["groups"])) {
+		return "", logical.ErrorResponse("group memberships have changed since login, renewal is not allowed"), errRefreshDenied
+	}
+
+	// Idps rotating the refresh tokens return a new one
+	if token.RefreshToken != "" {
+		refreshToken = token.RefreshToken
+	}
+
+	return refreshToken, nil, nil
+}
+
+// sameStrings reports whether both lists hold the same values, ignoring order
+// and duplicates.
+func sameStrings(a, b []string) bool {
+	a = strutil.RemoveDuplicates(append([]string{}, a...), false)
+	b = strutil.RemoveDuplicates(append([]string{}, b...), false)
+	if len(a) != len(b) {
+		return false
+	}
+	for _, value := range a {
+		if !strutil.StrListContains(b, value) {
+			return false
+		}
+	}
+
+	return true
+}
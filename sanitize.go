@@ -0,0 +1,93 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// maxErrorDescriptionLength bounds the Idp error descriptions returned to
+	// clients
+	maxErrorDescriptionLength = 256
+
+	// maxErrorMessageLength bounds any other error message
+	maxErrorMessageLength = 512
+)
+
+var (
+	// jwtRe matches JWTs and other dot separated base64url tokens
+	jwtRe = regexp.MustCompile(`[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]*`)
+
+	// secretParamRe matches the secret values of form encoded, query and
+	// JSON bodies
+	secretParamRe = regexp.MustCompile(`(?i)("?(?:code|id_token|access_token|refresh_token|client_secret|code_verifier)"?\s*[=:]\s*"?)[^"&\s,}]+`)
+)
+
+// sanitizeError returns a summary of the errors of the oauth2 and go-oidc
+// libraries which is safe to return to clients and to be audited. Idp error
+// responses are reduced to their status, OAuth error code and description,
+// and the values of codes and tokens are removed from any message.
+func sanitizeError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if retrieveErr, ok := err.(*oauth2.RetrieveError); ok {
+		return sanitizeRetrieveError(retrieveErr)
+	}
+
+	return truncate(scrubSecrets(err.Error()), maxErrorMessageLength)
+}
+
+func sanitizeRetrieveError(err *oauth2.RetrieveError) string {
+	summary := "the Idp returned an error"
+	if err.Response != nil {
+		summary = fmt.Sprintf("the Idp returned status %d", err.Response.StatusCode)
+	}
+
+	var body struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if json.Unmarshal(err.Body, &body) != nil || body.Error == "" {
+		return summary
+	}
+
+	summary = fmt.Sprintf("%s with error %q", summary, truncate(scrubSecrets(body.Error), maxErrorDescriptionLength))
+	if body.Description != "" {
+		summary = fmt.Sprintf("%s: %s", summary, sanitizeDescription(body.Description))
+	}
+
+	return summary
+}
+
+// scrubSecrets removes the codes and tokens from the message.
+func scrubSecrets(message string) string {
+	message = secretParamRe.ReplaceAllString(message, "${1}<redacted>")
+	return jwtRe.ReplaceAllString(message, "<redacted>")
+}
+
+// sanitizeDescription returns an error description of the Idp which is safe to
+// return to clients, without secrets nor control characters.
+func sanitizeDescription(desc string) string {
+	desc = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return ' '
+		}
+		return r
+	}, desc)
+	return truncate(scrubSecrets(desc), maxErrorDescriptionLength)
+}
+
+func truncate(s string, length int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= length {
+		return s
+	}
+	return s[:length] + "..."
+}
@@ -0,0 +1,163 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// storageVersion is the version of the stored configs, claims config and
+// roles. Entries written before it was added have version 0, they are
+// upgraded when first read and written back in place.
+const storageVersion = 1
+
+// checkStorageVersion fails on entries written by a newer release of the
+// plugin, which this release would otherwise misread and overwrite.
+func checkStorageVersion(key string, version int) error {
+	if version > storageVersion {
+		return fmt.Errorf("%q has storage version %d but this release of the plugin supports up to version %d, downgrading the plugin is not supported", key, version, storageVersion)
+	}
+	return nil
+}
+
+// upgrade upgrades a config read from storage, it reports whether the config
+// changed. Version 0 configs may predate the defaults set by config writes.
+func (c *oidcConfig) upgrade() (bool, error) {
+	if err := checkStorageVersion(configPath, c.Version); err != nil {
+		return false, err
+	}
+	if c.Version == storageVersion {
+		return false, nil
+	}
+
+	if c.OIDCResponseMode == "" {
+		c.OIDCResponseMode = responseModeQuery
+	}
+	if len(c.OIDCResponseTypes) == 0 {
+		c.OIDCResponseTypes = []string{"code"}
+	}
+	// Configs written before clock_skew_leeway keep the default drift
+	if c.ClockSkewLeeway == 0 {
+		c.ClockSkewLeeway = defaultClockSkewLeeway
+	}
+
+	c.Version = storageVersion
+	return true, nil
+}
+
+// upgrade upgrades a claims config read from storage, it reports whether the
+// claims config changed.
+func (c *oidcClaimsConfig) upgrade() (bool, error) {
+	if err := checkStorageVersion(claimsConfigPath, c.Version); err != nil {
+		return false, err
+	}
+	if c.Version == storageVersion {
+		return false, nil
+	}
+
+	if c.GroupsDelimiter == "" {
+		c.GroupsDelimiter = ","
+	}
+	if c.GroupsClaimSource == "" {
+		c.GroupsClaimSource = groupsSourceUserInfo
+	}
+	if c.GroupsNormalizeCase == "" {
+		c.GroupsNormalizeCase = groupsCaseNone
+	}
+	if c.DisplayNameClaim == "" {
+		c.DisplayNameClaim = c.UserClaim
+	}
+	if c.PoliciesDelimiter == "" {
+		c.PoliciesDelimiter = ","
+	}
+	if c.PoliciesClaimMode == "" {
+		c.PoliciesClaimMode = policiesClaimMerge
+	}
+	if c.BoundClaimsType == "" {
+		c.BoundClaimsType = boundClaimsString
+	}
+	if c.MaxMetadataKeys <= 0 {
+		c.MaxMetadataKeys = defaultMaxMetadataKeys
+	}
+	if c.MaxMetadataValueLength <= 0 {
+		c.MaxMetadataValueLength = maxMetadataValueLength
+	}
+	if c.MaxMetadataBytes <= 0 {
+		c.MaxMetadataBytes = defaultMaxMetadataBytes
+	}
+
+	c.Version = storageVersion
+	return true, nil
+}
+
+// upgrade upgrades a role read from storage, it reports whether the role
+// changed.
+func (r *oidcRole) upgrade(key string) (bool, error) {
+	if err := checkStorageVersion(key, r.Version); err != nil {
+		return false, err
+	}
+	if r.Version == storageVersion {
+		return false, nil
+	}
+
+	if r.BoundClaimsType == "" {
+		r.BoundClaimsType = boundClaimsString
+	}
+
+	r.Version = storageVersion
+	return true, nil
+}
+
+// storeUpgraded writes an upgraded entry back in place. Nodes which can't
+// write, such as performance standbys, keep using the upgraded entry read and
+// leave the stored one to the active node.
+func (b *openIDConnectAuthBackend) storeUpgraded(ctx context.Context, s logical.Storage, key string, upgraded interface{}) {
+	entry, err := logical.StorageEntryJSON(key, upgraded)
+	if err == nil {
+		err = s.Put(ctx, entry)
+	}
+	if err != nil {
+		b.Logger().Warn("failed to store upgraded entry", "key", key, "error", err)
+		return
+	}
+	b.Logger().Info("upgraded stored entry", "key", key, "version", storageVersion)
+}
+
+// upgradeStorage reads, and so upgrades, every versioned entry. It runs once
+// from the periodic function of the active node, the plugin API has no hook
+// to run it when the backend is mounted.
+func (b *openIDConnectAuthBackend) upgradeStorage(ctx context.Context, s logical.Storage) error {
+	if atomic.LoadUint32(&b.storageUpgraded) == 1 {
+		return nil
+	}
+
+	if _, err := b.config(ctx, s); err != nil {
+		return err
+	}
+	names, err := s.List(ctx, configPrefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := b.namedConfig(ctx, s, name); err != nil {
+			return err
+		}
+	}
+	if _, err := b.claimsConfig(ctx, s); err != nil {
+		return err
+	}
+	roles, err := s.List(ctx, rolePrefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range roles {
+		if _, err := b.role(ctx, s, name); err != nil {
+			return err
+		}
+	}
+
+	atomic.StoreUint32(&b.storageUpgraded, 1)
+	return nil
+}
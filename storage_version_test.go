@@ -0,0 +1,162 @@
+package oidc
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// putRaw stores the JSON as is, as an older release of the plugin wrote it.
+func putRaw(t *testing.T, s logical.Storage, key, value string) {
+	if err := s.Put(context.Background(), &logical.StorageEntry{Key: key, Value: []byte(value)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storedVersion(t *testing.T, s logical.Storage, key string) int {
+	entry, err := s.Get(context.Background(), key)
+	if err != nil || entry == nil {
+		t.Fatalf("error reading %s: %v", key, err)
+	}
+
+	var stored struct {
+		Version int `json:"version"`
+	}
+	if err := entry.DecodeJSON(&stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored.Version
+}
+
+// seedVersion0 stores the config, claims and role in the format of the
+// releases which predate the storage version.
+func seedVersion0(t *testing.T, idp *testIdp, s logical.Storage) {
+	putRaw(t, s, configPath, `{
+		"client_id": "`+testClientID+`",
+		"secret_id": "test-secret",
+		"redirect_url": "`+testRedirectURL+`",
+		"oidc_discovery_url": "`+idp.URL+`",
+		"scopes": ["email"],
+		"ttl": 3600000000000,
+		"max_ttl": 0
+	}`)
+	putRaw(t, s, claimsConfigPath, `{
+		"user_claim": "email",
+		"groups_claim": "groups",
+		"policies_claim": "",
+		"metadata_claims": ["sub"],
+		"all_metadata": false
+	}`)
+	putRaw(t, s, rolePrefix+"reader", `{
+		"policies": ["reader"],
+		"bound_claims": {"email": "user@example.com"}
+	}`)
+}
+
+func TestStorageVersion_LoginAfterUpgrade(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	seedVersion0(t, idp, storage)
+
+	state := idp.startRoleLogin(b, storage, "reader")
+	_, resp, err := callback(b, storage, state, testCode)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("login failed after the upgrade: err: %v resp: %#v", err, resp)
+	}
+	if !reflect.DeepEqual(resp.Auth.Policies, []string{"reader"}) {
+		t.Fatalf("unexpected policies %#v", resp.Auth.Policies)
+	}
+	if !reflect.DeepEqual(resp.Auth.GroupAliases, []*logical.Alias{{Name: "admins"}, {Name: "developers"}}) {
+		t.Fatalf("unexpected group aliases %#v", resp.Auth.GroupAliases)
+	}
+	if resp.Auth.Metadata["sub"] != "user-1" {
+		t.Fatalf("unexpected metadata %#v", resp.Auth.Metadata)
+	}
+
+	// The entries read by the login were written back upgraded
+	for _, key := range []string{configPath, claimsConfigPath, rolePrefix + "reader"} {
+		if version := storedVersion(t, storage, key); version != storageVersion {
+			t.Fatalf("%s has version %d after the login", key, version)
+		}
+	}
+
+	config, err := b.config(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.OIDCResponseMode != responseModeQuery || !reflect.DeepEqual(config.OIDCResponseTypes, []string{"code"}) {
+		t.Fatalf("config defaults were not set: %q %#v", config.OIDCResponseMode, config.OIDCResponseTypes)
+	}
+	if config.ClockSkewLeeway != defaultClockSkewLeeway {
+		t.Fatalf("clock_skew_leeway default was not set: %s", config.ClockSkewLeeway)
+	}
+	claimsConfig, err := b.claimsConfig(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimsConfig.GroupsDelimiter != "," || claimsConfig.DisplayNameClaim != "email" || claimsConfig.BoundClaimsType != boundClaimsString {
+		t.Fatalf("claims defaults were not set: %#v", claimsConfig)
+	}
+}
+
+func TestStorageVersion_UpgradeStorage(t *testing.T) {
+	b, storage := getBackend(t)
+	idp := newTestIdp(t)
+	defer idp.Close()
+	seedVersion0(t, idp, storage)
+	putRaw(t, storage, configPrefix+"partners", `{
+		"client_id": "partners",
+		"secret_id": "partners-secret",
+		"oidc_discovery_url": "`+idp.URL+`"
+	}`)
+
+	if err := b.upgradeStorage(context.Background(), storage); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{configPath, configPrefix + "partners", claimsConfigPath, rolePrefix + "reader"} {
+		if version := storedVersion(t, storage, key); version != storageVersion {
+			t.Fatalf("%s has version %d after the upgrade", key, version)
+		}
+	}
+}
+
+func TestStorageVersion_DowngradeFails(t *testing.T) {
+	tests := []struct {
+		key  string
+		path string
+	}{
+		{configPath, "config"},
+		{claimsConfigPath, "claims"},
+		{rolePrefix + "reader", "role/reader"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			b, storage := getBackend(t)
+			newer := `{"version": 99, "user_claim": "email", "client_id": "vault", "policies": ["reader"]}`
+			putRaw(t, storage, tt.key, newer)
+
+			_, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      tt.path,
+				Storage:   storage,
+			})
+			if err == nil || !strings.Contains(err.Error(), "downgrading the plugin is not supported") {
+				t.Fatalf("expected a downgrade error, got %v", err)
+			}
+
+			// The entry of the newer release is left untouched
+			entry, err := storage.Get(context.Background(), tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(entry.Value) != newer {
+				t.Fatalf("entry was overwritten: %s", entry.Value)
+			}
+		})
+	}
+}
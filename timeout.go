@@ -0,0 +1,37 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// defaultProviderRequestTimeout bounds each request to the Idp when
+// provider_request_timeout is not set.
+const defaultProviderRequestTimeout = 10 * time.Second
+
+// idpContext returns the context of one call to the Idp, bounded by
+// provider_request_timeout so that a hung Idp doesn't hold the login for as
+// long as the Vault request may take.
+func idpContext(ctx context.Context, config *oidcConfig) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, config.providerRequestTimeout())
+}
+
+// idpTimeout returns a 502 error naming the call to the Idp when err was
+// caused by the deadline of ctx or by the HTTP client timeout, nil otherwise.
+func idpTimeout(ctx context.Context, call string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		if ctx.Err() != context.DeadlineExceeded {
+			return nil
+		}
+	}
+
+	return logical.CodedError(http.StatusBadGateway, fmt.Sprintf("the Idp %s request timed out", call))
+}